@@ -6,7 +6,11 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/buildkite/ecs-run-task/parser"
 	"github.com/buildkite/ecs-run-task/runner"
 	"github.com/urfave/cli/v2"
 )
@@ -27,9 +31,30 @@ func main() {
 			Name:  "debug",
 			Usage: "Show debugging information",
 		},
-		&cli.StringFlag{
+		&cli.StringSliceFlag{
 			Name:  "file, f",
-			Usage: "Task definition file in JSON or YAML",
+			Usage: "Task definition file in JSON or YAML, or an http(s) or s3:// URL to fetch it from. Can be specified multiple times to deep merge files over the first, with containers merged by name. A YAML file with several documents separated by --- runs each as its own task definition. Use - to read from stdin",
+		},
+		&cli.StringFlag{
+			Name:  "task",
+			Usage: "An existing task definition `family:revision` to run instead of a file. A bare family runs its latest ACTIVE revision",
+		},
+		&cli.BoolFlag{
+			Name:  "no-describe-on-existing",
+			Usage: "Run the existing --task as is, rather than re-registering it with the log configuration. Logs are only streamed if --name is given and it already logs to --log-group with --name as the stream prefix",
+		},
+		&cli.StringFlag{
+			Name:  "vars-file",
+			Usage: "File of KEY=value lines to use when interpolating the task definition",
+		},
+		&cli.StringFlag{
+			Name:  "vars-precedence",
+			Value: "env",
+			Usage: "Whether the vars file or the environment wins when both set a variable (file or env)",
+		},
+		&cli.StringFlag{
+			Name:  "patch",
+			Usage: "An RFC 6902 JSON Patch to apply to the task definition file before registering it",
 		},
 		&cli.StringFlag{
 			Name:  "name, n",
@@ -45,15 +70,67 @@ func main() {
 			Value: "ecs-task-runner",
 			Usage: "Cloudwatch Log Group Name to write logs to",
 		},
+		&cli.StringFlag{
+			Name:  "log-group-class",
+			Usage: "Log group class to use when creating the log group (STANDARD or INFREQUENT_ACCESS)",
+		},
+		&cli.StringFlag{
+			Name:  "command",
+			Usage: "Command to override with as a single string, split with shell quoting rules. An alternative to passing the command as arguments",
+		},
+		&cli.StringFlag{
+			Name:  "command-base64",
+			Usage: "Command to override with as a base64 encoded JSON array of arguments, such as from echo '[\"echo\",\"hi\"]' | base64, so it passes through tooling unmangled",
+		},
+		&cli.StringFlag{
+			Name:  "service-name",
+			Usage: "Attach to the running tasks of an existing service `NAME` and tail their logs, rather than running a new task",
+		},
 		&cli.StringFlag{
 			Name:  "service, s",
 			Value: "",
 			Usage: "service to replace cmd for",
 		},
+		&cli.StringSliceFlag{
+			Name:  "image",
+			Usage: "Replace a container's image, in the form `NAME=URI`. A bare URI replaces the image of the --service container, or the first container. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "essential",
+			Usage: "Mark a container essential or not, in the form `CONTAINER=true|false`, such as to keep a task running when a container exits while debugging. Can be specified multiple times",
+		},
+		&cli.BoolFlag{
+			Name:  "validate-images",
+			Usage: "Check that the private ECR images of the containers exist before registering the task definition, to catch typos in tags",
+		},
 		&cli.BoolFlag{
 			Name:  "fargate",
 			Usage: "Specified if task is to be run under FARGATE as opposed to EC2",
 		},
+		&cli.StringFlag{
+			Name:  "container-instance",
+			Usage: "Start the task on a specific EC2 container instance `ARN` with StartTask, rather than letting ECS place it",
+		},
+		&cli.StringSliceFlag{
+			Name:  "capacity-provider",
+			Usage: "Run with a capacity provider strategy item in the form `name=weight[:base]` instead of a launch type. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "placement-constraint",
+			Usage: "A placement constraint for EC2 tasks in the form `type=expression`, such as \"memberOf=attribute:ecs.instance-type == t3.medium\". Ignored for FARGATE. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "placement-attribute",
+			Usage: "Place EC2 tasks on instances with a custom attribute, in the form `key=value`, such as gpu=true. Multiple attributes must all match. Ignored for FARGATE. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "placement-strategy",
+			Usage: "A placement strategy for EC2 tasks in the form `type[:field]`, such as spread:attribute:ecs.availability-zone, binpack:memory or random. Ignored for FARGATE. Can be specified multiple times",
+		},
+		&cli.StringFlag{
+			Name:  "platform-version",
+			Usage: "Fargate platform version to run the task on",
+		},
 		&cli.StringSliceFlag{
 			Name:  "security-group",
 			Usage: "Security groups to launch task in (required for FARGATE). Can be specified multiple times",
@@ -62,10 +139,31 @@ func main() {
 			Name:  "subnet",
 			Usage: "Subnet to launch task in (required for FARGATE). Can be specified multiple times",
 		},
+		&cli.StringFlag{
+			Name:  "assign-public-ip",
+			Value: "ENABLED",
+			Usage: "Whether to assign a public IP to tasks with awsvpc networking (ENABLED or DISABLED). Tasks in public subnets without a NAT gateway need one to pull images, so use DISABLED only in private subnets",
+		},
+		&cli.BoolFlag{
+			Name:  "validate-network",
+			Usage: "Check the subnets and security groups exist in the region and share a VPC before running",
+		},
 		&cli.StringSliceFlag{
 			Name:  "env, e",
 			Usage: "An environment variable to add in the form `KEY=value` or `KEY` (shorthand for `KEY=$KEY` to pass through an env var from the current host). Can be specified multiple times",
 		},
+		&cli.StringSliceFlag{
+			Name:  "env-file",
+			Usage: "A file of environment variables to add, with `KEY=value` or `KEY` lines like --env. Can be specified multiple times, with later files and --env winning",
+		},
+		&cli.StringSliceFlag{
+			Name:  "upload-env-file",
+			Usage: "Upload a local env file to --env-file-bucket and add it to a container's environmentFiles, in the form `CONTAINER:path`. Avoids the size limit on --env. The file is deleted once the tasks have stopped, and left in place if the run ends before then. Can be specified multiple times",
+		},
+		&cli.StringFlag{
+			Name:  "env-file-bucket",
+			Usage: "The S3 `BUCKET` to upload --upload-env-file files to",
+		},
 		&cli.BoolFlag{
 			Name:  "inherit-env, E",
 			Usage: "Inherit all of the environment variables from the calling shell",
@@ -75,21 +173,308 @@ func main() {
 			Value: 1,
 			Usage: "Number of tasks to run",
 		},
+		&cli.DurationFlag{
+			Name:  "log-poll-interval",
+			Usage: "How often to poll for new log lines",
+			Value: time.Second * 2,
+		},
+		&cli.DurationFlag{
+			Name:  "log-wait-timeout",
+			Usage: "How long to wait for a container's log stream to exist",
+			Value: time.Minute * 60,
+		},
+		&cli.IntFlag{
+			Name:  "max-concurrent-watchers",
+			Usage: "Maximum number of log streams to poll at once, with the rest waiting their turn (0 for no limit)",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Stop the tasks and fail if the run takes longer than this, such as 30m. Defaults to no timeout",
+		},
 		&cli.StringFlag{
-			Name:  "region, r",
-			Usage: "AWS Region",
+			Name:  "log-prefix-template",
+			Usage: "A Go template for the prefix of each log line, with {{.Task}}, {{.Container}} and {{.Cluster}} fields",
+		},
+		&cli.BoolFlag{
+			Name:  "log-prefix",
+			Usage: "Prefix each log line with [container-name]",
+		},
+		&cli.BoolFlag{
+			Name:  "timestamps",
+			Usage: "Prefix each log line with the time it was logged",
+		},
+		&cli.Int64Flag{
+			Name:  "log-retention-days",
+			Usage: "Set the retention of the log group in days, such as 14. Defaults to leaving it as is, which for new groups is forever",
+		},
+		&cli.StringFlag{
+			Name:    "log-kms-key-id",
+			Aliases: []string{"log-group-kms-key-id"},
+			Usage:   "The ARN of a KMS key to encrypt the log group with when it's created",
+		},
+		&cli.BoolFlag{
+			Name:  "no-create-log-group",
+			Usage: "Don't create the log group if it doesn't exist, for when logs:CreateLogGroup isn't allowed",
+		},
+		&cli.BoolFlag{
+			Name:  "no-color",
+			Usage: "Don't color each container's log lines",
+		},
+		&cli.BoolFlag{
+			Name:  "annotate",
+			Usage: "Annotate the Buildkite build or GitHub Actions run with the result. In GitHub Actions the annotations are workflow commands printed to stdout, so it can't be used with --output",
+		},
+		&cli.IntFlag{
+			Name:  "max-retries",
+			Usage: "How many times to retry running the tasks when ECS throttles or fails transiently, with exponential backoff",
+			Value: 5,
+		},
+		&cli.DurationFlag{
+			Name:  "launch-stagger",
+			Usage: "How long to wait between launching each batch of 10 tasks when --count is more than 10, such as 5s",
+		},
+		&cli.StringFlag{
+			Name:  "print-env",
+			Usage: "Print the environment variables passed to the containers to stderr, either `keys` for just the names or `full` for names and values",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Register the task definition but don't run it",
+		},
+		&cli.BoolFlag{
+			Name:  "wait-exponential-describe",
+			Usage: "While waiting for tasks to stop, back off describing them from every 6s to every minute while their status doesn't change",
+		},
+		&cli.BoolFlag{
+			Name:  "wait-for-attachment",
+			Usage: "Print the private and public IPs of the tasks' network interfaces once they're attached, such as for FARGATE tasks",
+		},
+		&cli.DurationFlag{
+			Name:  "attachment-timeout",
+			Value: 2 * time.Minute,
+			Usage: "How long --wait-for-attachment waits for the network interfaces before warning",
+		},
+		&cli.DurationFlag{
+			Name:  "per-task-timeout",
+			Usage: "Stop any individual task that runs for longer than this, such as 10m, while the others continue. A task that hasn't started, such as one stuck PENDING, is timed from when it was created",
+		},
+		&cli.StringFlag{
+			Name:    "region",
+			Aliases: []string{"r"},
+			Usage:   "AWS Region",
+		},
+		&cli.StringFlag{
+			Name:  "profile",
+			Usage: "The AWS named profile `NAME` to use, rather than the default credential chain",
+		},
+		&cli.StringFlag{
+			Name:  "assume-role-arn",
+			Usage: "An IAM role `ARN` to assume before making any calls, such as for cross-account runs",
+		},
+		&cli.StringFlag{
+			Name:  "assume-role-session-name",
+			Usage: "The session `NAME` for --assume-role-arn. Defaults to a generated one",
+		},
+		&cli.StringFlag{
+			Name:  "endpoint-url",
+			Usage: "Send all AWS calls to this `URL`, such as http://localhost:4566 for LocalStack",
+		},
+		&cli.BoolFlag{
+			Name:  "endpoint-skip-tls-verify",
+			Usage: "Don't verify the TLS certificate of --endpoint-url",
 		},
 		&cli.BoolFlag{
 			Name:  "deregister",
 			Usage: "Deregister task definition once done",
 		},
+		&cli.StringFlag{
+			Name:  "write-arn-file",
+			Usage: "Write the ARN of the task definition that's run to this `PATH`, for later steps to reference or clean up",
+		},
+		&cli.DurationFlag{
+			Name:  "deregister-timeout",
+			Usage: "How long --deregister can take before failing the run",
+			Value: time.Second * 30,
+		},
+		&cli.BoolFlag{
+			Name:  "deregister-previous",
+			Usage: "Deregister the previous revision of the task definition before registering a new one, if ecs-run-task registered it. Can't be used with --task",
+		},
+		&cli.StringSliceFlag{
+			Name:  "tty",
+			Usage: "Allocate a pseudo terminal for the named `CONTAINER`, or for every container with \"all\". Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "add-host",
+			Usage: "Add an /etc/hosts entry to a container in the form `CONTAINER:hostname:ip`. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "working-directory",
+			Usage: "Set the working directory of a container in the form `CONTAINER:dir`, replacing any from the task definition. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "secret",
+			Usage: "Expose a Secrets Manager or SSM Parameter Store secret as an environment variable in the --service container, or the first container, in the form `NAME=arn`. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "secret-file",
+			Usage: "Write a Secrets Manager or SSM Parameter Store secret to a read only file in a container, in the form `CONTAINER:path=arn`. Can be specified multiple times",
+		},
+		&cli.StringFlag{
+			Name:    "task-cpu",
+			Aliases: []string{"cpu"},
+			Usage:   "Set the task level cpu, whether or not there are command overrides, as cpu units like 1024 or vCPUs like \"1 vCPU\", such as to size FARGATE tasks",
+		},
+		&cli.StringFlag{
+			Name:    "task-memory",
+			Aliases: []string{"memory"},
+			Usage:   "Set the task level memory, whether or not there are command overrides, as MiB like 2048 or GB like \"2 GB\", such as to size FARGATE tasks",
+		},
+		&cli.StringSliceFlag{
+			Name:  "container-cpu",
+			Usage: "Override the cpu units of a container in the form `CONTAINER:units`. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "hostname",
+			Usage: "Set the hostname of a container in the form `CONTAINER:hostname`. Not supported with the awsvpc network mode. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "credential-spec",
+			Usage: "Add a Windows gMSA credential spec to a container in the form `CONTAINER:arn`. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns-server",
+			Usage: "Add a DNS server to a container in the form `CONTAINER:ip`. Not supported by FARGATE. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns-search",
+			Usage: "Add a DNS search domain to a container in the form `CONTAINER:domain`. Not supported by FARGATE. Can be specified multiple times",
+		},
+		&cli.BoolFlag{
+			Name:  "expand-command-env",
+			Usage: "Expand $VAR and ${VAR} in the command with the container's environment from the task definition and --env, not the host's. Use $$ for a literal $",
+		},
+		&cli.StringFlag{
+			Name:  "task-role-arn",
+			Usage: "Replace the IAM role of the task definition that the containers use",
+		},
+		&cli.StringFlag{
+			Name:  "execution-role-arn",
+			Usage: "Replace the IAM role of the task definition that ECS uses to pull images, fetch secrets and write logs",
+		},
+		&cli.StringFlag{
+			Name:  "cpu-architecture",
+			Usage: "Set the cpu architecture of the task definition, X86_64 or ARM64 such as for Graviton",
+		},
+		&cli.StringFlag{
+			Name:  "os-family",
+			Usage: "Set the operating system family of the task definition, such as LINUX or WINDOWS_SERVER_2022_CORE",
+		},
+		&cli.Int64Flag{
+			Name:  "ephemeral-storage",
+			Usage: "GiB of ephemeral storage for FARGATE tasks, from 21 to 200. Defaults to 20 GiB",
+		},
+		&cli.Int64Flag{
+			Name:  "stop-timeout",
+			Usage: "Seconds containers have to handle their stop signal before being killed. Defaults to the task definition's stopTimeout",
+		},
+		&cli.BoolFlag{
+			Name:  "enable-execute-command",
+			Usage: "Enable ECS Exec on the task for aws ecs execute-command. Requires a task role with SSM permissions, and warns if the task definition is unlikely to support it",
+		},
+		&cli.StringFlag{
+			Name:  "exit-code-strategy",
+			Usage: "How to choose the exit code from the containers of all the tasks: first (the first non-zero), max (the highest) or any-nonzero (1 if any are non-zero)",
+			Value: "first",
+		},
+		&cli.StringSliceFlag{
+			Name:  "ignore-container",
+			Usage: "Ignore the exit code of a container `NAME`, such as a sidecar that exits non-zero on shutdown. Can be specified multiple times",
+		},
+		&cli.BoolFlag{
+			Name:  "detach",
+			Usage: "Print the ARNs of the tasks once they're launched and exit, without tailing their logs or waiting for them. --deregister is ignored",
+		},
+		&cli.StringFlag{
+			Name:  "wait-for-log",
+			Usage: "Return successfully once a log line matches this `REGEX`, stopping the tasks unless --leave-running is set",
+		},
+		&cli.BoolFlag{
+			Name:  "leave-running",
+			Usage: "Leave the tasks running once --wait-for-log matches",
+		},
+		&cli.StringFlag{
+			Name:  "ready-when",
+			Usage: "Return successfully, leaving the tasks running, once the named container logs a line matching `CONTAINER:REGEX`",
+		},
+		&cli.StringFlag{
+			Name:  "client-token",
+			Usage: "A token to make running the task idempotent. Defaults to one generated from the run ID and the task to run, so retries of a CI job running the same task definition revision don't launch duplicate tasks. Outside CI, set --run-id or this for retries to share a token. A file with several task definitions derives a token for each from this one",
+		},
+		&cli.StringFlag{
+			Name:  "started-by",
+			Value: "ecs-run-task",
+			Usage: "Who the tasks were started by, for filtering tasks in ECS. At most 128 characters",
+		},
+		&cli.StringFlag{
+			Name:  "run-id",
+			Usage: "An `ID` for this run, tagged on the tasks as RunId along with ManagedBy=ecs-run-task. Defaults to one derived from the Buildkite job or GitHub Actions job and attempt, so retries of the job share it, or a random ID outside CI",
+		},
+		&cli.StringSliceFlag{
+			Name:  "tag",
+			Usage: "A tag to add to the task definition and task in the form `KEY=VALUE`. Can be specified multiple times",
+		},
+		&cli.StringFlag{
+			Name:  "propagate-tags",
+			Usage: "Propagate tags to the task from the task definition or service (TASK_DEFINITION or SERVICE)",
+		},
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "Print a summary of the tasks and their timings to stdout once they finish (json or table)",
+		},
+		&cli.BoolFlag{
+			Name:  "print-insights-query",
+			Usage: "Print a CloudWatch Logs Insights query for the run's logs once it finishes",
+		},
+		&cli.BoolFlag{
+			Name:  "audit-secrets",
+			Usage: "Print the Secrets Manager secrets and SSM parameters the task definition's containers reference, including repository credentials, without resolving them. They're also included in the --output summary",
+		},
+		&cli.BoolFlag{
+			Name:  "describe-after",
+			Usage: "Describe the tasks again once they stop and print their attachments and network interfaces for debugging. ECS keeps stopped tasks for about an hour",
+		},
+		&cli.StringFlag{
+			Name:  "result-webhook",
+			Usage: "POST the JSON summary of the run to this `URL` once the tasks finish",
+		},
+		&cli.DurationFlag{
+			Name:  "result-webhook-timeout",
+			Value: 10 * time.Second,
+			Usage: "Timeout for each attempt to POST to the --result-webhook",
+		},
+		&cli.BoolFlag{
+			Name:  "strict-webhook",
+			Usage: "Fail the run if the --result-webhook can't be POSTed to, rather than warning",
+		},
+		&cli.BoolFlag{
+			Name:  "inject-task-metadata",
+			Usage: "Set ECS_CLUSTER and ECS_TASK_DEFINITION in the container environment",
+		},
 	}
 
 	app.Action = func(ctx *cli.Context) error {
-		requireFlagValue(ctx, "file")
+		files := ctx.StringSlice("file")
+		if ctx.String("task") == "" && ctx.String("service-name") == "" {
+			requireFlagValue(ctx, "file")
+		}
 
-		if _, err := os.Stat(ctx.String("file")); err != nil {
-			return cli.NewExitError(err, 1)
+		for _, file := range files {
+			if file != parser.Stdin && !parser.IsURL(file) && !parser.IsS3URL(file) {
+				if _, err := os.Stat(file); err != nil {
+					return cli.NewExitError(err, 1)
+				}
+			}
 		}
 
 		if !ctx.Bool("debug") {
@@ -97,20 +482,148 @@ func main() {
 		}
 
 		r := runner.New()
-		r.TaskDefinitionFile = ctx.String("file")
+		if len(files) > 0 {
+			r.TaskDefinitionFile = files[0]
+			r.OverlayFiles = files[1:]
+		}
+		r.ExistingTaskDefinition = ctx.String("task")
+		r.NoDescribeOnExisting = ctx.Bool("no-describe-on-existing")
+		r.AttachService = ctx.String("service-name")
+		r.VarsFile = ctx.String("vars-file")
+		r.VarsPrecedence = ctx.String("vars-precedence")
+		r.Patch = ctx.String("patch")
 		r.Cluster = ctx.String("cluster")
 		r.TaskName = ctx.String("name")
 		r.LogGroupName = ctx.String("log-group")
+		r.LogGroupClass = ctx.String("log-group-class")
 		r.Fargate = ctx.Bool("fargate")
+		r.PlatformVersion = ctx.String("platform-version")
+		for _, s := range ctx.StringSlice("placement-constraint") {
+			constraint, err := runner.ParsePlacementConstraint(s)
+			if err != nil {
+				return cli.NewExitError(err, 1)
+			}
+			r.PlacementConstraints = append(r.PlacementConstraints, constraint)
+		}
+		attributes, err := runner.ParsePlacementAttributes(ctx.StringSlice("placement-attribute"))
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		if attributes != nil {
+			r.PlacementConstraints = append(r.PlacementConstraints, attributes)
+		}
+		for _, s := range ctx.StringSlice("placement-strategy") {
+			strategy, err := runner.ParsePlacementStrategy(s)
+			if err != nil {
+				return cli.NewExitError(err, 1)
+			}
+			r.PlacementStrategy = append(r.PlacementStrategy, strategy)
+		}
+		for _, s := range ctx.StringSlice("capacity-provider") {
+			item, err := runner.ParseCapacityProvider(s)
+			if err != nil {
+				return cli.NewExitError(err, 1)
+			}
+			r.CapacityProviderStrategy = append(r.CapacityProviderStrategy, item)
+		}
+		r.ContainerInstance = ctx.String("container-instance")
 		r.SecurityGroups = ctx.StringSlice("security-group")
 		r.Subnets = ctx.StringSlice("subnet")
+		r.AssignPublicIp = ctx.String("assign-public-ip")
+		r.ValidateNetwork = ctx.Bool("validate-network")
 		r.Environment = ctx.StringSlice("env")
+		r.EnvFiles = ctx.StringSlice("env-file")
+		r.UploadEnvFiles = ctx.StringSlice("upload-env-file")
+		r.EnvFileBucket = ctx.String("env-file-bucket")
 		r.Count = ctx.Int64("count")
+		r.MaxConcurrentWatchers = ctx.Int("max-concurrent-watchers")
+		r.LogPollInterval = ctx.Duration("log-poll-interval")
+		r.LogWaitTimeout = ctx.Duration("log-wait-timeout")
 		r.Deregister = ctx.Bool("deregister")
+		r.ArnFile = ctx.String("write-arn-file")
+		r.DeregisterPrevious = ctx.Bool("deregister-previous")
+		r.DeregisterTimeout = ctx.Duration("deregister-timeout")
+		r.TTY = ctx.StringSlice("tty")
+		r.InjectTaskMetadata = ctx.Bool("inject-task-metadata")
+		r.StopTimeout = ctx.Int64("stop-timeout")
+		r.EphemeralStorageGiB = ctx.Int64("ephemeral-storage")
+		r.ExpandCommandEnv = ctx.Bool("expand-command-env")
+		r.TaskRoleArn = ctx.String("task-role-arn")
+		r.ExecutionRoleArn = ctx.String("execution-role-arn")
+		r.RuntimePlatform = runner.NewRuntimePlatform(ctx.String("cpu-architecture"), ctx.String("os-family"))
+		r.AddHosts = ctx.StringSlice("add-host")
+		r.Hostnames = ctx.StringSlice("hostname")
+		r.WorkingDirectories = ctx.StringSlice("working-directory")
+		r.SecretFiles = ctx.StringSlice("secret-file")
+		r.ContainerCPU = ctx.StringSlice("container-cpu")
+		r.TaskCPU = ctx.String("task-cpu")
+		r.TaskMemory = ctx.String("task-memory")
+		r.CredentialSpecs = ctx.StringSlice("credential-spec")
+		r.DNSServers = ctx.StringSlice("dns-server")
+		r.DNSSearchDomains = ctx.StringSlice("dns-search")
+		r.EnableExecuteCommand = ctx.Bool("enable-execute-command")
+		r.Output = ctx.String("output")
+		r.PrintInsightsQuery = ctx.Bool("print-insights-query")
+		r.DescribeAfter = ctx.Bool("describe-after")
+		r.AuditSecrets = ctx.Bool("audit-secrets")
+		r.RunID = ctx.String("run-id")
+		r.StartedBy = ctx.String("started-by")
+		r.ClientToken = ctx.String("client-token")
+		r.Detach = ctx.Bool("detach")
+		r.ExitCodeStrategy = ctx.String("exit-code-strategy")
+		r.IgnoredContainers = ctx.StringSlice("ignore-container")
+		r.WaitForLog = ctx.String("wait-for-log")
+		r.LeaveRunning = ctx.Bool("leave-running")
+		r.ReadyWhen = ctx.String("ready-when")
+		r.PropagateTags = ctx.String("propagate-tags")
+
+		images, err := runner.ParseImageOverrides(ctx.StringSlice("image"), ctx.String("service"))
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		r.ImageOverrides = images
+		r.ValidateImages = ctx.Bool("validate-images")
+		r.Essential = ctx.StringSlice("essential")
+
+		secrets, err := runner.ParseSecrets(ctx.StringSlice("secret"), ctx.String("service"))
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		r.Secrets = secrets
+
+		tags, err := runner.ParseTags(ctx.StringSlice("tag"))
+		if err != nil {
+			return cli.NewExitError(err, 1)
+		}
+		r.Tags = tags
+		r.ResultWebhook = ctx.String("result-webhook")
+		r.ResultWebhookTimeout = ctx.Duration("result-webhook-timeout")
+		r.PerTaskTimeout = ctx.Duration("per-task-timeout")
+		r.WaitForAttachment = ctx.Bool("wait-for-attachment")
+		r.AttachmentTimeout = ctx.Duration("attachment-timeout")
+		r.DryRun = ctx.Bool("dry-run")
+		r.LogPrefixTemplate = ctx.String("log-prefix-template")
+		r.LogPrefix = ctx.Bool("log-prefix")
+		r.Timestamps = ctx.Bool("timestamps")
+		r.Annotate = ctx.Bool("annotate")
+		r.NoColor = ctx.Bool("no-color")
+		r.CreateLogGroup = !ctx.Bool("no-create-log-group")
+		r.RetentionDays = ctx.Int64("log-retention-days")
+		r.LogKmsKeyID = ctx.String("log-kms-key-id")
+		r.LaunchStagger = ctx.Duration("launch-stagger")
+		r.MaxRetries = ctx.Int("max-retries")
+		r.PrintEnv = ctx.String("print-env")
+		r.ExponentialDescribe = ctx.Bool("wait-exponential-describe")
+		r.StrictWebhook = ctx.Bool("strict-webhook")
 
 		if r.Region == "" {
 			r.Region = ctx.String("region")
 		}
+		r.Profile = ctx.String("profile")
+		r.AssumeRoleARN = ctx.String("assume-role-arn")
+		r.AssumeRoleSessionName = ctx.String("assume-role-session-name")
+		r.EndpointURL = ctx.String("endpoint-url")
+		r.EndpointSkipTLSVerify = ctx.Bool("endpoint-skip-tls-verify")
 
 		if ctx.Bool("inherit-env") {
 			for _, env := range os.Environ() {
@@ -118,14 +631,67 @@ func main() {
 			}
 		}
 
-		if args := ctx.Args(); args.Len() > 0 {
+		if ctx.String("command-base64") != "" && (ctx.String("command") != "" || ctx.Args().Len() > 0) {
+			return cli.NewExitError("Only one of --command-base64, --command or a command override can be provided", 1)
+		}
+
+		if encoded := ctx.String("command-base64"); encoded != "" {
+			args, err := parser.DecodeCommand(encoded)
+			if err != nil {
+				return cli.NewExitError(err, 1)
+			}
+			r.Overrides = append(r.Overrides, runner.Override{
+				Service: ctx.String("service"),
+				Command: args,
+			})
+		} else if command := ctx.String("command"); command != "" {
+			if ctx.Args().Len() > 0 {
+				return cli.NewExitError("Only one of --command or a command override can be provided", 1)
+			}
+			args, err := parser.SplitCommand(command)
+			if err != nil {
+				return cli.NewExitError(err, 1)
+			}
+			r.Overrides = append(r.Overrides, runner.Override{
+				Service: ctx.String("service"),
+				Command: args,
+			})
+		} else if args := ctx.Args(); args.Len() > 0 {
 			r.Overrides = append(r.Overrides, runner.Override{
 				Service: ctx.String("service"),
 				Command: args.Slice(),
 			})
 		}
 
-		if err := r.Run(context.Background()); err != nil {
+		runCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// cancel the run on the first signal so the tasks get stopped, a
+		// second signal kills us as normal
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			select {
+			case sig := <-signals:
+				fmt.Fprintf(os.Stderr, "Received %v, stopping tasks...\n", sig)
+				signal.Stop(signals)
+				cancel()
+			case <-runCtx.Done():
+			}
+		}()
+
+		if timeout := ctx.Duration("timeout"); timeout > 0 {
+			var cancel context.CancelFunc
+			runCtx, cancel = context.WithTimeout(runCtx, timeout)
+			defer cancel()
+		}
+
+		result, err := r.RunWithResult(runCtx)
+		if err != nil {
+			// the tasks finished, so exit like their containers did
+			if result.ExitCode != 0 {
+				return cli.NewExitError(err, result.ExitCode)
+			}
 			if ec, ok := err.(cli.ExitCoder); ok {
 				return ec
 			}
@@ -143,7 +709,7 @@ func main() {
 }
 
 func requireFlagValue(ctx *cli.Context, name string) {
-	if ctx.String(name) == "" {
+	if !ctx.IsSet(name) {
 		fmt.Fprintf(os.Stderr, "ERROR: Required flag %q isn't set\n\n", name)
 		cli.ShowAppHelpAndExit(ctx, 1)
 	}
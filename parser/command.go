@@ -0,0 +1,85 @@
+package parser
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DecodeCommand decodes a base64 encoded JSON array of arguments, which
+// survives tooling that mangles quotes and special characters
+func DecodeCommand(encoded string) ([]string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode base64 command: %v", err)
+	}
+
+	var args []string
+	if err := json.Unmarshal(decoded, &args); err != nil {
+		return nil, fmt.Errorf("Expected the base64 command to be a JSON array of strings: %v", err)
+	}
+	if len(args) == 0 {
+		return nil, errors.New("Expected the base64 command to have at least one argument")
+	}
+	return args, nil
+}
+
+// SplitCommand splits a command string into arguments the way a shell would,
+// honoring single quotes, double quotes and backslash escapes
+func SplitCommand(command string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var inArg, escaped bool
+	var quote rune
+
+	for _, c := range command {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' {
+				escaped = true
+			} else {
+				current.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+			inArg = true
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+
+	if escaped {
+		return nil, errors.New("Failed to split command: trailing backslash")
+	}
+	if quote != 0 {
+		return nil, errors.New("Failed to split command: unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
@@ -0,0 +1,64 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	for command, expected := range map[string][]string{
+		`echo hello`:                {"echo", "hello"},
+		`  echo   hello  `:          {"echo", "hello"},
+		`foo 'bar baz'`:             {"foo", "bar baz"},
+		`foo "bar baz"`:             {"foo", "bar baz"},
+		`sh -c "echo \"hi\" there"`: {"sh", "-c", `echo "hi" there`},
+		`echo 'it'"'"'s'`:           {"echo", "it's"},
+		`echo bar\ baz`:             {"echo", "bar baz"},
+		`echo ''`:                   {"echo", ""},
+		``:                          nil,
+	} {
+		args, err := SplitCommand(command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(args, expected) {
+			t.Fatalf("Expected %q to split into %q, got %q", command, expected, args)
+		}
+	}
+}
+
+func TestSplitCommandUnterminated(t *testing.T) {
+	for _, command := range []string{`foo 'bar`, `foo "bar`, `foo bar\`} {
+		if _, err := SplitCommand(command); err == nil {
+			t.Fatalf("Expected an error for %q, got nil", command)
+		}
+	}
+}
+
+func TestDecodeCommand(t *testing.T) {
+	// ["sh","-c","echo \"it's $HOME\" && exit 3"]
+	args, err := DecodeCommand("WyJzaCIsIi1jIiwiZWNobyBcIml0J3MgJEhPTUVcIiAmJiBleGl0IDMiXQ==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"sh", "-c", `echo "it's $HOME" && exit 3`}
+	if len(args) != len(expected) {
+		t.Fatalf("bad args %q", args)
+	}
+	for i := range expected {
+		if args[i] != expected[i] {
+			t.Fatalf("bad args %q", args)
+		}
+	}
+
+	for _, encoded := range []string{
+		"not base64!",
+		"eyJjb21tYW5kIjoiZWNobyJ9", // {"command":"echo"}
+		"WyJlY2hvIiwxXQ==",         // ["echo",1]
+		"W10=",                     // []
+	} {
+		if _, err := DecodeCommand(encoded); err == nil {
+			t.Fatalf("Expected an error for %q, got nil", encoded)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package parser
+
+// mergedByName are the lists whose items are merged by their name rather than
+// the list being replaced
+var mergedByName = map[string]bool{
+	"containerDefinitions": true,
+}
+
+// merge deep merges an overlay document into a base one. Maps are merged
+// recursively, container definitions are merged by name with new ones
+// appended, and anything else in the overlay, including other lists,
+// replaces the base value.
+func merge(base, overlay interface{}) interface{} {
+	baseMap, ok := base.(map[string]interface{})
+	if !ok {
+		return overlay
+	}
+	overlayMap, ok := overlay.(map[string]interface{})
+	if !ok {
+		return overlay
+	}
+
+	for key, value := range overlayMap {
+		existing, exists := baseMap[key]
+		if !exists {
+			baseMap[key] = value
+			continue
+		}
+		if mergedByName[key] {
+			if baseList, ok := existing.([]interface{}); ok {
+				if overlayList, ok := value.([]interface{}); ok {
+					baseMap[key] = mergeByName(baseList, overlayList)
+					continue
+				}
+			}
+		}
+		baseMap[key] = merge(existing, value)
+	}
+
+	return baseMap
+}
+
+// mergeByName merges items with the same name, appending the others
+func mergeByName(base, overlay []interface{}) []interface{} {
+	for _, item := range overlay {
+		name, ok := itemName(item)
+		if !ok {
+			base = append(base, item)
+			continue
+		}
+
+		merged := false
+		for i, existing := range base {
+			if existingName, ok := itemName(existing); ok && existingName == name {
+				base[i] = merge(existing, item)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			base = append(base, item)
+		}
+	}
+	return base
+}
+
+func itemName(item interface{}) (string, bool) {
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	name, ok := m["name"].(string)
+	return name, ok
+}
@@ -0,0 +1,93 @@
+package parser
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const baseYAML = `
+family: llamas
+cpu: "256"
+containerDefinitions:
+  - name: app
+    image: app:latest
+    memory: 128
+    command: ["serve", "--port", "80"]
+    environment:
+      - name: LOG_LEVEL
+        value: debug
+  - name: sidecar
+    image: sidecar:latest
+`
+
+const prodYAML = `
+cpu: "1024"
+containerDefinitions:
+  - name: app
+    memory: 512
+    command: ["serve", "--port", "8080"]
+  - name: datadog
+    image: datadog/agent:latest
+`
+
+func filesServer() *httptest.Server {
+	files := map[string]string{"/base.yml": baseYAML, "/prod.yml": prodYAML}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(files[r.URL.Path]))
+	}))
+}
+
+func TestParseFilesOverridesScalars(t *testing.T) {
+	ts := filesServer()
+	defer ts.Close()
+
+	def, err := ParseFiles([]string{ts.URL + "/base.yml", ts.URL + "/prod.yml"}, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *def.Family != "llamas" || *def.Cpu != "1024" {
+		t.Fatalf("bad family %q and cpu %q", *def.Family, *def.Cpu)
+	}
+}
+
+func TestParseFilesMergesContainersByName(t *testing.T) {
+	ts := filesServer()
+	defer ts.Close()
+
+	def, err := ParseFiles([]string{ts.URL + "/base.yml", ts.URL + "/prod.yml"}, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, c := range def.ContainerDefinitions {
+		names = append(names, *c.Name)
+	}
+	if len(names) != 3 || names[0] != "app" || names[1] != "sidecar" || names[2] != "datadog" {
+		t.Fatalf("bad containers %v", names)
+	}
+
+	app := def.ContainerDefinitions[0]
+	if *app.Image != "app:latest" || *app.Memory != 512 {
+		t.Fatalf("Expected app to keep its image and take the overlay memory, got %q and %d", *app.Image, *app.Memory)
+	}
+	if len(app.Environment) != 1 || *app.Environment[0].Name != "LOG_LEVEL" {
+		t.Fatalf("Expected app to keep its environment, got %v", app.Environment)
+	}
+}
+
+func TestParseFilesReplacesLists(t *testing.T) {
+	ts := filesServer()
+	defer ts.Close()
+
+	def, err := ParseFiles([]string{ts.URL + "/base.yml", ts.URL + "/prod.yml"}, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	command := def.ContainerDefinitions[0].Command
+	if len(command) != 3 || *command[2] != "8080" {
+		t.Fatalf("Expected the overlay command to replace the base one, got %v", command)
+	}
+}
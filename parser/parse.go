@@ -3,32 +3,92 @@ package parser
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/buildkite/interpolate"
 	"github.com/ghodss/yaml"
 )
 
+// Parse reads a task definition from a file or http(s) URL, interpolates it
+// with the provided environment and returns it ready for registration
 func Parse(file string, env []string) (*ecs.RegisterTaskDefinitionInput, error) {
-	body, err := ioutil.ReadFile(file)
+	return ParseWithPatch(file, env, "")
+}
+
+// ParseWithPatch is like Parse, but applies an RFC 6902 JSON Patch to the
+// interpolated task definition before it's converted
+func ParseWithPatch(file string, env []string, patch string) (*ecs.RegisterTaskDefinitionInput, error) {
+	return ParseFiles([]string{file}, env, patch, nil)
+}
+
+// ParseFiles is like ParseWithPatch, but deep merges several task definition
+// files in order, so later files override earlier ones. See merge for how
+// they're merged. Files with s3:// URLs are fetched with s3Client.
+func ParseFiles(files []string, env []string, patch string, s3Client ObjectGetter) (*ecs.RegisterTaskDefinitionInput, error) {
+	inputs, err := ParseAll(files, env, patch, s3Client)
 	if err != nil {
 		return nil, err
 	}
+	if len(inputs) > 1 {
+		return nil, fmt.Errorf("%s has %d task definitions, expected one", files[0], len(inputs))
+	}
+	return inputs[0], nil
+}
 
-	interpolated, err := interpolate.Interpolate(
-		interpolate.NewSliceEnv(env),
-		string(body),
-	)
-	if err != nil {
-		return nil, err
+// ParseAll is like ParseFiles, but the first file may be a multi-document
+// YAML file with several task definitions separated by ---. The later files
+// and the patch are applied to each of them, and they're returned in order.
+func ParseAll(files []string, env []string, patch string, s3Client ObjectGetter) ([]*ecs.RegisterTaskDefinitionInput, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no task definition files given")
+	}
+
+	stdinFiles := 0
+	for _, file := range files {
+		if file == Stdin {
+			stdinFiles++
+		}
+	}
+	if stdinFiles > 1 {
+		return nil, fmt.Errorf("only one task definition file can be read from stdin")
 	}
 
-	unmarshaled, err := unmarshal([]byte(interpolated))
+	docs, err := parseDocuments(files[0], env, s3Client)
 	if err != nil {
 		return nil, err
 	}
 
+	for _, file := range files[1:] {
+		overlay, err := parseFile(file, env, s3Client)
+		if err != nil {
+			return nil, err
+		}
+		for i := range docs {
+			docs[i] = merge(docs[i], overlay)
+		}
+	}
+
+	inputs := make([]*ecs.RegisterTaskDefinitionInput, len(docs))
+	for i, doc := range docs {
+		if inputs[i], err = convert(doc, patch); err != nil {
+			return nil, err
+		}
+	}
+
+	return inputs, nil
+}
+
+// convert applies the patch to an unmarshaled task definition and turns it
+// into a RegisterTaskDefinitionInput
+func convert(unmarshaled interface{}, patch string) (*ecs.RegisterTaskDefinitionInput, error) {
+	var err error
+	if patch != "" {
+		if unmarshaled, err = applyPatch(unmarshaled, patch); err != nil {
+			return nil, err
+		}
+	}
+
 	// Return to json which aws will parse
 	jsonBytes, err := json.Marshal(unmarshaled)
 	if err != nil {
@@ -42,9 +102,106 @@ func Parse(file string, env []string) (*ecs.RegisterTaskDefinitionInput, error)
 		return nil, err
 	}
 
+	if patch != "" {
+		if err = result.Validate(); err != nil {
+			return nil, fmt.Errorf("Patched task definition is invalid: %v", err)
+		}
+	}
+
 	return &result, nil
 }
 
+// parseFile reads and interpolates a task definition file that holds a
+// single task definition
+func parseFile(file string, env []string, s3Client ObjectGetter) (interface{}, error) {
+	docs, err := parseDocuments(file, env, s3Client)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) > 1 {
+		return nil, fmt.Errorf("%s has %d task definitions, expected one", file, len(docs))
+	}
+	return docs[0], nil
+}
+
+// parseDocuments reads and interpolates a task definition file, returning
+// each of the YAML documents in it. Empty documents are skipped.
+func parseDocuments(file string, env []string, s3Client ObjectGetter) ([]interface{}, error) {
+	body, err := readSource(file, s3Client)
+	if err != nil {
+		return nil, err
+	}
+
+	expr, err := interpolate.NewParser(string(body)).Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	interpolated, err := requireVariables(expr).Expand(interpolate.NewSliceEnv(env))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to interpolate %s: %v", file, err)
+	}
+
+	var docs []interface{}
+	for _, part := range splitDocuments(interpolated) {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		doc, err := unmarshal([]byte(part))
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, doc)
+	}
+	if len(docs) == 0 {
+		return nil, fmt.Errorf("%s has no task definition", file)
+	}
+
+	return docs, nil
+}
+
+// splitDocuments splits a YAML stream on its --- document separators
+func splitDocuments(body string) []string {
+	var parts []string
+	var current []string
+	for _, line := range strings.Split(body, "\n") {
+		if isDocumentSeparator(line) {
+			parts = append(parts, strings.Join(current, "\n"))
+			current = nil
+			continue
+		}
+		current = append(current, line)
+	}
+	return append(parts, strings.Join(current, "\n"))
+}
+
+// isDocumentSeparator returns whether a line is a --- document separator,
+// which can be followed by whitespace and a comment
+func isDocumentSeparator(line string) bool {
+	if !strings.HasPrefix(line, "---") {
+		return false
+	}
+	rest := strings.TrimRight(line[3:], " \t\r")
+	if rest == "" {
+		return true
+	}
+	return (rest[0] == ' ' || rest[0] == '\t') && strings.HasPrefix(strings.TrimLeft(rest, " \t"), "#")
+}
+
+// requireVariables makes plain $VAR and ${VAR} expansions fail if the
+// variable isn't set, so a missing variable doesn't silently interpolate to
+// nothing. Use ${VAR:-default} or ${VAR-default} for a fallback.
+func requireVariables(expr interpolate.Expression) interpolate.Expression {
+	required := make(interpolate.Expression, len(expr))
+	for i, item := range expr {
+		if v, ok := item.Expansion.(interpolate.VariableExpansion); ok {
+			item.Expansion = interpolate.RequiredExpansion{Identifier: v.Identifier}
+		}
+		required[i] = item
+	}
+	return required
+}
+
 func unmarshal(body []byte) (interface{}, error) {
 	var unmarshaled interface{}
 
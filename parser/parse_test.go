@@ -0,0 +1,201 @@
+package parser
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const helloWorldYAML = `
+family: ${FAMILY}
+containerDefinitions:
+  - name: helloworld
+    image: alpine:latest
+    memory: 128
+`
+
+func TestParseFromURL(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(helloWorldYAML))
+	}))
+	defer ts.Close()
+
+	def, err := Parse(ts.URL+"/taskdefinition.yml", []string{"FAMILY=llamas"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *def.Family != "llamas" {
+		t.Fatalf("bad family %q", *def.Family)
+	}
+	if l := len(def.ContainerDefinitions); l != 1 {
+		t.Fatalf("bad number of container definitions %d", l)
+	}
+}
+
+func TestParseFromURLWithErrorStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	_, err := Parse(ts.URL, nil)
+	if err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	if !strings.Contains(err.Error(), "404 Not Found") {
+		t.Fatalf("bad error message returned: %q", err.Error())
+	}
+}
+
+func TestParseFromStdin(t *testing.T) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+	stdin = strings.NewReader(helloWorldYAML)
+
+	def, err := Parse(Stdin, []string{"FAMILY=llamas"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *def.Family != "llamas" {
+		t.Fatalf("bad family %q", *def.Family)
+	}
+	if l := len(def.ContainerDefinitions); l != 1 {
+		t.Fatalf("bad number of container definitions %d", l)
+	}
+}
+
+func TestParseFilesFromStdinOnlyOnce(t *testing.T) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+	stdin = strings.NewReader(helloWorldYAML)
+
+	if _, err := ParseFiles([]string{Stdin, Stdin}, nil, "", nil); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+}
+
+func TestParseInterpolationDefaults(t *testing.T) {
+	const body = `
+family: ${FAMILY}
+containerDefinitions:
+  - name: app
+    image: myapp:${IMAGE_TAG:-latest}
+    memory: 128
+`
+	defer func(r io.Reader) { stdin = r }(stdin)
+
+	for _, tc := range []struct {
+		env      []string
+		expected string
+	}{
+		{[]string{"FAMILY=llamas", "IMAGE_TAG=v1.2.3"}, "myapp:v1.2.3"},
+		{[]string{"FAMILY=llamas"}, "myapp:latest"},
+		{[]string{"FAMILY=llamas", "IMAGE_TAG="}, "myapp:latest"},
+	} {
+		stdin = strings.NewReader(body)
+		def, err := Parse(Stdin, tc.env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if image := *def.ContainerDefinitions[0].Image; image != tc.expected {
+			t.Fatalf("Expected image %q with %q, got %q", tc.expected, tc.env, image)
+		}
+	}
+}
+
+func TestParseUnsetVariableWithoutDefault(t *testing.T) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+	stdin = strings.NewReader(helloWorldYAML)
+
+	_, err := Parse(Stdin, nil)
+	if err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	if !strings.Contains(err.Error(), "$FAMILY: not set") {
+		t.Fatalf("bad error message returned: %q", err.Error())
+	}
+}
+
+func TestParseAllMultipleDocuments(t *testing.T) {
+	const body = `
+family: ${FAMILY}-one
+containerDefinitions:
+  - name: one
+    image: alpine:latest
+    memory: 128
+---
+family: ${FAMILY}-two
+containerDefinitions:
+  - name: two
+    image: alpine:latest
+    memory: 128
+---
+`
+	defer func(r io.Reader) { stdin = r }(stdin)
+	stdin = strings.NewReader(body)
+
+	defs, err := ParseAll([]string{Stdin}, []string{"FAMILY=llamas"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 2 {
+		t.Fatalf("expected 2 task definitions, got %d", len(defs))
+	}
+	for i, family := range []string{"llamas-one", "llamas-two"} {
+		if *defs[i].Family != family {
+			t.Fatalf("bad family %q, expected %q", *defs[i].Family, family)
+		}
+	}
+}
+
+func TestParseAllSeparatorsWithComments(t *testing.T) {
+	body := "family: one\n" +
+		"containerDefinitions:\n  - name: one\n    image: alpine:latest\n" +
+		"--- # the second task\n" +
+		"family: two\n" +
+		"containerDefinitions:\n  - name: two\n    image: alpine:latest\n" +
+		"---   \n" +
+		"family: three\n" +
+		"containerDefinitions:\n  - name: three\n    image: alpine:latest\n"
+	defer func(r io.Reader) { stdin = r }(stdin)
+	stdin = strings.NewReader(body)
+
+	defs, err := ParseAll([]string{Stdin}, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs) != 3 {
+		t.Fatalf("expected 3 task definitions, got %d", len(defs))
+	}
+	for i, family := range []string{"one", "two", "three"} {
+		if *defs[i].Family != family {
+			t.Fatalf("bad family %q, expected %q", *defs[i].Family, family)
+		}
+	}
+}
+
+func TestIsDocumentSeparator(t *testing.T) {
+	for line, expected := range map[string]bool{
+		"---":             true,
+		"---   ":          true,
+		"---\r":           true,
+		"--- # comment":   true,
+		"---\t# comment":  true,
+		"---#not-comment": false,
+		"----":            false,
+		"  ---":           false,
+	} {
+		if got := isDocumentSeparator(line); got != expected {
+			t.Errorf("isDocumentSeparator(%q) = %v, expected %v", line, got, expected)
+		}
+	}
+}
+
+func TestParseFilesRejectsMultipleDocuments(t *testing.T) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+	stdin = strings.NewReader(helloWorldYAML + "---\n" + helloWorldYAML)
+
+	if _, err := ParseFiles([]string{Stdin}, []string{"FAMILY=llamas"}, "", nil); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+}
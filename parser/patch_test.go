@@ -0,0 +1,64 @@
+package parser
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func helloWorldServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(helloWorldYAML))
+	}))
+}
+
+func TestParseWithPatchReplaceAndAdd(t *testing.T) {
+	ts := helloWorldServer()
+	defer ts.Close()
+	file := ts.URL + "/taskdefinition.yml"
+
+	def, err := ParseWithPatch(file, []string{"FAMILY=llamas"}, `[
+		{"op": "replace", "path": "/containerDefinitions/0/image", "value": "alpine:3.12"},
+		{"op": "add", "path": "/containerDefinitions/0/environment", "value": [{"name": "FOO", "value": "bar"}]}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container := def.ContainerDefinitions[0]
+	if *container.Image != "alpine:3.12" {
+		t.Fatalf("bad image %q", *container.Image)
+	}
+	if l := len(container.Environment); l != 1 {
+		t.Fatalf("bad number of environment variables %d", l)
+	}
+	if *container.Environment[0].Name != "FOO" || *container.Environment[0].Value != "bar" {
+		t.Fatalf("bad environment variable %v", container.Environment[0])
+	}
+}
+
+func TestParseWithPatchErrors(t *testing.T) {
+	ts := helloWorldServer()
+	defer ts.Close()
+	file := ts.URL + "/taskdefinition.yml"
+
+	for _, tc := range []struct {
+		patch string
+		err   string
+	}{
+		{`{"op": "add"}`, "Failed to parse patch"},
+		{`[{"op": "frobnicate", "path": "/family"}]`, "unknown op"},
+		{`[{"op": "add", "path": "/family"}]`, "missing a value"},
+		{`[{"op": "replace", "path": "/nope", "value": 1}]`, `key "nope" not found`},
+		{`[{"op": "remove", "path": "/containerDefinitions/1"}]`, "out of range"},
+		{`[{"op": "remove", "path": "/family"}]`, "Patched task definition is invalid"},
+	} {
+		_, err := ParseWithPatch(file, []string{"FAMILY=llamas"}, tc.patch)
+		if err == nil {
+			t.Errorf("expected an error for %s", tc.patch)
+		} else if !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected error containing %q for %s, got %q", tc.err, tc.patch, err.Error())
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package parser
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Stdin is the task definition file that means read from stdin
+const Stdin = "-"
+
+var (
+	// httpTimeout is how long to wait when fetching a task definition over http
+	httpTimeout = time.Second * 30
+
+	// stdin is where a task definition file of Stdin is read from
+	stdin io.Reader = os.Stdin
+)
+
+// ObjectGetter gets objects from S3
+type ObjectGetter interface {
+	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+}
+
+// IsS3URL returns whether a task definition file refers to an s3:// URL
+func IsS3URL(file string) bool {
+	return strings.HasPrefix(file, "s3://")
+}
+
+// IsURL returns whether a task definition file refers to an http(s) URL
+func IsURL(file string) bool {
+	return strings.HasPrefix(file, "http://") || strings.HasPrefix(file, "https://")
+}
+
+// readSource reads a task definition body from a local file, an http(s) URL
+// or an s3:// URL with the S3 client
+func readSource(file string, s3Client ObjectGetter) ([]byte, error) {
+	if file == Stdin {
+		return ioutil.ReadAll(stdin)
+	}
+	if IsURL(file) {
+		return fetchURL(file)
+	}
+	if IsS3URL(file) {
+		return fetchS3(s3Client, file)
+	}
+	return ioutil.ReadFile(file)
+}
+
+func fetchS3(client ObjectGetter, url string) ([]byte, error) {
+	if client == nil {
+		return nil, fmt.Errorf("Failed to fetch %s: no S3 client", url)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(url, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid S3 URL %q, expected s3://bucket/key", url)
+	}
+
+	resp, err := client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(parts[0]),
+		Key:    aws.String(parts[1]),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func fetchURL(url string) ([]byte, error) {
+	client := &http.Client{Timeout: httpTimeout}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch %s: %s", url, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
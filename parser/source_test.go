@@ -0,0 +1,80 @@
+package parser
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type mockS3 struct {
+	objects map[string]string
+	gets    []string
+}
+
+func (m *mockS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	key := *input.Bucket + "/" + *input.Key
+	m.gets = append(m.gets, key)
+	body, ok := m.objects[key]
+	if !ok {
+		return nil, errors.New("NoSuchKey")
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+}
+
+func TestParseFromS3(t *testing.T) {
+	client := &mockS3{objects: map[string]string{
+		"my-bucket/task-definitions/hello.yml": helloWorldYAML,
+	}}
+
+	def, err := ParseFiles([]string{"s3://my-bucket/task-definitions/hello.yml"}, []string{"FAMILY=llamas"}, "", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *def.Family != "llamas" {
+		t.Fatalf("bad family %q", *def.Family)
+	}
+	if len(client.gets) != 1 {
+		t.Fatalf("Expected a single GetObject, got %v", client.gets)
+	}
+
+	if _, err := ParseFiles([]string{"s3://my-bucket/missing.yml"}, nil, "", client); err == nil {
+		t.Fatal("Expected an error for a missing object")
+	}
+	if _, err := ParseFiles([]string{"s3://my-bucket"}, nil, "", client); err == nil {
+		t.Fatal("Expected an error for a URL without a key")
+	}
+	if _, err := Parse("s3://my-bucket/task-definitions/hello.yml", nil); err == nil {
+		t.Fatal("Expected an error without an S3 client")
+	}
+}
+
+func TestParseFromFileDoesntUseS3(t *testing.T) {
+	client := &mockS3{}
+
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "hello.yml")
+	if err := ioutil.WriteFile(file, []byte(helloWorldYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	def, err := ParseFiles([]string{file}, []string{"FAMILY=llamas"}, "", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *def.Family != "llamas" {
+		t.Fatalf("bad family %q", *def.Family)
+	}
+	if len(client.gets) != 0 {
+		t.Fatalf("Expected no GetObject calls, got %v", client.gets)
+	}
+}
@@ -0,0 +1,103 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// VarsPrecedenceEnv makes the process environment win over a vars file
+	VarsPrecedenceEnv = "env"
+
+	// VarsPrecedenceFile makes a vars file win over the process environment
+	VarsPrecedenceFile = "file"
+)
+
+// ReadVarsFile reads interpolation variables from a file of KEY=value lines.
+// Blank lines and lines starting with # are ignored.
+func ReadVarsFile(file string) ([]string, error) {
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var vars []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for line := 1; scanner.Scan(); line++ {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		if !strings.Contains(l, "=") {
+			return nil, fmt.Errorf("Failed to parse %s:%d: expected KEY=value", file, line)
+		}
+		vars = append(vars, l)
+	}
+
+	return vars, scanner.Err()
+}
+
+// ReadEnvFile reads environment variables from a file of KEY=value lines, or
+// bare KEY lines to pass through a variable from the current environment.
+// Blank lines and lines starting with # are ignored, and values can be
+// wrapped in single or double quotes.
+func ReadEnvFile(file string) ([]string, error) {
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var env []string
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for line := 1; scanner.Scan(); line++ {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		parts := strings.SplitN(l, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("Failed to parse %s:%d: expected KEY=value or KEY", file, line)
+		}
+		if len(parts) == 1 {
+			env = append(env, key)
+			continue
+		}
+		env = append(env, key+"="+unquote(strings.TrimSpace(parts[1])))
+	}
+
+	return env, scanner.Err()
+}
+
+// unquote removes matching single or double quotes around a value
+func unquote(value string) string {
+	if len(value) >= 2 {
+		first, last := value[0], value[len(value)-1]
+		if first == last && (first == '"' || first == '\'') {
+			return value[1 : len(value)-1]
+		}
+	}
+	return value
+}
+
+// MergeVars combines the process environment with variables from a vars file,
+// with the precedence deciding which wins when a variable is in both
+func MergeVars(env []string, vars []string, precedence string) ([]string, error) {
+	merged := make([]string, 0, len(env)+len(vars))
+
+	// later values win during interpolation
+	switch precedence {
+	case VarsPrecedenceEnv, "":
+		merged = append(append(merged, vars...), env...)
+	case VarsPrecedenceFile:
+		merged = append(append(merged, env...), vars...)
+	default:
+		return nil, fmt.Errorf("unknown vars precedence %q, expected %q or %q",
+			precedence, VarsPrecedenceFile, VarsPrecedenceEnv)
+	}
+
+	return merged, nil
+}
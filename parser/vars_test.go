@@ -0,0 +1,92 @@
+package parser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/interpolate"
+)
+
+func TestReadVarsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "vars")
+	if err := ioutil.WriteFile(file, []byte("# a comment\n\nFAMILY=llamas\nIMAGE=alpine:latest\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	vars, err := ReadVarsFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vars) != 2 || vars[0] != "FAMILY=llamas" || vars[1] != "IMAGE=alpine:latest" {
+		t.Fatalf("bad vars %v", vars)
+	}
+}
+
+func TestMergeVarsPrecedence(t *testing.T) {
+	env := []string{"FAMILY=from-env"}
+	vars := []string{"FAMILY=from-file"}
+
+	for precedence, expected := range map[string]string{
+		VarsPrecedenceEnv:  "from-env",
+		VarsPrecedenceFile: "from-file",
+	} {
+		merged, err := MergeVars(env, vars, precedence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := interpolate.NewSliceEnv(merged).Get("FAMILY")
+		if value != expected {
+			t.Fatalf("Expected %q with %s precedence, got %q", expected, precedence, value)
+		}
+	}
+}
+
+func TestMergeVarsUnknownPrecedence(t *testing.T) {
+	if _, err := MergeVars(nil, nil, "llamas"); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+}
+
+func TestReadEnvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, ".env")
+	body := "# database\nDB_HOST=db.internal\n\n  DB_NAME = \"my db\"  \nGREETING='hello=world'\nHOME\nEMPTY=\n"
+	if err := ioutil.WriteFile(file, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := ReadEnvFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"DB_HOST=db.internal", "DB_NAME=my db", "GREETING=hello=world", "HOME", "EMPTY="}
+	if len(env) != len(expected) {
+		t.Fatalf("bad env %q", env)
+	}
+	for i := range expected {
+		if env[i] != expected[i] {
+			t.Fatalf("bad env %q", env)
+		}
+	}
+
+	if err := ioutil.WriteFile(file, []byte("NOT A KEY=value\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadEnvFile(file); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+}
@@ -0,0 +1,117 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+const annotationContext = "ecs-run-task"
+
+// annotation is how to annotate a CI build with the result of a run, either
+// a command to run or workflow commands to print to stdout
+type annotation struct {
+	Command []string
+	Output  string
+}
+
+// newAnnotation returns the annotation for the CI system the environment
+// belongs to, or nil if it isn't Buildkite or GitHub Actions. It fails along
+// with the run's exit code, listing the containers that aren't ignored.
+func newAnnotation(lookupEnv func(string) (string, bool), summary *Summary, ignored []string) *annotation {
+	var failures []string
+	if summary.ExitCode != 0 {
+		failures = summaryFailures(summary, ignored)
+		if len(failures) == 0 {
+			failures = []string{summary.ExitReason}
+		}
+	}
+
+	if v, ok := lookupEnv("BUILDKITE"); ok && v == "true" {
+		style, body := "success", fmt.Sprintf("ECS run %s succeeded", summary.RunID)
+		if len(failures) > 0 {
+			style = "error"
+			body = fmt.Sprintf("ECS run %s failed:\n\n* %s", summary.RunID, strings.Join(failures, "\n* "))
+		}
+		return &annotation{
+			Command: []string{"buildkite-agent", "annotate", "--style", style, "--context", annotationContext, body},
+		}
+	}
+
+	if isGitHubActions(lookupEnv) {
+		if len(failures) == 0 {
+			return &annotation{
+				Output: fmt.Sprintf("::notice title=%s::%s\n", annotationContext,
+					escapeWorkflowCommand(fmt.Sprintf("ECS run %s succeeded", summary.RunID))),
+			}
+		}
+		var b strings.Builder
+		for _, failure := range failures {
+			fmt.Fprintf(&b, "::error title=%s::%s\n", annotationContext, escapeWorkflowCommand(failure))
+		}
+		return &annotation{Output: b.String()}
+	}
+
+	return nil
+}
+
+// isGitHubActions returns whether the environment is a GitHub Actions run,
+// where annotations are workflow commands printed to stdout
+func isGitHubActions(lookupEnv func(string) (string, bool)) bool {
+	v, ok := lookupEnv("GITHUB_ACTIONS")
+	return ok && v == "true"
+}
+
+// Write runs the annotation command or prints the annotation to w
+func (a *annotation) Write(w io.Writer) error {
+	if len(a.Command) > 0 {
+		log.Printf("Annotating build with %s", a.Command[0])
+		cmd := exec.Command(a.Command[0], a.Command[1:]...)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	_, err := io.WriteString(w, a.Output)
+	return err
+}
+
+// summaryFailures describes each container that didn't exit with zero, other
+// than the ignored ones
+func summaryFailures(summary *Summary, ignored []string) []string {
+	tasks, _ := ignoreContainers(summary.Tasks, ignored)
+
+	var failures []string
+	for _, task := range tasks {
+		for _, container := range task.Containers {
+			switch {
+			case container.ExitCode == nil:
+				failures = append(failures, fmt.Sprintf("Container %s in task %s didn't exit: %s",
+					container.Name, path.Base(task.TaskArn), firstNonEmpty(container.Reason, task.StoppedReason, "unknown reason")))
+			case *container.ExitCode != 0:
+				failures = append(failures, fmt.Sprintf("Container %s in task %s exited with %d",
+					container.Name, path.Base(task.TaskArn), *container.ExitCode))
+			}
+		}
+	}
+	return failures
+}
+
+// firstNonEmpty returns the first of its arguments that isn't empty, so
+// callers can give their own fallback last
+func firstNonEmpty(s ...string) string {
+	for _, v := range s {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// escapeWorkflowCommand escapes a GitHub Actions workflow command message
+func escapeWorkflowCommand(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
@@ -0,0 +1,103 @@
+package runner
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func fakeEnv(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+}
+
+var failedSummary = &Summary{
+	RunID:      "abc123",
+	ExitCode:   3,
+	ExitReason: "container app exited with 3",
+	Tasks: []TaskSummary{{
+		TaskArn: "arn:aws:ecs:us-east-1:012345678910:task/my-cluster/def456",
+		Containers: []ContainerSummary{
+			{Name: "app", ExitCode: aws.Int64(3)},
+			{Name: "sidecar", ExitCode: aws.Int64(0)},
+		},
+	}},
+}
+
+func TestBuildkiteAnnotation(t *testing.T) {
+	a := newAnnotation(fakeEnv(map[string]string{"BUILDKITE": "true"}), failedSummary, nil)
+	if a == nil {
+		t.Fatal("Expected an annotation")
+	}
+
+	expected := []string{"buildkite-agent", "annotate", "--style", "error", "--context", "ecs-run-task",
+		"ECS run abc123 failed:\n\n* Container app in task def456 exited with 3"}
+	if len(a.Command) != len(expected) {
+		t.Fatalf("bad command %q", a.Command)
+	}
+	for i := range expected {
+		if a.Command[i] != expected[i] {
+			t.Fatalf("bad command %q", a.Command)
+		}
+	}
+}
+
+func TestGitHubActionsAnnotation(t *testing.T) {
+	a := newAnnotation(fakeEnv(map[string]string{"GITHUB_ACTIONS": "true"}), failedSummary, nil)
+	if a == nil {
+		t.Fatal("Expected an annotation")
+	}
+	if len(a.Command) != 0 {
+		t.Fatalf("Expected no command, got %q", a.Command)
+	}
+	if a.Output != "::error title=ecs-run-task::Container app in task def456 exited with 3\n" {
+		t.Fatalf("bad output %q", a.Output)
+	}
+
+	a = newAnnotation(fakeEnv(map[string]string{"GITHUB_ACTIONS": "true"}), &Summary{RunID: "abc123"}, nil)
+	if a.Output != "::notice title=ecs-run-task::ECS run abc123 succeeded\n" {
+		t.Fatalf("bad output %q", a.Output)
+	}
+}
+
+func TestAnnotationIgnoresContainers(t *testing.T) {
+	summary := &Summary{
+		RunID: "abc123",
+		Tasks: []TaskSummary{{
+			TaskArn: "arn:aws:ecs:us-east-1:012345678910:task/my-cluster/def456",
+			Containers: []ContainerSummary{
+				{Name: "app", ExitCode: aws.Int64(0)},
+				{Name: "sidecar", ExitCode: aws.Int64(137)},
+			},
+		}},
+	}
+	exitTasks, _ := ignoreContainers(summary.Tasks, []string{"sidecar"})
+	summary.ExitCode, summary.ExitReason = computeExitCode(exitTasks, ExitCodeFirst)
+
+	a := newAnnotation(fakeEnv(map[string]string{"GITHUB_ACTIONS": "true"}), summary, []string{"sidecar"})
+	if a.Output != "::notice title=ecs-run-task::ECS run abc123 succeeded\n" {
+		t.Fatalf("Expected a success with the sidecar ignored, got %q", a.Output)
+	}
+
+	a = newAnnotation(fakeEnv(map[string]string{"BUILDKITE": "true"}), summary, []string{"sidecar"})
+	if a.Command[3] != "success" {
+		t.Fatalf("Expected a success with the sidecar ignored, got %q", a.Command)
+	}
+}
+
+func TestNoAnnotationOutsideCI(t *testing.T) {
+	if a := newAnnotation(fakeEnv(nil), failedSummary, nil); a != nil {
+		t.Fatalf("Expected no annotation, got %+v", a)
+	}
+}
+
+func TestFirstNonEmpty(t *testing.T) {
+	if s := firstNonEmpty("", "b", "c"); s != "b" {
+		t.Fatalf("Expected b, got %q", s)
+	}
+	if s := firstNonEmpty("", ""); s != "" {
+		t.Fatalf("Expected no fallback of its own, got %q", s)
+	}
+}
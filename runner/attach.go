@@ -0,0 +1,134 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// attach tails the logs of the running tasks of an existing service until
+// they stop or the context is cancelled
+func (r *Runner) attach(ctx context.Context, printer *colorPrinter) error {
+	sess, err := r.newSession()
+	if err != nil {
+		return err
+	}
+	svc := ecs.New(sess)
+	cwl := cloudwatchlogs.New(sess)
+
+	taskARNs, err := serviceTaskArns(svc, r.Cluster, r.AttachService)
+	if err != nil {
+		return err
+	}
+	if len(taskARNs) == 0 {
+		fmt.Fprintf(os.Stderr, "No running tasks found for service %s\n", r.AttachService)
+		return nil
+	}
+
+	output, err := describeTasks(svc, r.Cluster, aws.StringSlice(taskARNs))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var watchers sync.WaitGroup
+	pollLogs := limitLogPolling(cwl, r.MaxConcurrentWatchers)
+	definitions := map[string]*ecs.RegisterTaskDefinitionInput{}
+
+	for _, task := range output.Tasks {
+		fmt.Fprintf(os.Stderr, "Task %s is %s\n", path.Base(*task.TaskArn), aws.StringValue(task.LastStatus))
+
+		def, ok := definitions[*task.TaskDefinitionArn]
+		if !ok {
+			if def, err = describeTaskDefinition(ctx, svc, *task.TaskDefinitionArn); err != nil {
+				return err
+			}
+			definitions[*task.TaskDefinitionArn] = def
+		}
+
+		for _, container := range def.ContainerDefinitions {
+			logGroup, streamPrefix, ok := awslogsConfiguration(container)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "WARNING: container %s doesn't log to cloudwatch with a stream prefix, so can't be tailed\n", *container.Name)
+				continue
+			}
+
+			fields := logPrefixFields{
+				Task:      path.Base(*task.TaskArn),
+				Container: *container.Name,
+				Cluster:   r.Cluster,
+			}
+			stream := fmt.Sprintf("%s/%s/%s", streamPrefix, *container.Name, path.Base(*task.TaskArn))
+			watcher := r.newLogWatcher(pollLogs, logGroup, stream, func(ev *cloudwatchlogs.FilteredLogEvent) bool {
+				printer.Print(fields, ev)
+				return true
+			})
+
+			watchers.Add(1)
+			go func() {
+				defer watchers.Done()
+				if err := watcher.Watch(ctx); err != nil && err != context.Canceled {
+					log.Printf("Log watcher returned error: %v", err)
+				}
+			}()
+		}
+	}
+
+	for {
+		werr := waitUntilTasksStopped(ctx, svc, r.Cluster, aws.StringSlice(taskARNs))
+		if werr == nil {
+			break
+		}
+		if !isAwsTimeOutError(werr) {
+			cancel()
+			watchers.Wait()
+			return werr
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "All tasks for service %s have stopped\n", r.AttachService)
+	cancel()
+	watchers.Wait()
+
+	return nil
+}
+
+// serviceTaskArns returns the ARNs of the running tasks of a service
+func serviceTaskArns(svc ecsInterface, cluster, service string) ([]string, error) {
+	log.Printf("Listing tasks for service %s", service)
+
+	var arns []string
+	err := svc.ListTasksPages(&ecs.ListTasksInput{
+		Cluster:       aws.String(cluster),
+		ServiceName:   aws.String(service),
+		DesiredStatus: aws.String(ecs.DesiredStatusRunning),
+	}, func(page *ecs.ListTasksOutput, lastPage bool) bool {
+		arns = append(arns, aws.StringValueSlice(page.TaskArns)...)
+		return !lastPage
+	})
+
+	return arns, err
+}
+
+// awslogsConfiguration returns the log group and stream prefix a container
+// definition logs to, if it uses the awslogs driver with a stream prefix
+func awslogsConfiguration(def *ecs.ContainerDefinition) (string, string, bool) {
+	if def.LogConfiguration == nil || aws.StringValue(def.LogConfiguration.LogDriver) != "awslogs" {
+		return "", "", false
+	}
+	group := aws.StringValue(def.LogConfiguration.Options["awslogs-group"])
+	prefix := aws.StringValue(def.LogConfiguration.Options["awslogs-stream-prefix"])
+	if group == "" || prefix == "" {
+		return "", "", false
+	}
+	return group, prefix, true
+}
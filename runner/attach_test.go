@@ -0,0 +1,62 @@
+package runner
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestServiceTaskArns(t *testing.T) {
+	svc := &mockECS{
+		serviceTasks: map[string][]string{
+			"my-service": {
+				"arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123",
+				"arn:aws:ecs:us-east-1:012345678910:task/my-cluster/def456",
+			},
+		},
+	}
+
+	arns, err := serviceTaskArns(svc, "my-cluster", "my-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123",
+		"arn:aws:ecs:us-east-1:012345678910:task/my-cluster/def456",
+	}
+	if !reflect.DeepEqual(arns, expected) {
+		t.Fatalf("Expected %v, got %v", expected, arns)
+	}
+}
+
+func TestServiceTaskArnsWithNoTasks(t *testing.T) {
+	arns, err := serviceTaskArns(&mockECS{}, "my-cluster", "my-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(arns) != 0 {
+		t.Fatalf("Expected no tasks, got %v", arns)
+	}
+}
+
+func TestAwslogsConfiguration(t *testing.T) {
+	group, prefix, ok := awslogsConfiguration(&ecs.ContainerDefinition{
+		LogConfiguration: &ecs.LogConfiguration{
+			LogDriver: aws.String("awslogs"),
+			Options: map[string]*string{
+				"awslogs-group":         aws.String("my-group"),
+				"awslogs-stream-prefix": aws.String("my-prefix"),
+			},
+		},
+	})
+	if !ok || group != "my-group" || prefix != "my-prefix" {
+		t.Fatalf("bad awslogs configuration %q %q %v", group, prefix, ok)
+	}
+
+	if _, _, ok := awslogsConfiguration(&ecs.ContainerDefinition{}); ok {
+		t.Fatal("Expected no awslogs configuration")
+	}
+}
@@ -0,0 +1,131 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+const (
+	// defaultAttachmentTimeout is how long to wait for a task's network
+	// interface if no timeout is given
+	defaultAttachmentTimeout = 2 * time.Minute
+
+	// eniAttachmentType is the type of a task's awsvpc network interface
+	eniAttachmentType = "ElasticNetworkInterface"
+)
+
+// attachmentPollInterval is how often the tasks are described while waiting
+// for their network interfaces
+var attachmentPollInterval = 5 * time.Second
+
+// taskNetworkInterface is the network interface ECS attached to a task
+type taskNetworkInterface struct {
+	ID        string
+	PrivateIP string
+	PublicIP  string
+}
+
+// networkInterface returns a task's network interface, once ECS has attached
+// one and given it an IP
+func networkInterface(task *ecs.Task) (taskNetworkInterface, bool) {
+	for _, attachment := range task.Attachments {
+		if aws.StringValue(attachment.Type) != eniAttachmentType {
+			continue
+		}
+		var ni taskNetworkInterface
+		for _, detail := range attachment.Details {
+			switch aws.StringValue(detail.Name) {
+			case "networkInterfaceId":
+				ni.ID = aws.StringValue(detail.Value)
+			case "privateIPv4Address":
+				ni.PrivateIP = aws.StringValue(detail.Value)
+			}
+		}
+		if ni.ID != "" && ni.PrivateIP != "" {
+			return ni, true
+		}
+	}
+	return taskNetworkInterface{}, false
+}
+
+// waitForAttachments describes the tasks until each has a network interface,
+// writing their IPs as they appear. ECS doesn't report public IPs, so they're
+// looked up in EC2. Tasks that stop without one are skipped.
+func waitForAttachments(ctx context.Context, w io.Writer, svc ecsInterface, ec2svc ec2Interface, cluster string,
+	taskARNs []*string, timeout time.Duration, sleep func(context.Context, time.Duration) error) error {
+	pending := map[string]bool{}
+	for _, arn := range taskARNs {
+		pending[*arn] = true
+	}
+
+	for waited := time.Duration(0); ; waited += attachmentPollInterval {
+		output, err := describeTasks(svc, cluster, taskARNs)
+		if err != nil && !isRateLimited(err) {
+			return err
+		} else if err == nil {
+			for _, task := range output.Tasks {
+				arn := aws.StringValue(task.TaskArn)
+				if !pending[arn] {
+					continue
+				}
+				if ni, ok := networkInterface(task); ok {
+					ni.PublicIP = publicIP(ec2svc, ni.ID)
+					writeNetworkInterface(w, arn, ni)
+					delete(pending, arn)
+				} else if aws.StringValue(task.LastStatus) == ecs.DesiredStatusStopped {
+					delete(pending, arn)
+				}
+			}
+		}
+
+		if len(pending) == 0 {
+			return nil
+		}
+		if waited >= timeout {
+			var arns []string
+			for arn := range pending {
+				arns = append(arns, arn)
+			}
+			sort.Strings(arns)
+			return fmt.Errorf("no network interface attached to %s after %v", strings.Join(arns, ", "), timeout)
+		}
+		if err := sleep(ctx, attachmentPollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// publicIP returns the public IP of a network interface, if it has one
+func publicIP(svc ec2Interface, id string) string {
+	output, err := svc.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+		NetworkInterfaceIds: aws.StringSlice([]string{id}),
+	})
+	if err != nil {
+		log.Printf("Failed to describe network interface %s: %v", id, err)
+		return ""
+	}
+	for _, ni := range output.NetworkInterfaces {
+		if ni.Association != nil {
+			return aws.StringValue(ni.Association.PublicIp)
+		}
+	}
+	return ""
+}
+
+func writeNetworkInterface(w io.Writer, taskArn string, ni taskNetworkInterface) {
+	fmt.Fprintf(w, "Task %s network interface %s: private IP %s", path.Base(taskArn), ni.ID, ni.PrivateIP)
+	if ni.PublicIP != "" {
+		fmt.Fprintf(w, ", public IP %s", ni.PublicIP)
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,89 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestWaitForAttachmentsPrintsIPs(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123"
+	task := &ecs.Task{
+		TaskArn:    aws.String(taskArn),
+		LastStatus: aws.String("PROVISIONING"),
+		Attachments: []*ecs.Attachment{
+			{Type: aws.String("ElasticNetworkInterface"), Status: aws.String("PRECREATED")},
+		},
+	}
+	svc := &mockECS{tasks: map[string]*ecs.Task{taskArn: task}}
+	ec2svc := &mockEC2{
+		networkInterfaces: []*ec2.NetworkInterface{
+			{
+				NetworkInterfaceId: aws.String("eni-456"),
+				Association:        &ec2.NetworkInterfaceAssociation{PublicIp: aws.String("203.0.113.7")},
+			},
+		},
+	}
+
+	// the interface is attached after the first describe
+	var slept int
+	sleep := func(ctx context.Context, d time.Duration) error {
+		slept++
+		svc.Lock()
+		defer svc.Unlock()
+		task.LastStatus = aws.String("RUNNING")
+		task.Attachments[0].Status = aws.String("ATTACHED")
+		task.Attachments[0].Details = []*ecs.KeyValuePair{
+			{Name: aws.String("subnetId"), Value: aws.String("subnet-123")},
+			{Name: aws.String("networkInterfaceId"), Value: aws.String("eni-456")},
+			{Name: aws.String("privateIPv4Address"), Value: aws.String("10.0.0.12")},
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	err := waitForAttachments(context.Background(), &buf, svc, ec2svc, "my-cluster",
+		aws.StringSlice([]string{taskArn}), time.Minute, sleep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slept != 1 {
+		t.Fatalf("Expected to describe twice, slept %d times", slept)
+	}
+	expected := "Task abc123 network interface eni-456: private IP 10.0.0.12, public IP 203.0.113.7\n"
+	if buf.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestWaitForAttachmentsTimesOut(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123"
+	svc := &mockECS{
+		tasks: map[string]*ecs.Task{
+			taskArn: {TaskArn: aws.String(taskArn), LastStatus: aws.String("PROVISIONING")},
+		},
+	}
+
+	var slept time.Duration
+	sleep := func(ctx context.Context, d time.Duration) error {
+		slept += d
+		return nil
+	}
+
+	var buf bytes.Buffer
+	err := waitForAttachments(context.Background(), &buf, svc, &mockEC2{}, "my-cluster",
+		aws.StringSlice([]string{taskArn}), 30*time.Second, sleep)
+	if err == nil || !strings.Contains(err.Error(), "no network interface attached to "+taskArn) {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+	if slept != 30*time.Second || buf.Len() != 0 {
+		t.Fatalf("Expected to wait 30s without printing, waited %v and printed %q", slept, buf.String())
+	}
+}
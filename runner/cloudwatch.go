@@ -5,13 +5,18 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/sts"
 )
 
 const (
@@ -20,6 +25,9 @@ const (
 )
 
 type cloudwatchLogsInterface interface {
+	DescribeLogGroups(input *cloudwatchlogs.DescribeLogGroupsInput) (*cloudwatchlogs.DescribeLogGroupsOutput, error)
+	CreateLogGroup(input *cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error)
+	PutRetentionPolicy(input *cloudwatchlogs.PutRetentionPolicyInput) (*cloudwatchlogs.PutRetentionPolicyOutput, error)
 	DescribeLogStreamsPages(input *cloudwatchlogs.DescribeLogStreamsInput,
 		fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool) error
 	DescribeLogStreams(input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error)
@@ -107,13 +115,16 @@ func (lw *logWaiter) Wait(ctx context.Context) error {
 			return fmt.Errorf("Timed out waiting for stream %s", lw.LogStreamName)
 		case <-ticker.C:
 			continue
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
 
 func isRateLimited(err error) bool {
 	if aerr, ok := err.(awserr.Error); ok {
-		if aerr.Code() == "Throttling" {
+		switch aerr.Code() {
+		case "Throttling", "ThrottlingException":
 			return true
 		}
 	}
@@ -131,14 +142,16 @@ type logWatcher struct {
 	Interval time.Duration
 	Timeout  time.Duration
 
-	mu   sync.Mutex
-	stop chan struct{}
+	mu      sync.Mutex
+	stop    chan struct{}
+	stopped bool
 }
 
 // Watch follows the log stream and prints events via a Printer
 func (lw *logWatcher) Watch(ctx context.Context) error {
 	lw.mu.Lock()
 	lw.stop = make(chan struct{})
+	stop := lw.stop
 	lw.mu.Unlock()
 
 	waiter := &logWaiter{
@@ -151,26 +164,51 @@ func (lw *logWatcher) Watch(ctx context.Context) error {
 
 	after := time.Now().Unix() * 1000
 
-	if err := waiter.Wait(ctx); err != nil {
-		return err
+	// stopping before the stream exists, such as for a container that never
+	// started, stops waiting for it as there's nothing to print
+	waitCtx, cancelWait := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-stop:
+			cancelWait()
+		case <-waitCtx.Done():
+		}
+	}()
+	err := waiter.Wait(waitCtx)
+	cancelWait()
+	if err != nil {
+		select {
+		case <-stop:
+			return nil
+		default:
+			return err
+		}
 	}
 
-	var err error
-
 	pollInterval := lw.Interval
 	if pollInterval == time.Duration(0) {
-		pollInterval = time.Second * 2
+		pollInterval = defaultLogPollInterval
 	}
 
+	// where the last poll started from and the events it saw, so the drain
+	// once stopped can look back over it without printing them twice
+	lastAfter, seen := after, map[string]bool{}
+
 	for {
 		select {
 		case <-time.After(pollInterval):
-			if after, err = lw.printEventsAfter(ctx, after); err != nil {
+			lastAfter, seen = after, map[string]bool{}
+			if after, err = lw.printEventsAfter(ctx, after, seen); err != nil {
 				return err
 			}
 
 		case <-lw.stop:
-			return nil
+			// events can still arrive once the watcher is stopped, such as
+			// lines written just before the container finished message but
+			// ingested after it, with earlier timestamps than it. So print
+			// anything new since the start of the last poll.
+			_, err = lw.printEventsAfter(ctx, lastAfter, seen)
+			return err
 
 		case <-ctx.Done():
 			return ctx.Err()
@@ -183,14 +221,18 @@ func (lw *logWatcher) Stop() error {
 	lw.mu.Lock()
 	defer lw.mu.Unlock()
 	if lw.stop != nil {
-		close(lw.stop)
+		if !lw.stopped {
+			close(lw.stop)
+			lw.stopped = true
+		}
 		return nil
 	}
 	return errors.New("Log watcher not started")
 }
 
-// printEventsAfter prints events from a given stream after a given timestamp
-func (lw *logWatcher) printEventsAfter(ctx context.Context, ts int64) (int64, error) {
+// printEventsAfter prints events from a given stream after a given timestamp,
+// skipping and then recording those in seen
+func (lw *logWatcher) printEventsAfter(ctx context.Context, ts int64, seen map[string]bool) (int64, error) {
 	log.Printf("Printing events in stream %q after %d", lw.LogStreamName, ts)
 	t := time.Now()
 	var count int64
@@ -204,6 +246,11 @@ func (lw *logWatcher) printEventsAfter(ctx context.Context, ts int64) (int64, er
 	err := lw.CloudWatchLogs.FilterLogEventsPages(filterInput,
 		func(p *cloudwatchlogs.FilterLogEventsOutput, lastPage bool) (shouldContinue bool) {
 			for _, event := range p.Events {
+				id := eventID(event)
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
 				count++
 				if !lw.Printer(event) {
 					log.Printf("Stopping log watcher via print function")
@@ -222,6 +269,15 @@ func (lw *logWatcher) printEventsAfter(ctx context.Context, ts int64) (int64, er
 	return ts, err
 }
 
+// eventID identifies a log event, falling back to its timestamp and message
+// if it has no ID
+func eventID(event *cloudwatchlogs.FilteredLogEvent) string {
+	if event.EventId != nil {
+		return *event.EventId
+	}
+	return fmt.Sprintf("%d/%s", aws.Int64Value(event.Timestamp), aws.StringValue(event.Message))
+}
+
 // logWriter appends a line to a finished log stream
 type logWriter struct {
 	CloudWatchLogs cloudwatchLogsInterface
@@ -284,25 +340,150 @@ func (lw *logWriter) WriteString(ctx context.Context, msg string) error {
 	return err
 }
 
-func createLogGroup(sess *session.Session, logGroup string) error {
-	cwl := cloudwatchlogs.New(sess)
-	groups, err := cwl.DescribeLogGroups(&cloudwatchlogs.DescribeLogGroupsInput{
-		Limit:              aws.Int64(1),
-		LogGroupNamePrefix: aws.String(logGroup),
-	})
+// logRetentionDays are the retention periods CloudWatch Logs allows
+var logRetentionDays = []int64{
+	1, 3, 5, 7, 14, 30, 60, 90, 120, 150, 180, 365, 400, 545, 731,
+	1096, 1827, 2192, 2557, 2922, 3288, 3653,
+}
+
+// validLogRetentionDays returns an error if CloudWatch Logs doesn't allow a
+// retention period
+func validLogRetentionDays(days int64) error {
+	for _, allowed := range logRetentionDays {
+		if days == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid log retention of %d days, expected one of %v", days, logRetentionDays)
+}
+
+// validLogKmsKeyID returns an error if a KMS key doesn't look like a key or
+// alias ARN, or an alias name
+func validLogKmsKeyID(keyID string) error {
+	if strings.HasPrefix(keyID, "alias/") && len(keyID) > len("alias/") {
+		return nil
+	}
+	if a, err := arn.Parse(keyID); err == nil && a.Service == "kms" &&
+		(strings.HasPrefix(a.Resource, "key/") || strings.HasPrefix(a.Resource, "alias/")) {
+		return nil
+	}
+	return fmt.Errorf("invalid log KMS key %q, expected a key ARN or alias", keyID)
+}
+
+// createLogGroup creates a log group if it doesn't exist, with an optional
+// log group class and KMS key which only apply to newly created groups. If
+// retentionDays is set, the group's retention is set or updated to match.
+func createLogGroup(cwl cloudwatchLogsInterface, logGroup, logGroupClass, kmsKeyID string, retentionDays int64) error {
+	group, err := describeLogGroup(cwl, logGroup)
 	if err != nil {
 		return err
 	}
-	if len(groups.LogGroups) == 0 {
+	if group == nil {
 		log.Printf("Creating log group %s", logGroup)
-		_, err = cwl.CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{
+		input := &cloudwatchlogs.CreateLogGroupInput{
 			LogGroupName: aws.String(logGroup),
-		})
+		}
+		if logGroupClass != "" {
+			input.LogGroupClass = aws.String(logGroupClass)
+		}
+		if kmsKeyID != "" {
+			input.KmsKeyId = aws.String(kmsKeyID)
+		}
+		_, err = cwl.CreateLogGroup(input)
 		if err != nil {
 			return err
 		}
+		group = &cloudwatchlogs.LogGroup{LogGroupName: aws.String(logGroup)}
 	} else {
 		log.Printf("Log group %s exists", logGroup)
 	}
-	return nil
+	return setLogRetention(cwl, group, retentionDays)
+}
+
+// setLogRetention sets a log group's retention if it's set and differs
+func setLogRetention(cwl cloudwatchLogsInterface, group *cloudwatchlogs.LogGroup, retentionDays int64) error {
+	if retentionDays == 0 || aws.Int64Value(group.RetentionInDays) == retentionDays {
+		return nil
+	}
+	log.Printf("Setting retention of log group %s to %d days", *group.LogGroupName, retentionDays)
+	_, err := cwl.PutRetentionPolicy(&cloudwatchlogs.PutRetentionPolicyInput{
+		LogGroupName:    group.LogGroupName,
+		RetentionInDays: aws.Int64(retentionDays),
+	})
+	return err
+}
+
+type stsInterface interface {
+	GetCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error)
+}
+
+// logGroupArn returns the ARN of a log group in the caller's account, as used
+// in IAM policies
+func logGroupArn(svc stsInterface, region, logGroup string) (string, error) {
+	identity, err := svc.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("failed to find the account id: %v", err)
+	}
+	return arn.ARN{
+		Partition: partitionForRegion(region),
+		Service:   "logs",
+		Region:    region,
+		AccountID: aws.StringValue(identity.Account),
+		Resource:  "log-group:" + logGroup,
+	}.String(), nil
+}
+
+// partitionForRegion returns the partition of a region for building ARNs,
+// such as aws-cn for cn-north-1, defaulting to aws
+func partitionForRegion(region string) string {
+	if p, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region); ok {
+		return p.ID()
+	}
+	return endpoints.AwsPartitionID
+}
+
+// describeLogGroup returns the log group with exactly the given name, or nil
+// if it doesn't exist
+func describeLogGroup(cwl cloudwatchLogsInterface, logGroup string) (*cloudwatchlogs.LogGroup, error) {
+	groups, err := cwl.DescribeLogGroups(&cloudwatchlogs.DescribeLogGroupsInput{
+		LogGroupNamePrefix: aws.String(logGroup),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups.LogGroups {
+		if aws.StringValue(group.LogGroupName) == logGroup {
+			return group, nil
+		}
+	}
+	return nil, nil
+}
+
+// insightsQuery returns a CloudWatch Logs Insights query for the log streams
+// with a given prefix
+func insightsQuery(streamPrefix string) string {
+	pattern := strings.Replace(regexp.QuoteMeta(streamPrefix+"/"), "/", `\/`, -1)
+	return fmt.Sprintf("fields @timestamp, @logStream, @message\n"+
+		"| filter @logStream like /^%s/\n"+
+		"| sort @timestamp asc", pattern)
+}
+
+// insightsConsoleURL returns the CloudWatch Logs Insights console for a region,
+// on the console domain of the region's partition
+func insightsConsoleURL(region string) string {
+	domain := "console.aws.amazon.com"
+	switch partitionForRegion(region) {
+	case endpoints.AwsCnPartitionID:
+		domain = "console.amazonaws.cn"
+	case endpoints.AwsUsGovPartitionID:
+		domain = "console.amazonaws-us-gov.com"
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     region + "." + domain,
+		Path:     "/cloudwatch/home",
+		RawQuery: url.Values{"region": {region}}.Encode(),
+		Fragment: "logsV2:logs-insights",
+	}
+	return u.String()
 }
@@ -2,6 +2,8 @@ package runner
 
 import (
 	"context"
+	"fmt"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
@@ -9,6 +11,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/sts"
 )
 
 func TestLogsWatcherTimesOutWhenNoStreamIsFound(t *testing.T) {
@@ -30,7 +33,7 @@ func TestLogsWatcherTimesOutWhenNoStreamIsFound(t *testing.T) {
 
 func TestLogsWatcherWaitsForStreamToStart(t *testing.T) {
 	events := []*cloudwatchlogs.FilteredLogEvent{}
-	ts := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	ts := time.Now().Add(time.Second)
 
 	cwlc := &mockCloudWatchLogs{
 		logStreams:      []*cloudwatchlogs.LogStream{},
@@ -54,15 +57,16 @@ func TestLogsWatcherWaitsForStreamToStart(t *testing.T) {
 		<-time.After(time.Millisecond * 20)
 
 		cwlc.Lock()
-		defer cwlc.Unlock()
-
 		cwlc.logStreams = append(cwlc.logStreams, &cloudwatchlogs.LogStream{
 			Arn:           aws.String("my-stream-arn"),
 			LogStreamName: aws.String("my-stream"),
 		})
+		cwlc.Unlock()
 
 		<-time.After(time.Millisecond * 20)
 
+		cwlc.Lock()
+		defer cwlc.Unlock()
 		cwlc.filterLogEvents = append(cwlc.filterLogEvents, &cloudwatchlogs.FilteredLogEvent{
 			EventId:       aws.String("my-event"),
 			LogStreamName: aws.String("my-log-stream"),
@@ -85,6 +89,60 @@ func TestLogsWatcherWaitsForStreamToStart(t *testing.T) {
 	}
 }
 
+func TestLogsWatcherDrainsEventsAfterStopping(t *testing.T) {
+	// after the watcher starts, as it only prints events from then on
+	base := time.Now().Add(time.Second).UnixNano() / int64(time.Millisecond)
+	event := func(msg string, offset int64) *cloudwatchlogs.FilteredLogEvent {
+		return &cloudwatchlogs.FilteredLogEvent{
+			EventId:   aws.String(msg),
+			Message:   aws.String(msg),
+			Timestamp: aws.Int64(base + offset),
+		}
+	}
+
+	cwlc := &mockCloudWatchLogs{
+		logStreams: []*cloudwatchlogs.LogStream{
+			{LogStreamName: aws.String("my-stream")},
+		},
+		filterLogEvents: []*cloudwatchlogs.FilteredLogEvent{
+			event("first", 0),
+			event("Container abc123 exited with 0", 2),
+		},
+	}
+
+	var printed []string
+	w := logWatcher{
+		LogGroupName:  "my-group",
+		LogStreamName: "my-stream",
+		Printer: func(ev *cloudwatchlogs.FilteredLogEvent) bool {
+			if strings.HasPrefix(*ev.Message, "Container abc123 exited") {
+				// a line logged before the finish message arrives after it
+				// has been fetched, the mock holds its lock while printing
+				cwlc.filterLogEvents = append(cwlc.filterLogEvents, event("trailing", 1))
+				return false
+			}
+			printed = append(printed, *ev.Message)
+			return true
+		},
+		CloudWatchLogs: cwlc,
+		Timeout:        time.Second,
+		Interval:       time.Millisecond * 5,
+	}
+
+	if err := w.Watch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(printed, []string{"first", "trailing"}) {
+		t.Fatalf("Expected the trailing event to be printed, got %v", printed)
+	}
+
+	// stopping again is harmless
+	if err := w.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestLogsWatcherRespectsContext(t *testing.T) {
 	cwlc := &mockCloudWatchLogs{
 		logStreams: []*cloudwatchlogs.LogStream{{
@@ -135,12 +193,168 @@ func TestLogsWriterAppendsMessage(t *testing.T) {
 	}
 }
 
+func TestCreateLogGroupWithClass(t *testing.T) {
+	cwlc := &mockCloudWatchLogs{}
+
+	err := createLogGroup(cwlc, "my-group", cloudwatchlogs.LogGroupClassInfrequentAccess, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l := len(cwlc.logGroups); l != 1 {
+		t.Fatal("bad number of log groups created", l)
+	}
+	if class := aws.StringValue(cwlc.logGroups[0].LogGroupClass); class != "INFREQUENT_ACCESS" {
+		t.Fatalf("bad log group class %q", class)
+	}
+}
+
+func TestCreateLogGroupWithKmsKey(t *testing.T) {
+	cwlc := &mockCloudWatchLogs{}
+	key := "arn:aws:kms:us-east-1:012345678910:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+
+	if err := createLogGroup(cwlc, "my-group", "", key, 0); err != nil {
+		t.Fatal(err)
+	}
+	if k := aws.StringValue(cwlc.logGroups[0].KmsKeyId); k != key {
+		t.Fatalf("bad kms key %q", k)
+	}
+
+	// existing groups are left unencrypted
+	cwlc = &mockCloudWatchLogs{
+		logGroups: []*cloudwatchlogs.LogGroup{{LogGroupName: aws.String("my-group")}},
+	}
+	if err := createLogGroup(cwlc, "my-group", "", key, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(cwlc.logGroups) != 1 || cwlc.logGroups[0].KmsKeyId != nil {
+		t.Fatalf("Expected the existing group to be left alone, got %v", cwlc.logGroups)
+	}
+}
+
+func TestValidLogKmsKeyID(t *testing.T) {
+	for _, key := range []string{
+		"arn:aws:kms:us-east-1:012345678910:key/1234abcd-12ab-34cd-56ef-1234567890ab",
+		"arn:aws:kms:us-east-1:012345678910:alias/my-key",
+		"alias/my-key",
+	} {
+		if err := validLogKmsKeyID(key); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", key, err)
+		}
+	}
+	for _, key := range []string{"1234abcd", "alias/", "arn:aws:s3:::my-bucket"} {
+		if err := validLogKmsKeyID(key); err == nil {
+			t.Errorf("Expected %q to be invalid", key)
+		}
+	}
+}
+
+func TestCreateLogGroupSkipsExistingGroup(t *testing.T) {
+	cwlc := &mockCloudWatchLogs{
+		logGroups: []*cloudwatchlogs.LogGroup{{
+			LogGroupName: aws.String("my-group"),
+		}},
+	}
+
+	err := createLogGroup(cwlc, "my-group", cloudwatchlogs.LogGroupClassInfrequentAccess, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l := len(cwlc.logGroups); l != 1 {
+		t.Fatal("bad number of log groups", l)
+	}
+	if cwlc.logGroups[0].LogGroupClass != nil {
+		t.Fatal("expected existing log group to be left alone")
+	}
+}
+
+func TestCreateLogGroupSetsRetention(t *testing.T) {
+	cwlc := &mockCloudWatchLogs{}
+
+	if err := createLogGroup(cwlc, "my-group", "", "", 14); err != nil {
+		t.Fatal(err)
+	}
+	if r := aws.Int64Value(cwlc.logGroups[0].RetentionInDays); r != 14 {
+		t.Fatalf("bad retention %d", r)
+	}
+
+	// an existing group with a different retention is updated
+	if err := createLogGroup(cwlc, "my-group", "", "", 30); err != nil {
+		t.Fatal(err)
+	}
+	if r := aws.Int64Value(cwlc.logGroups[0].RetentionInDays); r != 30 {
+		t.Fatalf("bad retention %d", r)
+	}
+
+	// and left alone if it matches
+	if err := createLogGroup(cwlc, "my-group", "", "", 30); err != nil {
+		t.Fatal(err)
+	}
+	if cwlc.retentionUpdates != 2 {
+		t.Fatal("bad number of retention updates", cwlc.retentionUpdates)
+	}
+}
+
+func TestValidLogRetentionDays(t *testing.T) {
+	if err := validLogRetentionDays(14); err != nil {
+		t.Fatal(err)
+	}
+	if err := validLogRetentionDays(15); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+}
+
 type mockCloudWatchLogs struct {
 	sync.Mutex
 
+	logGroups       []*cloudwatchlogs.LogGroup
 	logStreams      []*cloudwatchlogs.LogStream
 	filterLogEvents []*cloudwatchlogs.FilteredLogEvent
 	inputLogEvents  []*cloudwatchlogs.InputLogEvent
+
+	retentionUpdates int
+}
+
+func (cw *mockCloudWatchLogs) DescribeLogGroups(input *cloudwatchlogs.DescribeLogGroupsInput) (*cloudwatchlogs.DescribeLogGroupsOutput, error) {
+	cw.Lock()
+	defer cw.Unlock()
+
+	output := &cloudwatchlogs.DescribeLogGroupsOutput{
+		LogGroups: []*cloudwatchlogs.LogGroup{},
+	}
+
+	for _, group := range cw.logGroups {
+		if strings.HasPrefix(*group.LogGroupName, *input.LogGroupNamePrefix) {
+			output.LogGroups = append(output.LogGroups, group)
+		}
+	}
+
+	return output, nil
+}
+
+func (cw *mockCloudWatchLogs) CreateLogGroup(input *cloudwatchlogs.CreateLogGroupInput) (*cloudwatchlogs.CreateLogGroupOutput, error) {
+	cw.Lock()
+	defer cw.Unlock()
+	cw.logGroups = append(cw.logGroups, &cloudwatchlogs.LogGroup{
+		LogGroupName:  input.LogGroupName,
+		LogGroupClass: input.LogGroupClass,
+		KmsKeyId:      input.KmsKeyId,
+	})
+	return &cloudwatchlogs.CreateLogGroupOutput{}, nil
+}
+
+func (cw *mockCloudWatchLogs) PutRetentionPolicy(input *cloudwatchlogs.PutRetentionPolicyInput) (*cloudwatchlogs.PutRetentionPolicyOutput, error) {
+	cw.Lock()
+	defer cw.Unlock()
+	for _, group := range cw.logGroups {
+		if *group.LogGroupName == *input.LogGroupName {
+			group.RetentionInDays = input.RetentionInDays
+			cw.retentionUpdates++
+			return &cloudwatchlogs.PutRetentionPolicyOutput{}, nil
+		}
+	}
+	return nil, fmt.Errorf("no log group %s", *input.LogGroupName)
 }
 
 func (cw *mockCloudWatchLogs) DescribeLogStreams(input *cloudwatchlogs.DescribeLogStreamsInput) (*cloudwatchlogs.DescribeLogStreamsOutput, error) {
@@ -172,29 +386,25 @@ func (cw *mockCloudWatchLogs) DescribeLogStreamsPages(input *cloudwatchlogs.Desc
 	return nil
 }
 
+// FilterLogEventsPages returns the events from StartTime on, like CloudWatch
+// Logs. The mock is locked while fn is called.
 func (cw *mockCloudWatchLogs) FilterLogEventsPages(input *cloudwatchlogs.FilterLogEventsInput,
 	fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool) error {
 
-	for {
-		output := &cloudwatchlogs.FilterLogEventsOutput{
-			Events: []*cloudwatchlogs.FilteredLogEvent{},
-		}
-
-		cw.Lock()
+	cw.Lock()
+	defer cw.Unlock()
 
-		if len(cw.filterLogEvents) > 0 {
-			var e *cloudwatchlogs.FilteredLogEvent
-			e, cw.filterLogEvents = cw.filterLogEvents[0], cw.filterLogEvents[1:]
+	output := &cloudwatchlogs.FilterLogEventsOutput{
+		Events: []*cloudwatchlogs.FilteredLogEvent{},
+	}
+	for _, e := range cw.filterLogEvents {
+		if input.StartTime == nil || aws.Int64Value(e.Timestamp) >= *input.StartTime {
 			output.Events = append(output.Events, e)
 		}
-
-		if !fn(output, len(cw.filterLogEvents) == 0) {
-			cw.Unlock()
-			return nil
-		}
-
-		cw.Unlock()
 	}
+
+	fn(output, true)
+	return nil
 }
 
 func (cw *mockCloudWatchLogs) PutLogEvents(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
@@ -203,3 +413,80 @@ func (cw *mockCloudWatchLogs) PutLogEvents(input *cloudwatchlogs.PutLogEventsInp
 	cw.inputLogEvents = append(cw.inputLogEvents, input.LogEvents...)
 	return &cloudwatchlogs.PutLogEventsOutput{}, nil
 }
+
+func TestInsightsQuery(t *testing.T) {
+	expected := "fields @timestamp, @logStream, @message\n" +
+		"| filter @logStream like /^run_task\\.1\\//\n" +
+		"| sort @timestamp asc"
+
+	if query := insightsQuery("run_task.1"); query != expected {
+		t.Fatalf("Expected %q, got %q", expected, query)
+	}
+}
+
+func TestInsightsConsoleURL(t *testing.T) {
+	for region, expected := range map[string]string{
+		"us-east-1":     "https://us-east-1.console.aws.amazon.com/cloudwatch/home?region=us-east-1#logsV2:logs-insights",
+		"cn-north-1":    "https://cn-north-1.console.amazonaws.cn/cloudwatch/home?region=cn-north-1#logsV2:logs-insights",
+		"us-gov-west-1": "https://us-gov-west-1.console.amazonaws-us-gov.com/cloudwatch/home?region=us-gov-west-1#logsV2:logs-insights",
+	} {
+		if url := insightsConsoleURL(region); url != expected {
+			t.Errorf("Expected %q, got %q", expected, url)
+		}
+	}
+}
+
+func TestSetupLogGroupWithoutCreating(t *testing.T) {
+	cwlc := &mockCloudWatchLogs{
+		logGroups: []*cloudwatchlogs.LogGroup{{
+			LogGroupName: aws.String("my-group-other"),
+		}},
+	}
+
+	r := New()
+	r.LogGroupName = "my-group"
+	r.CreateLogGroup = false
+
+	err := r.setupLogGroup(cwlc)
+	if err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Fatalf("Expected a missing log group error, got %v", err)
+	}
+	if l := len(cwlc.logGroups); l != 1 {
+		t.Fatal("Expected no log groups to be created", l)
+	}
+
+	cwlc.logGroups = append(cwlc.logGroups, &cloudwatchlogs.LogGroup{LogGroupName: aws.String("my-group")})
+	if err := r.setupLogGroup(cwlc); err != nil {
+		t.Fatal(err)
+	}
+	if l := len(cwlc.logGroups); l != 2 {
+		t.Fatal("Expected no log groups to be created", l)
+	}
+}
+
+type mockSTS struct {
+	account string
+}
+
+func (m *mockSTS) GetCallerIdentity(input *sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	return &sts.GetCallerIdentityOutput{Account: aws.String(m.account)}, nil
+}
+
+func TestLogGroupArn(t *testing.T) {
+	for _, tc := range []struct {
+		region   string
+		expected string
+	}{
+		{"us-east-1", "arn:aws:logs:us-east-1:012345678910:log-group:ecs-run-task"},
+		{"cn-north-1", "arn:aws-cn:logs:cn-north-1:012345678910:log-group:ecs-run-task"},
+		{"us-gov-west-1", "arn:aws-us-gov:logs:us-gov-west-1:012345678910:log-group:ecs-run-task"},
+	} {
+		groupArn, err := logGroupArn(&mockSTS{account: "012345678910"}, tc.region, "ecs-run-task")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if groupArn != tc.expected {
+			t.Fatalf("Expected %s, got %s", tc.expected, groupArn)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package runner
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+const colorReset = "\x1b[0m"
+
+// containerColors are the ANSI colors containers are assigned from, leaving
+// out black and white so lines are readable on both dark and light terminals
+var containerColors = []string{
+	"\x1b[31m", "\x1b[32m", "\x1b[33m", "\x1b[34m", "\x1b[35m", "\x1b[36m",
+	"\x1b[91m", "\x1b[92m", "\x1b[93m", "\x1b[94m", "\x1b[95m", "\x1b[96m",
+}
+
+// colorPrinter prints log events, coloring each container's lines
+type colorPrinter struct {
+	w      io.Writer
+	prefix *logPrefix
+	color  bool
+
+	mu sync.Mutex
+}
+
+// newColorPrinter returns a printer for stdout, with colors only when it's
+// a terminal and they aren't disabled
+func newColorPrinter(prefix *logPrefix, noColor bool) *colorPrinter {
+	return &colorPrinter{
+		w:      os.Stdout,
+		prefix: prefix,
+		color:  !noColor && isTerminal(os.Stdout),
+	}
+}
+
+// Print prints a log event from a container
+func (p *colorPrinter) Print(fields logPrefixFields, ev *cloudwatchlogs.FilteredLogEvent) {
+	line := p.prefix.FormatEvent(fields, ev)
+	if p.color {
+		line = containerColor(fields.Container) + line + colorReset
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintln(p.w, line)
+}
+
+// containerColor returns a stable color for a container name
+func containerColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return containerColors[h.Sum32()%uint32(len(containerColors))]
+}
+
+// isTerminal returns whether f is a character device like a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
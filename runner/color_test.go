@@ -0,0 +1,38 @@
+package runner
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+func TestContainerColorIsDeterministic(t *testing.T) {
+	for _, name := range []string{"app", "sidecar", "datadog-agent"} {
+		if a, b := containerColor(name), containerColor(name); a != b {
+			t.Fatalf("Expected the same color for %s, got %q and %q", name, a, b)
+		}
+	}
+	if containerColor("app") == containerColor("sidecar") {
+		t.Fatal("Expected app and sidecar to get different colors")
+	}
+}
+
+func TestColorPrinter(t *testing.T) {
+	var buf bytes.Buffer
+	p := &colorPrinter{w: &buf, prefix: &logPrefix{}}
+	ev := &cloudwatchlogs.FilteredLogEvent{Message: aws.String("hello world")}
+
+	p.Print(logPrefixFields{Container: "app"}, ev)
+	if buf.String() != "hello world\n" {
+		t.Fatalf("bad uncolored output %q", buf.String())
+	}
+
+	buf.Reset()
+	p.color = true
+	p.Print(logPrefixFields{Container: "app"}, ev)
+	if expected := containerColor("app") + "hello world" + colorReset + "\n"; buf.String() != expected {
+		t.Fatalf("bad colored output %q", buf.String())
+	}
+}
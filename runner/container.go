@@ -0,0 +1,441 @@
+package runner
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// containerDefinition returns the named container definition
+func containerDefinition(defs []*ecs.ContainerDefinition, name string) (*ecs.ContainerDefinition, error) {
+	for _, def := range defs {
+		if *def.Name == name {
+			return def, nil
+		}
+	}
+	return nil, fmt.Errorf("no container definition named %q", name)
+}
+
+// hostEntry is an extra /etc/hosts entry for a container
+type hostEntry struct {
+	Container string
+	Hostname  string
+	IP        string
+}
+
+// parseAddHost parses an extra host in the form CONTAINER:hostname:ip
+func parseAddHost(s string) (hostEntry, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return hostEntry{}, fmt.Errorf("invalid host %q, expected CONTAINER:hostname:ip", s)
+	}
+	if net.ParseIP(parts[2]) == nil {
+		return hostEntry{}, fmt.Errorf("invalid host %q, %q isn't an IP address", s, parts[2])
+	}
+	return hostEntry{Container: parts[0], Hostname: parts[1], IP: parts[2]}, nil
+}
+
+// addHosts appends extra /etc/hosts entries to container definitions
+func addHosts(defs []*ecs.ContainerDefinition, hosts []string) error {
+	for _, h := range hosts {
+		entry, err := parseAddHost(h)
+		if err != nil {
+			return err
+		}
+		def, err := containerDefinition(defs, entry.Container)
+		if err != nil {
+			return err
+		}
+		log.Printf("Adding host %s (%s) to %s", entry.Hostname, entry.IP, entry.Container)
+		def.ExtraHosts = append(def.ExtraHosts, &ecs.HostEntry{
+			Hostname:  aws.String(entry.Hostname),
+			IpAddress: aws.String(entry.IP),
+		})
+	}
+	return nil
+}
+
+// parseContainerValue parses a flag value in the form CONTAINER:value
+func parseContainerValue(s string) (string, string, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid value %q, expected CONTAINER:value", s)
+	}
+	return parts[0], parts[1], nil
+}
+
+// validDomain returns whether s looks like a DNS search domain
+func validDomain(s string) bool {
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// addDNSServers appends DNS servers in the form CONTAINER:ip to container
+// definitions
+func addDNSServers(defs []*ecs.ContainerDefinition, servers []string) error {
+	for _, s := range servers {
+		name, ip, err := parseContainerValue(s)
+		if err != nil {
+			return err
+		}
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid dns server %q, %q isn't an IP address", s, ip)
+		}
+		def, err := containerDefinition(defs, name)
+		if err != nil {
+			return err
+		}
+		log.Printf("Adding dns server %s to %s", ip, name)
+		def.DnsServers = append(def.DnsServers, aws.String(ip))
+	}
+	return nil
+}
+
+// addDNSSearchDomains appends DNS search domains in the form CONTAINER:domain
+// to container definitions
+func addDNSSearchDomains(defs []*ecs.ContainerDefinition, domains []string) error {
+	for _, s := range domains {
+		name, domain, err := parseContainerValue(s)
+		if err != nil {
+			return err
+		}
+		if !validDomain(domain) {
+			return fmt.Errorf("invalid dns search domain %q, %q isn't a domain", s, domain)
+		}
+		def, err := containerDefinition(defs, name)
+		if err != nil {
+			return err
+		}
+		log.Printf("Adding dns search domain %s to %s", domain, name)
+		def.DnsSearchDomains = append(def.DnsSearchDomains, aws.String(domain))
+	}
+	return nil
+}
+
+// setHostnames sets container hostnames in the form CONTAINER:hostname. ECS
+// rejects hostnames with the awsvpc network mode.
+func setHostnames(defs []*ecs.ContainerDefinition, networkMode string, hostnames []string) error {
+	if len(hostnames) > 0 && networkMode == ecs.NetworkModeAwsvpc {
+		return fmt.Errorf("--hostname can't be used with the %s network mode", networkMode)
+	}
+	for _, s := range hostnames {
+		name, hostname, err := parseContainerValue(s)
+		if err != nil {
+			return err
+		}
+		def, err := containerDefinition(defs, name)
+		if err != nil {
+			return err
+		}
+		log.Printf("Setting hostname of %s to %s", name, hostname)
+		def.Hostname = aws.String(hostname)
+	}
+	return nil
+}
+
+// setWorkingDirectories sets container working directories in the form
+// CONTAINER:dir. ECS container overrides can't change the working directory,
+// so it's set on the registered definition, replacing the file's value.
+func setWorkingDirectories(defs []*ecs.ContainerDefinition, dirs []string) error {
+	for _, s := range dirs {
+		name, dir, err := parseContainerValue(s)
+		if err != nil {
+			return err
+		}
+		def, err := containerDefinition(defs, name)
+		if err != nil {
+			return err
+		}
+		if def.WorkingDirectory != nil {
+			log.Printf("Overriding working directory of %s from %s to %s", name, *def.WorkingDirectory, dir)
+		} else {
+			log.Printf("Setting working directory of %s to %s", name, dir)
+		}
+		def.WorkingDirectory = aws.String(dir)
+	}
+	return nil
+}
+
+// setImages replaces container images by container name, with an empty name
+// meaning the first container. Like working directories, images can't be
+// overridden when running a task so they're set on the registered definition.
+func setImages(defs []*ecs.ContainerDefinition, images map[string]string) error {
+	names := make([]string, 0, len(images))
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var def *ecs.ContainerDefinition
+		if name == "" {
+			if len(defs) == 0 {
+				return fmt.Errorf("no container definitions to set the image of")
+			}
+			def = defs[0]
+		} else {
+			var err error
+			if def, err = containerDefinition(defs, name); err != nil {
+				return err
+			}
+		}
+		log.Printf("Overriding image of %s from %s to %s", *def.Name, aws.StringValue(def.Image), images[name])
+		def.Image = aws.String(images[name])
+	}
+	return nil
+}
+
+// setEssential marks containers essential or not, in the form
+// CONTAINER=true|false. ECS needs at least one essential container, so
+// making them all non-essential is an error.
+func setEssential(defs []*ecs.ContainerDefinition, values []string) error {
+	for _, s := range values {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid essential %q, expected CONTAINER=true|false", s)
+		}
+		essential, err := strconv.ParseBool(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid essential %q, expected CONTAINER=true|false", s)
+		}
+		def, err := containerDefinition(defs, parts[0])
+		if err != nil {
+			return err
+		}
+		log.Printf("Setting %s to essential %v", parts[0], essential)
+		def.Essential = aws.Bool(essential)
+	}
+
+	if len(values) > 0 {
+		for _, def := range defs {
+			// containers are essential unless they say otherwise
+			if def.Essential == nil || *def.Essential {
+				return nil
+			}
+		}
+		return fmt.Errorf("at least one container must be essential")
+	}
+	return nil
+}
+
+// containerOverride returns the override for the named container, adding one
+// if there isn't one already
+func containerOverride(overrides *ecs.TaskOverride, name string) *ecs.ContainerOverride {
+	for _, override := range overrides.ContainerOverrides {
+		if aws.StringValue(override.Name) == name {
+			return override
+		}
+	}
+	override := &ecs.ContainerOverride{Name: aws.String(name)}
+	overrides.ContainerOverrides = append(overrides.ContainerOverrides, override)
+	return override
+}
+
+// parseContainerCPU parses cpu units for a container in the form CONTAINER:units
+func parseContainerCPU(s string) (string, int64, error) {
+	name, value, err := parseContainerValue(s)
+	if err != nil {
+		return "", 0, err
+	}
+	units, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || units < 0 {
+		return "", 0, fmt.Errorf("invalid container cpu %q, %q isn't a number of cpu units", s, value)
+	}
+	return name, units, nil
+}
+
+// parseTaskCPU parses task level cpu as either cpu units like 1024 or vCPUs
+// like "1 vCPU"
+func parseTaskCPU(cpu string) (int64, error) {
+	cpu = strings.TrimSpace(cpu)
+	if lower := strings.ToLower(cpu); strings.HasSuffix(lower, "vcpu") {
+		vcpus, err := strconv.ParseFloat(strings.TrimSpace(lower[:len(lower)-len("vcpu")]), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid task cpu %q", cpu)
+		}
+		return int64(vcpus * 1024), nil
+	}
+	units, err := strconv.ParseInt(cpu, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid task cpu %q", cpu)
+	}
+	return units, nil
+}
+
+// parseTaskMemory parses task level memory as either MiB like 2048 or GB
+// like "2 GB", returning MiB
+func parseTaskMemory(memory string) (int64, error) {
+	memory = strings.TrimSpace(memory)
+	if upper := strings.ToUpper(memory); strings.HasSuffix(upper, "GB") {
+		gb, err := strconv.ParseFloat(strings.TrimSpace(upper[:len(upper)-len("GB")]), 64)
+		if err != nil || gb <= 0 {
+			return 0, fmt.Errorf("invalid task memory %q", memory)
+		}
+		return int64(gb * 1024), nil
+	}
+	mib, err := strconv.ParseInt(memory, 10, 64)
+	if err != nil || mib <= 0 {
+		return 0, fmt.Errorf("invalid task memory %q", memory)
+	}
+	return mib, nil
+}
+
+// validateContainerCPU checks that container cpu overrides fit within the
+// task level cpu, if the task has one
+func validateContainerCPU(taskCPU string, overrides []*ecs.ContainerOverride) error {
+	if taskCPU == "" {
+		return nil
+	}
+
+	var total int64
+	for _, override := range overrides {
+		total += aws.Int64Value(override.Cpu)
+	}
+	if total == 0 {
+		return nil
+	}
+
+	units, err := parseTaskCPU(taskCPU)
+	if err != nil {
+		return err
+	}
+	if total > units {
+		return fmt.Errorf("container cpu overrides total %d cpu units, but the task only has %d", total, units)
+	}
+	return nil
+}
+
+// addCredentialSpecs appends gMSA credential specs in the form CONTAINER:arn
+// to container definitions. The arn can be prefixed with credentialspec: or
+// credentialspecdomainless:, and defaults to credentialspec:
+func addCredentialSpecs(defs []*ecs.ContainerDefinition, specs []string) error {
+	for _, s := range specs {
+		name, spec, err := parseContainerValue(s)
+		if err != nil {
+			return err
+		}
+		prefix, specArn := "credentialspec:", spec
+		for _, p := range []string{"credentialspec:", "credentialspecdomainless:"} {
+			if strings.HasPrefix(spec, p) {
+				prefix, specArn = p, strings.TrimPrefix(spec, p)
+			}
+		}
+		if _, err := arn.Parse(specArn); err != nil {
+			return fmt.Errorf("invalid credential spec %q, %q isn't an ARN", s, specArn)
+		}
+		def, err := containerDefinition(defs, name)
+		if err != nil {
+			return err
+		}
+		log.Printf("Adding credential spec %s to %s", specArn, name)
+		def.CredentialSpecs = append(def.CredentialSpecs, aws.String(prefix+specArn))
+	}
+	return nil
+}
+
+// sortContainerDefinitions sorts the lists in container definitions whose
+// order doesn't matter, so identical configs register identical definitions
+func sortContainerDefinitions(defs []*ecs.ContainerDefinition) {
+	for _, def := range defs {
+		sort.SliceStable(def.Environment, func(i, j int) bool {
+			return aws.StringValue(def.Environment[i].Name) < aws.StringValue(def.Environment[j].Name)
+		})
+		sort.SliceStable(def.Secrets, func(i, j int) bool {
+			return aws.StringValue(def.Secrets[i].Name) < aws.StringValue(def.Secrets[j].Name)
+		})
+		sort.SliceStable(def.Ulimits, func(i, j int) bool {
+			return aws.StringValue(def.Ulimits[i].Name) < aws.StringValue(def.Ulimits[j].Name)
+		})
+		sort.SliceStable(def.SystemControls, func(i, j int) bool {
+			return aws.StringValue(def.SystemControls[i].Namespace) < aws.StringValue(def.SystemControls[j].Namespace)
+		})
+	}
+}
+
+// validateSystemControls checks that containers agree on net.* sysctls under
+// FARGATE, where they apply to the whole task rather than each container
+func validateSystemControls(defs []*ecs.ContainerDefinition, fargate bool) error {
+	if !fargate {
+		return nil
+	}
+
+	values := map[string]string{}
+	setBy := map[string]string{}
+
+	for _, def := range defs {
+		for _, sc := range def.SystemControls {
+			namespace := aws.StringValue(sc.Namespace)
+			if !strings.HasPrefix(namespace, "net.") {
+				continue
+			}
+			value := aws.StringValue(sc.Value)
+			if existing, ok := values[namespace]; ok && existing != value {
+				return fmt.Errorf("containers %s and %s set %s to %q and %q, but FARGATE applies it to the whole task so they must agree",
+					setBy[namespace], *def.Name, namespace, existing, value)
+			}
+			values[namespace] = value
+			setBy[namespace] = *def.Name
+		}
+	}
+
+	return nil
+}
+
+// compatibilityProblems returns the combinations of fields in a task
+// definition that ECS rejects, so they can be reported before registering
+func compatibilityProblems(input *ecs.RegisterTaskDefinitionInput, networkMode string, fargate bool) []string {
+	for _, c := range input.RequiresCompatibilities {
+		if aws.StringValue(c) == ecs.CompatibilityFargate {
+			fargate = true
+		}
+	}
+
+	var problems []string
+	for _, def := range input.ContainerDefinitions {
+		name := aws.StringValue(def.Name)
+
+		if len(def.Links) > 0 && networkMode == ecs.NetworkModeAwsvpc {
+			problems = append(problems, fmt.Sprintf("container %s uses links, which aren't supported with the awsvpc network mode", name))
+		}
+
+		if networkMode == ecs.NetworkModeAwsvpc || networkMode == ecs.NetworkModeHost {
+			for _, pm := range def.PortMappings {
+				hostPort, containerPort := aws.Int64Value(pm.HostPort), aws.Int64Value(pm.ContainerPort)
+				if hostPort != 0 && hostPort != containerPort {
+					problems = append(problems, fmt.Sprintf("container %s maps host port %d to container port %d, but they must match with the %s network mode",
+						name, hostPort, containerPort, networkMode))
+				}
+			}
+		}
+
+		if fargate && aws.BoolValue(def.Privileged) {
+			problems = append(problems, fmt.Sprintf("container %s is privileged, which isn't supported by FARGATE", name))
+		}
+	}
+
+	if fargate {
+		for _, v := range input.Volumes {
+			if v.Host != nil && aws.StringValue(v.Host.SourcePath) != "" {
+				problems = append(problems, fmt.Sprintf("volume %s uses a host source path, which isn't supported by FARGATE", aws.StringValue(v.Name)))
+			}
+		}
+	}
+
+	return problems
+}
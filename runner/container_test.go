@@ -0,0 +1,382 @@
+package runner
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestParseAddHost(t *testing.T) {
+	for s, expected := range map[string]hostEntry{
+		"app:db.local:10.0.0.1": {Container: "app", Hostname: "db.local", IP: "10.0.0.1"},
+		"app:db.local:fd00::1":  {Container: "app", Hostname: "db.local", IP: "fd00::1"},
+	} {
+		entry, err := parseAddHost(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry != expected {
+			t.Fatalf("Expected %q to parse to %+v, got %+v", s, expected, entry)
+		}
+	}
+
+	for _, s := range []string{"db.local:10.0.0.1", "app:db.local:llamas", ":db.local:10.0.0.1", "app::10.0.0.1"} {
+		if _, err := parseAddHost(s); err == nil {
+			t.Fatalf("Expected an error for %q, got nil", s)
+		}
+	}
+}
+
+func TestAddHosts(t *testing.T) {
+	defs := []*ecs.ContainerDefinition{
+		{Name: aws.String("app")},
+		{Name: aws.String("sidecar")},
+	}
+
+	if err := addHosts(defs, []string{"app:db.local:10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if l := len(defs[0].ExtraHosts); l != 1 {
+		t.Fatal("bad number of extra hosts", l)
+	}
+	if h := defs[0].ExtraHosts[0]; *h.Hostname != "db.local" || *h.IpAddress != "10.0.0.1" {
+		t.Fatalf("bad extra host %v", h)
+	}
+	if defs[1].ExtraHosts != nil {
+		t.Fatal("Expected sidecar to have no extra hosts")
+	}
+
+	if err := addHosts(defs, []string{"missing:db.local:10.0.0.1"}); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+}
+
+func TestAddDNSServers(t *testing.T) {
+	defs := []*ecs.ContainerDefinition{{Name: aws.String("app")}}
+
+	if err := addDNSServers(defs, []string{"app:10.0.0.2", "app:10.0.0.3"}); err != nil {
+		t.Fatal(err)
+	}
+	if servers := aws.StringValueSlice(defs[0].DnsServers); len(servers) != 2 || servers[0] != "10.0.0.2" || servers[1] != "10.0.0.3" {
+		t.Fatalf("bad dns servers %v", servers)
+	}
+
+	for _, s := range []string{"10.0.0.2", "app:llamas", "missing:10.0.0.2"} {
+		if err := addDNSServers(defs, []string{s}); err == nil {
+			t.Fatalf("Expected an error for %q, got nil", s)
+		}
+	}
+}
+
+func TestAddDNSSearchDomains(t *testing.T) {
+	defs := []*ecs.ContainerDefinition{{Name: aws.String("app")}}
+
+	if err := addDNSSearchDomains(defs, []string{"app:internal.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if domains := aws.StringValueSlice(defs[0].DnsSearchDomains); len(domains) != 1 || domains[0] != "internal.example.com" {
+		t.Fatalf("bad dns search domains %v", domains)
+	}
+
+	for _, s := range []string{"internal.example.com", "app:bad domain", "app:-bad.example.com", "app:example..com", "missing:example.com"} {
+		if err := addDNSSearchDomains(defs, []string{s}); err == nil {
+			t.Fatalf("Expected an error for %q, got nil", s)
+		}
+	}
+}
+
+func TestSetHostnames(t *testing.T) {
+	defs := []*ecs.ContainerDefinition{
+		{Name: aws.String("app")},
+		{Name: aws.String("sidecar")},
+	}
+
+	if err := setHostnames(defs, ecs.NetworkModeBridge, []string{"app:my-host"}); err != nil {
+		t.Fatal(err)
+	}
+	if h := aws.StringValue(defs[0].Hostname); h != "my-host" {
+		t.Fatalf("bad hostname %q", h)
+	}
+	if defs[1].Hostname != nil {
+		t.Fatal("Expected sidecar to have no hostname")
+	}
+}
+
+func TestSetHostnamesWithAwsvpc(t *testing.T) {
+	defs := []*ecs.ContainerDefinition{{Name: aws.String("app")}}
+
+	err := setHostnames(defs, ecs.NetworkModeAwsvpc, []string{"app:my-host"})
+	if err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	if defs[0].Hostname != nil {
+		t.Fatal("Expected no hostname to be set")
+	}
+}
+
+func TestValidateContainerCPUOversubscribed(t *testing.T) {
+	overrides := &ecs.TaskOverride{}
+	containerOverride(overrides, "app").Cpu = aws.Int64(768)
+	containerOverride(overrides, "sidecar").Cpu = aws.Int64(512)
+
+	err := validateContainerCPU("1024", overrides.ContainerOverrides)
+	if err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	if err.Error() != "container cpu overrides total 1280 cpu units, but the task only has 1024" {
+		t.Fatalf("bad error message returned: %q", err.Error())
+	}
+
+	if err := validateContainerCPU("2 vCPU", overrides.ContainerOverrides); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateContainerCPU("", overrides.ContainerOverrides); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContainerOverrideReusesExisting(t *testing.T) {
+	overrides := &ecs.TaskOverride{}
+	containerOverride(overrides, "app").Cpu = aws.Int64(256)
+	containerOverride(overrides, "app").Memory = aws.Int64(512)
+
+	if l := len(overrides.ContainerOverrides); l != 1 {
+		t.Fatal("bad number of container overrides", l)
+	}
+}
+
+func TestParseContainerCPU(t *testing.T) {
+	name, units, err := parseContainerCPU("app:256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "app" || units != 256 {
+		t.Fatalf("bad container cpu %q %d", name, units)
+	}
+
+	for _, s := range []string{"256", "app:llamas", "app:-1"} {
+		if _, _, err := parseContainerCPU(s); err == nil {
+			t.Fatalf("Expected an error for %q, got nil", s)
+		}
+	}
+}
+
+func TestAddCredentialSpecs(t *testing.T) {
+	defs := []*ecs.ContainerDefinition{{Name: aws.String("app")}}
+
+	err := addCredentialSpecs(defs, []string{
+		"app:arn:aws:s3:::my-bucket/gmsa.json",
+		"app:credentialspecdomainless:arn:aws:ssm:us-east-1:012345678910:parameter/gmsa",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	specs := aws.StringValueSlice(defs[0].CredentialSpecs)
+	if len(specs) != 2 ||
+		specs[0] != "credentialspec:arn:aws:s3:::my-bucket/gmsa.json" ||
+		specs[1] != "credentialspecdomainless:arn:aws:ssm:us-east-1:012345678910:parameter/gmsa" {
+		t.Fatalf("bad credential specs %v", specs)
+	}
+
+	for _, s := range []string{"app:llamas", "missing:arn:aws:s3:::my-bucket/gmsa.json"} {
+		if err := addCredentialSpecs(defs, []string{s}); err == nil {
+			t.Fatalf("Expected an error for %q, got nil", s)
+		}
+	}
+}
+
+func TestSortContainerDefinitionsIsStable(t *testing.T) {
+	def := func(env ...string) *ecs.RegisterTaskDefinitionInput {
+		container := &ecs.ContainerDefinition{Name: aws.String("app")}
+		for _, name := range env {
+			container.Environment = append(container.Environment, &ecs.KeyValuePair{
+				Name:  aws.String(name),
+				Value: aws.String(name + "-value"),
+			})
+		}
+		return &ecs.RegisterTaskDefinitionInput{
+			Family:               aws.String("my-task"),
+			ContainerDefinitions: []*ecs.ContainerDefinition{container},
+		}
+	}
+
+	first, second := def("B", "C", "A"), def("C", "A", "B")
+	sortContainerDefinitions(first.ContainerDefinitions)
+	sortContainerDefinitions(second.ContainerDefinitions)
+
+	firstJSON, err := json.Marshal(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondJSON, err := json.Marshal(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(firstJSON) != string(secondJSON) {
+		t.Fatalf("Expected identical registrations, got %s and %s", firstJSON, secondJSON)
+	}
+}
+
+func TestValidateSystemControlsUnderFargate(t *testing.T) {
+	sysctl := func(namespace, value string) *ecs.SystemControl {
+		return &ecs.SystemControl{Namespace: aws.String(namespace), Value: aws.String(value)}
+	}
+
+	conflicting := []*ecs.ContainerDefinition{
+		{Name: aws.String("app"), SystemControls: []*ecs.SystemControl{sysctl("net.core.somaxconn", "1024")}},
+		{Name: aws.String("sidecar"), SystemControls: []*ecs.SystemControl{sysctl("net.core.somaxconn", "4096")}},
+	}
+
+	err := validateSystemControls(conflicting, true)
+	if err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	if err.Error() != `containers app and sidecar set net.core.somaxconn to "1024" and "4096", but FARGATE applies it to the whole task so they must agree` {
+		t.Fatalf("bad error message returned: %q", err.Error())
+	}
+
+	if err := validateSystemControls(conflicting, false); err != nil {
+		t.Fatalf("Expected no error outside of FARGATE, got %v", err)
+	}
+
+	consistent := []*ecs.ContainerDefinition{
+		{Name: aws.String("app"), SystemControls: []*ecs.SystemControl{sysctl("net.core.somaxconn", "1024")}},
+		{Name: aws.String("sidecar"), SystemControls: []*ecs.SystemControl{sysctl("net.core.somaxconn", "1024")}},
+	}
+	if err := validateSystemControls(consistent, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompatibilityProblems(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		input       *ecs.RegisterTaskDefinitionInput
+		networkMode string
+		fargate     bool
+		problems    int
+	}{
+		{
+			name: "links with awsvpc",
+			input: &ecs.RegisterTaskDefinitionInput{ContainerDefinitions: []*ecs.ContainerDefinition{
+				{Name: aws.String("app"), Links: aws.StringSlice([]string{"db"})},
+			}},
+			networkMode: ecs.NetworkModeAwsvpc,
+			problems:    1,
+		},
+		{
+			name: "links with bridge",
+			input: &ecs.RegisterTaskDefinitionInput{ContainerDefinitions: []*ecs.ContainerDefinition{
+				{Name: aws.String("app"), Links: aws.StringSlice([]string{"db"})},
+			}},
+			networkMode: ecs.NetworkModeBridge,
+		},
+		{
+			name: "different host port with awsvpc",
+			input: &ecs.RegisterTaskDefinitionInput{ContainerDefinitions: []*ecs.ContainerDefinition{
+				{Name: aws.String("app"), PortMappings: []*ecs.PortMapping{
+					{HostPort: aws.Int64(8080), ContainerPort: aws.Int64(80)},
+					{HostPort: aws.Int64(443), ContainerPort: aws.Int64(443)},
+				}},
+			}},
+			networkMode: ecs.NetworkModeAwsvpc,
+			problems:    1,
+		},
+		{
+			name: "privileged and a host volume under FARGATE",
+			input: &ecs.RegisterTaskDefinitionInput{
+				RequiresCompatibilities: aws.StringSlice([]string{ecs.CompatibilityFargate}),
+				ContainerDefinitions: []*ecs.ContainerDefinition{
+					{Name: aws.String("app"), Privileged: aws.Bool(true)},
+				},
+				Volumes: []*ecs.Volume{
+					{Name: aws.String("data"), Host: &ecs.HostVolumeProperties{SourcePath: aws.String("/data")}},
+				},
+			},
+			networkMode: ecs.NetworkModeAwsvpc,
+			problems:    2,
+		},
+	} {
+		problems := compatibilityProblems(tc.input, tc.networkMode, tc.fargate)
+		if len(problems) != tc.problems {
+			t.Errorf("%s: expected %d problems, got %q", tc.name, tc.problems, problems)
+		}
+	}
+}
+
+func TestSetWorkingDirectoriesSupersedesDefinition(t *testing.T) {
+	defs := []*ecs.ContainerDefinition{
+		{Name: aws.String("app"), WorkingDirectory: aws.String("/from-definition")},
+		{Name: aws.String("sidecar"), WorkingDirectory: aws.String("/sidecar")},
+	}
+
+	if err := setWorkingDirectories(defs, []string{"app:/from-flag"}); err != nil {
+		t.Fatal(err)
+	}
+	if dir := *defs[0].WorkingDirectory; dir != "/from-flag" {
+		t.Fatalf("Expected the flag to supersede the definition, got %q", dir)
+	}
+	if dir := *defs[1].WorkingDirectory; dir != "/sidecar" {
+		t.Fatalf("Expected other containers to be untouched, got %q", dir)
+	}
+
+	if err := setWorkingDirectories(defs, []string{"llamas:/nope"}); err == nil {
+		t.Fatal("Expected an error for an unknown container")
+	}
+}
+
+func TestSetImages(t *testing.T) {
+	defs := []*ecs.ContainerDefinition{
+		{Name: aws.String("app"), Image: aws.String("myapp:v1")},
+		{Name: aws.String("sidecar"), Image: aws.String("proxy:1.0")},
+	}
+
+	if err := setImages(defs, map[string]string{"sidecar": "proxy:2.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if image := *defs[0].Image; image != "myapp:v1" {
+		t.Fatalf("Expected other containers to be untouched, got %q", image)
+	}
+	if image := *defs[1].Image; image != "proxy:2.0" {
+		t.Fatalf("bad sidecar image %q", image)
+	}
+
+	if err := setImages(defs, map[string]string{"": "myapp:v2"}); err != nil {
+		t.Fatal(err)
+	}
+	if image := *defs[0].Image; image != "myapp:v2" {
+		t.Fatalf("Expected a bare image to replace the first container's, got %q", image)
+	}
+
+	if err := setImages(defs, map[string]string{"llamas": "nope"}); err == nil {
+		t.Fatal("Expected an error for an unknown container")
+	}
+}
+
+func TestSetEssential(t *testing.T) {
+	defs := []*ecs.ContainerDefinition{
+		{Name: aws.String("app"), Essential: aws.Bool(true)},
+		{Name: aws.String("sidecar")},
+	}
+
+	if err := setEssential(defs, []string{"app=false", "sidecar=true"}); err != nil {
+		t.Fatal(err)
+	}
+	if *defs[0].Essential || !*defs[1].Essential {
+		t.Fatalf("bad essential %v %v", *defs[0].Essential, *defs[1].Essential)
+	}
+
+	for _, values := range [][]string{
+		{"llamas=true"},
+		{"app=maybe"},
+		{"app"},
+		{"sidecar=false"},
+	} {
+		if err := setEssential(defs, values); err == nil {
+			t.Fatalf("Expected an error for %q, got nil", values)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package runner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// maxRunTaskCount is the most tasks a single RunTask call can launch
+const maxRunTaskCount = 10
+
+// maxDescribeTasks is the most tasks a single DescribeTasks call accepts
+const maxDescribeTasks = 100
+
+var (
+	// describeRetries is how many times to retry a throttled describe
+	describeRetries = 4
+
+	// describeRetryDelay is the delay before the first retry, which doubles
+	// with each attempt
+	describeRetryDelay = time.Second
+
+	// runTaskRetryDelay is the delay before the first RunTask retry, which
+	// doubles with each attempt
+	runTaskRetryDelay = time.Second
+)
+
+// defaultRunTaskRetries is how many times a RunTask call is retried on
+// throttling or transient failures if no --max-retries is given
+const defaultRunTaskRetries = 5
+
+type ecsInterface interface {
+	ListTaskDefinitionsPages(input *ecs.ListTaskDefinitionsInput,
+		fn func(*ecs.ListTaskDefinitionsOutput, bool) bool) error
+	DeregisterTaskDefinition(input *ecs.DeregisterTaskDefinitionInput) (*ecs.DeregisterTaskDefinitionOutput, error)
+	DeregisterTaskDefinitionWithContext(ctx aws.Context, input *ecs.DeregisterTaskDefinitionInput, opts ...request.Option) (*ecs.DeregisterTaskDefinitionOutput, error)
+	DescribeTaskDefinition(input *ecs.DescribeTaskDefinitionInput) (*ecs.DescribeTaskDefinitionOutput, error)
+	RegisterTaskDefinition(input *ecs.RegisterTaskDefinitionInput) (*ecs.RegisterTaskDefinitionOutput, error)
+	ListTasksPages(input *ecs.ListTasksInput,
+		fn func(*ecs.ListTasksOutput, bool) bool) error
+	RunTask(input *ecs.RunTaskInput) (*ecs.RunTaskOutput, error)
+	StartTask(input *ecs.StartTaskInput) (*ecs.StartTaskOutput, error)
+	StopTask(input *ecs.StopTaskInput) (*ecs.StopTaskOutput, error)
+	DescribeTasks(input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error)
+}
+
+// taskBatches splits the tasks into batches small enough for DescribeTasks,
+// and so for waiting until they've stopped
+func taskBatches(taskARNs []*string) [][]*string {
+	var batches [][]*string
+	for len(taskARNs) > maxDescribeTasks {
+		batches = append(batches, taskARNs[:maxDescribeTasks])
+		taskARNs = taskARNs[maxDescribeTasks:]
+	}
+	if len(taskARNs) > 0 {
+		batches = append(batches, taskARNs)
+	}
+	return batches
+}
+
+// describeTasks describes any number of tasks, in as many DescribeTasks calls
+// as ECS needs
+func describeTasks(svc ecsInterface, cluster string, taskARNs []*string) (*ecs.DescribeTasksOutput, error) {
+	output := &ecs.DescribeTasksOutput{}
+	for _, batch := range taskBatches(taskARNs) {
+		resp, err := svc.DescribeTasks(&ecs.DescribeTasksInput{
+			Cluster: aws.String(cluster),
+			Tasks:   batch,
+		})
+		if err != nil {
+			return nil, err
+		}
+		output.Tasks = append(output.Tasks, resp.Tasks...)
+		output.Failures = append(output.Failures, resp.Failures...)
+	}
+	return output, nil
+}
+
+// waitUntilTasksStopped waits for any number of tasks to stop, a batch at a
+// time, as the waiter describes all its tasks in one call
+func waitUntilTasksStopped(ctx context.Context, svc *ecs.ECS, cluster string, taskARNs []*string) error {
+	for _, batch := range taskBatches(taskARNs) {
+		err := svc.WaitUntilTasksStoppedWithContext(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(cluster),
+			Tasks:   batch,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runTask runs a task, or if a container instance is given uses StartTask to
+// place it on that specific instance instead
+func runTask(ctx context.Context, svc ecsInterface, input *ecs.RunTaskInput, containerInstance string, stagger time.Duration, retries int) (*ecs.RunTaskOutput, error) {
+	if containerInstance == "" {
+		return runTaskChunks(ctx, svc, input, stagger, retries, sleepContext)
+	}
+
+	log.Printf("Starting task on container instance %s", containerInstance)
+	return retryStartTask(ctx, svc, &ecs.StartTaskInput{
+		Cluster:              input.Cluster,
+		ContainerInstances:   []*string{aws.String(containerInstance)},
+		TaskDefinition:       input.TaskDefinition,
+		Overrides:            input.Overrides,
+		NetworkConfiguration: input.NetworkConfiguration,
+		EnableExecuteCommand: input.EnableExecuteCommand,
+		Tags:                 input.Tags,
+		PropagateTags:        input.PropagateTags,
+		StartedBy:            input.StartedBy,
+	}, retries, sleepContext)
+}
+
+// runTaskChunks runs input.Count tasks, splitting them into as many RunTask
+// calls as ECS needs and waiting stagger between the calls. If a call fails,
+// the tasks already launched are returned along with the error.
+func runTaskChunks(ctx context.Context, svc ecsInterface, input *ecs.RunTaskInput,
+	stagger time.Duration, retries int, sleep func(context.Context, time.Duration) error) (*ecs.RunTaskOutput, error) {
+	count := aws.Int64Value(input.Count)
+	if count <= maxRunTaskCount {
+		return retryRunTask(ctx, svc, input, retries, sleep)
+	}
+
+	output := &ecs.RunTaskOutput{}
+	for chunk := int64(0); count > 0; chunk++ {
+		if chunk > 0 && stagger > 0 {
+			log.Printf("Waiting %v before launching more tasks", stagger)
+			if err := sleep(ctx, stagger); err != nil {
+				return output, err
+			}
+		}
+
+		n := count
+		if n > maxRunTaskCount {
+			n = maxRunTaskCount
+		}
+		chunkInput := *input
+		chunkInput.Count = aws.Int64(n)
+		if input.ClientToken != nil {
+			chunkInput.ClientToken = aws.String(chunkClientToken(*input.ClientToken, chunk))
+		}
+
+		log.Printf("Launching %d tasks", n)
+		resp, err := retryRunTask(ctx, svc, &chunkInput, retries, sleep)
+		if err != nil {
+			return output, err
+		}
+		output.Tasks = append(output.Tasks, resp.Tasks...)
+		output.Failures = append(output.Failures, resp.Failures...)
+		count -= n
+	}
+
+	return output, nil
+}
+
+// retryRunTask calls RunTask, retrying with exponential backoff on throttling
+// and transient failures. The client token makes retrying safe, as a call
+// that did launch tasks won't launch them again.
+func retryRunTask(ctx context.Context, svc ecsInterface, input *ecs.RunTaskInput,
+	retries int, sleep func(context.Context, time.Duration) error) (*ecs.RunTaskOutput, error) {
+	return retryLaunch(ctx, "Running task", isTransientError, retries, sleep, func() (*ecs.RunTaskOutput, error) {
+		return svc.RunTask(input)
+	})
+}
+
+// retryStartTask calls StartTask, retrying with exponential backoff on
+// throttling. StartTask has no client token, so other failures aren't
+// retried in case the call did start the task.
+func retryStartTask(ctx context.Context, svc ecsInterface, input *ecs.StartTaskInput,
+	retries int, sleep func(context.Context, time.Duration) error) (*ecs.RunTaskOutput, error) {
+	return retryLaunch(ctx, "Starting task", isRateLimited, retries, sleep, func() (*ecs.RunTaskOutput, error) {
+		resp, err := svc.StartTask(input)
+		if err != nil {
+			return nil, err
+		}
+		return &ecs.RunTaskOutput{
+			Tasks:    resp.Tasks,
+			Failures: resp.Failures,
+		}, nil
+	})
+}
+
+// retryLaunch calls launch until it succeeds, fails in a way that isn't
+// retryable, or runs out of retries, doubling the delay between attempts
+func retryLaunch(ctx context.Context, action string, retryable func(error) bool,
+	retries int, sleep func(context.Context, time.Duration) error,
+	launch func() (*ecs.RunTaskOutput, error)) (*ecs.RunTaskOutput, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := launch()
+		if err == nil {
+			return resp, nil
+		}
+		if !retryable(err) || attempt >= retries {
+			if attempt > 0 {
+				return nil, fmt.Errorf("%v (after %d retries)", err, attempt)
+			}
+			return nil, err
+		}
+		delay := runTaskRetryDelay << uint(attempt)
+		log.Printf("%s failed with %v, retrying in %v", action, err, delay)
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// isTransientError returns whether an ECS call failed in a way that's worth
+// retrying, such as throttling or an error on the ECS side
+func isTransientError(err error) bool {
+	if isRateLimited(err) || isAwsTimeOutError(err) {
+		return true
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == ecs.ErrCodeServerException
+	}
+	return false
+}
+
+// chunkClientToken derives a distinct client token for each RunTask call of
+// a run, as ECS rejects reusing a token with a different count
+func chunkClientToken(token string, chunk int64) string {
+	if chunk == 0 {
+		return token
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%d", token, chunk)))
+	return hex.EncodeToString(sum[:])
+}
+
+// sleepContext waits for d, returning early if the context is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// describeTaskDefinition describes an existing task definition and returns it
+// as input for registering a new revision of it
+func describeTaskDefinition(ctx context.Context, svc ecsInterface, taskDefinition string) (*ecs.RegisterTaskDefinitionInput, error) {
+	def, err := fetchTaskDefinition(ctx, svc, taskDefinition)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions:    def.ContainerDefinitions,
+		Cpu:                     def.Cpu,
+		EphemeralStorage:        def.EphemeralStorage,
+		ExecutionRoleArn:        def.ExecutionRoleArn,
+		Family:                  def.Family,
+		InferenceAccelerators:   def.InferenceAccelerators,
+		IpcMode:                 def.IpcMode,
+		Memory:                  def.Memory,
+		NetworkMode:             def.NetworkMode,
+		PidMode:                 def.PidMode,
+		PlacementConstraints:    def.PlacementConstraints,
+		ProxyConfiguration:      def.ProxyConfiguration,
+		RequiresCompatibilities: def.RequiresCompatibilities,
+		RuntimePlatform:         def.RuntimePlatform,
+		TaskRoleArn:             def.TaskRoleArn,
+		Volumes:                 def.Volumes,
+	}, nil
+}
+
+// isBareFamily returns whether a task definition is a family without a
+// revision, which ECS resolves to the latest ACTIVE revision
+func isBareFamily(taskDefinition string) bool {
+	return !strings.Contains(path.Base(taskDefinition), ":")
+}
+
+// fetchTaskDefinition describes a task definition, retrying if throttled. A
+// bare family resolves to its latest ACTIVE revision, which is logged.
+func fetchTaskDefinition(ctx context.Context, svc ecsInterface, taskDefinition string) (*ecs.TaskDefinition, error) {
+	log.Printf("Describing task %s", taskDefinition)
+	var resp *ecs.DescribeTaskDefinitionOutput
+	var err error
+	for attempt := 0; ; attempt++ {
+		resp, err = svc.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
+			TaskDefinition: aws.String(taskDefinition),
+		})
+		if err == nil {
+			break
+		}
+		if !isRateLimited(err) || attempt >= describeRetries {
+			return nil, err
+		}
+		delay := describeRetryDelay << uint(attempt)
+		log.Printf("Describing task %s was throttled, retrying in %v", taskDefinition, delay)
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+
+	def := resp.TaskDefinition
+	if isBareFamily(taskDefinition) {
+		log.Printf("Resolved %s to its latest revision %s:%d",
+			taskDefinition, aws.StringValue(def.Family), aws.Int64Value(def.Revision))
+	}
+	return def, nil
+}
+
+// latestTaskDefinition returns the ARN of the latest active revision of a
+// task definition family, or an empty string if there isn't one
+func latestTaskDefinition(svc ecsInterface, family string) (string, error) {
+	params := &ecs.ListTaskDefinitionsInput{
+		FamilyPrefix: aws.String(family),
+		Status:       aws.String(ecs.TaskDefinitionStatusActive),
+		Sort:         aws.String(ecs.SortOrderDesc),
+	}
+
+	var latest string
+	err := svc.ListTaskDefinitionsPages(params,
+		func(page *ecs.ListTaskDefinitionsOutput, lastPage bool) bool {
+			for _, arn := range page.TaskDefinitionArns {
+				// the prefix can match other families, so check for an exact match
+				if taskDefinitionFamily(*arn) == family {
+					latest = *arn
+					return false
+				}
+			}
+			return !lastPage
+		})
+
+	return latest, err
+}
+
+// deregisterTaskDefinition deregisters a task definition revision, giving up
+// once the timeout passes
+func deregisterTaskDefinition(svc ecsInterface, taskDefinition string, timeout time.Duration) error {
+	log.Printf("Deregistering task %s", taskDefinition)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err := svc.DeregisterTaskDefinitionWithContext(ctx, &ecs.DeregisterTaskDefinitionInput{
+		TaskDefinition: aws.String(taskDefinition),
+	})
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timed out after %v deregistering task %s", timeout, taskDefinition)
+		}
+		return fmt.Errorf("failed to deregister task %s: %v", taskDefinition, err)
+	}
+	log.Printf("Successfully deregistered task %s", taskDefinition)
+	return nil
+}
+
+// deregisterPreviousTaskDefinition deregisters the latest active revision of a
+// task definition family, if there is one and ecs-run-task registered it
+func deregisterPreviousTaskDefinition(svc ecsInterface, family string) error {
+	previous, err := latestTaskDefinition(svc, family)
+	if err != nil {
+		return err
+	}
+	if previous == "" {
+		log.Printf("No previous task definition found for %s", family)
+		return nil
+	}
+
+	// a revision maintained elsewhere in the same family is left alone
+	resp, err := svc.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(previous),
+		Include:        aws.StringSlice([]string{ecs.TaskDefinitionFieldTags}),
+	})
+	if err != nil {
+		return err
+	}
+	if v, _ := tagValue(resp.Tags, managedByTag); v != managedByValue {
+		log.Printf("Not deregistering previous task %s, as it wasn't registered by %s", previous, managedByValue)
+		return nil
+	}
+
+	log.Printf("Deregistering previous task %s", previous)
+	_, err = svc.DeregisterTaskDefinition(&ecs.DeregisterTaskDefinitionInput{
+		TaskDefinition: aws.String(previous),
+	})
+	return err
+}
+
+// tagValue returns the value of the tag with the key, if there is one
+func tagValue(tags []*ecs.Tag, key string) (string, bool) {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value), true
+		}
+	}
+	return "", false
+}
+
+// taskDefinitionFamily returns the family from a task definition ARN like
+// arn:aws:ecs:us-east-1:012345678910:task-definition/family:1
+func taskDefinitionFamily(arn string) string {
+	family := path.Base(arn)
+	if i := strings.LastIndex(family, ":"); i >= 0 {
+		family = family[:i]
+	}
+	return family
+}
+
+// executeCommandWarnings returns the reasons ECS Exec is likely to fail for a
+// task definition, as exec needs a task role with SSM permissions and Fargate
+// platform version 1.4.0 or later
+func executeCommandWarnings(def *ecs.RegisterTaskDefinitionInput, fargate bool, platformVersion string) []string {
+	var warnings []string
+
+	if aws.StringValue(def.TaskRoleArn) == "" {
+		warnings = append(warnings, "--enable-execute-command requires a task role with SSM permissions, but the task definition has no taskRoleArn")
+	}
+
+	if fargate && !platformVersionAtLeast(platformVersion, 1, 4) {
+		warnings = append(warnings, fmt.Sprintf("--enable-execute-command requires Fargate platform version 1.4.0 or later, got %s", platformVersion))
+	}
+
+	return warnings
+}
+
+// platformVersionAtLeast returns whether a Fargate platform version like 1.3.0
+// is at least major.minor. An empty version or LATEST is always new enough.
+func platformVersionAtLeast(version string, major, minor int) bool {
+	if version == "" || version == "LATEST" {
+		return true
+	}
+
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	vMajor, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	vMinor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+
+	return vMajor > major || (vMajor == major && vMinor >= minor)
+}
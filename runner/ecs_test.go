@@ -0,0 +1,504 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDeregisterPreviousTaskDefinition(t *testing.T) {
+	svc := &mockECS{
+		taskDefinitionArns: []string{
+			"arn:aws:ecs:us-east-1:012345678910:task-definition/my-task-other:9",
+			"arn:aws:ecs:us-east-1:012345678910:task-definition/my-task:2",
+			"arn:aws:ecs:us-east-1:012345678910:task-definition/my-task:1",
+		},
+		taskDefinitions: map[string]*ecs.TaskDefinition{
+			"arn:aws:ecs:us-east-1:012345678910:task-definition/my-task:2": {Family: aws.String("my-task")},
+		},
+		taskDefinitionTags: map[string][]*ecs.Tag{
+			"arn:aws:ecs:us-east-1:012345678910:task-definition/my-task:2": {
+				{Key: aws.String("ManagedBy"), Value: aws.String("ecs-run-task")},
+			},
+		},
+	}
+
+	if err := deregisterPreviousTaskDefinition(svc, "my-task"); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := len(svc.deregistered); l != 1 {
+		t.Fatal("bad number of task definitions deregistered", l)
+	}
+	if arn := svc.deregistered[0]; arn != "arn:aws:ecs:us-east-1:012345678910:task-definition/my-task:2" {
+		t.Fatalf("bad task definition deregistered %q", arn)
+	}
+}
+
+func TestDeregisterPreviousTaskDefinitionNotRegisteredByUs(t *testing.T) {
+	svc := &mockECS{
+		taskDefinitionArns: []string{
+			"arn:aws:ecs:us-east-1:012345678910:task-definition/my-task:2",
+		},
+		taskDefinitions: map[string]*ecs.TaskDefinition{
+			"arn:aws:ecs:us-east-1:012345678910:task-definition/my-task:2": {Family: aws.String("my-task")},
+		},
+		taskDefinitionTags: map[string][]*ecs.Tag{
+			"arn:aws:ecs:us-east-1:012345678910:task-definition/my-task:2": {
+				{Key: aws.String("ManagedBy"), Value: aws.String("terraform")},
+			},
+		},
+	}
+
+	if err := deregisterPreviousTaskDefinition(svc, "my-task"); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := len(svc.deregistered); l != 0 {
+		t.Fatal("expected a task definition maintained elsewhere to be left alone", l)
+	}
+}
+
+func TestDeregisterPreviousTaskDefinitionWithNoPrevious(t *testing.T) {
+	svc := &mockECS{
+		taskDefinitionArns: []string{
+			"arn:aws:ecs:us-east-1:012345678910:task-definition/my-task-other:9",
+		},
+	}
+
+	if err := deregisterPreviousTaskDefinition(svc, "my-task"); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := len(svc.deregistered); l != 0 {
+		t.Fatal("expected no task definitions to be deregistered", l)
+	}
+}
+
+func TestDescribeTaskDefinitionRetriesThrottling(t *testing.T) {
+	defer func(delay time.Duration) { describeRetryDelay = delay }(describeRetryDelay)
+	describeRetryDelay = time.Millisecond
+
+	svc := &mockECS{
+		taskDefinitions: map[string]*ecs.TaskDefinition{
+			"my-task:3": {Family: aws.String("my-task")},
+		},
+		throttledDescribes: 1,
+	}
+
+	def, err := describeTaskDefinition(context.Background(), svc, "my-task:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *def.Family != "my-task" {
+		t.Fatalf("bad family %q", *def.Family)
+	}
+	if l := len(svc.described); l != 2 {
+		t.Fatal("Expected a retry after throttling, got describes", l)
+	}
+}
+
+func TestDescribeTaskDefinitionStopsRetryingWhenCancelled(t *testing.T) {
+	defer func(delay time.Duration) { describeRetryDelay = delay }(describeRetryDelay)
+	describeRetryDelay = time.Hour
+
+	svc := &mockECS{throttledDescribes: 1}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := describeTaskDefinition(ctx, svc, "my-task:3"); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the backoff to end with the context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected to return promptly, took %v", elapsed)
+	}
+}
+
+func TestRunTaskOnContainerInstance(t *testing.T) {
+	svc := &mockECS{}
+
+	_, err := runTask(context.Background(), svc, &ecs.RunTaskInput{
+		Cluster:        aws.String("my-cluster"),
+		TaskDefinition: aws.String("my-task:1"),
+	}, "arn:aws:ecs:us-east-1:012345678910:container-instance/my-cluster/abc123", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l := len(svc.runTaskInputs); l != 0 {
+		t.Fatal("expected no calls to RunTask", l)
+	}
+	if l := len(svc.startTaskInputs); l != 1 {
+		t.Fatal("bad number of calls to StartTask", l)
+	}
+	input := svc.startTaskInputs[0]
+	if len(input.ContainerInstances) != 1 || *input.ContainerInstances[0] != "arn:aws:ecs:us-east-1:012345678910:container-instance/my-cluster/abc123" {
+		t.Fatalf("bad container instances %v", aws.StringValueSlice(input.ContainerInstances))
+	}
+	if *input.TaskDefinition != "my-task:1" || *input.Cluster != "my-cluster" {
+		t.Fatalf("bad start task input %v", input)
+	}
+}
+
+func TestRunTaskChunksWithStagger(t *testing.T) {
+	svc := &mockECS{}
+
+	var slept []time.Duration
+	var callsBeforeSleep []int
+	sleep := func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		callsBeforeSleep = append(callsBeforeSleep, len(svc.runTaskInputs))
+		return nil
+	}
+
+	output, err := runTaskChunks(context.Background(), svc, &ecs.RunTaskInput{
+		Count:       aws.Int64(25),
+		ClientToken: aws.String("token"),
+	}, 5*time.Second, 0, sleep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l := len(output.Tasks); l != 25 {
+		t.Fatal("bad number of tasks", l)
+	}
+	if l := len(svc.runTaskInputs); l != 3 {
+		t.Fatal("bad number of RunTask calls", l)
+	}
+	for i, count := range []int64{10, 10, 5} {
+		if c := *svc.runTaskInputs[i].Count; c != count {
+			t.Fatalf("bad count %d for call %d", c, i)
+		}
+	}
+	if *svc.runTaskInputs[0].ClientToken != "token" || *svc.runTaskInputs[1].ClientToken == "token" ||
+		*svc.runTaskInputs[1].ClientToken == *svc.runTaskInputs[2].ClientToken {
+		t.Fatal("Expected a distinct client token for each call")
+	}
+	if len(slept) != 2 || slept[0] != 5*time.Second || slept[1] != 5*time.Second {
+		t.Fatalf("bad staggers %v", slept)
+	}
+	if callsBeforeSleep[0] != 1 || callsBeforeSleep[1] != 2 {
+		t.Fatalf("Expected a stagger between each call, got %v", callsBeforeSleep)
+	}
+}
+
+func TestRunTaskChunksStopsWhenCancelled(t *testing.T) {
+	svc := &mockECS{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	output, err := runTaskChunks(ctx, svc, &ecs.RunTaskInput{Count: aws.Int64(15)}, time.Hour, 0, sleepContext)
+	if err != context.Canceled {
+		t.Fatalf("Expected a cancelled error, got %v", err)
+	}
+	if len(svc.runTaskInputs) != 1 || len(output.Tasks) != 10 {
+		t.Fatal("Expected only the first chunk to launch")
+	}
+}
+
+func TestRunTaskWithoutContainerInstance(t *testing.T) {
+	svc := &mockECS{}
+
+	if _, err := runTask(context.Background(), svc, &ecs.RunTaskInput{}, "", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(svc.runTaskInputs) != 1 || len(svc.startTaskInputs) != 0 {
+		t.Fatal("expected only RunTask to be called")
+	}
+}
+
+type mockECS struct {
+	sync.Mutex
+
+	// in descending revision order, as returned by ListTaskDefinitions
+	taskDefinitionArns []string
+	deregistered       []string
+	taskDefinitions    map[string]*ecs.TaskDefinition
+	taskDefinitionTags map[string][]*ecs.Tag
+	serviceTasks       map[string][]string
+	described          []string
+	registered         []*ecs.RegisterTaskDefinitionInput
+	runTaskInputs      []*ecs.RunTaskInput
+	startTaskInputs    []*ecs.StartTaskInput
+	stopped            []string
+	stopReasons        []string
+	tasks              map[string]*ecs.Task
+
+	// throttledDescribes is how many describes fail with throttling first
+	throttledDescribes int
+
+	// deregisterDelay is how long deregistering takes
+	deregisterDelay time.Duration
+
+	// runTaskErrors are returned by RunTask calls in order before it succeeds
+	runTaskErrors []error
+
+	// startTaskErrors are returned by StartTask calls in order before it
+	// succeeds
+	startTaskErrors []error
+}
+
+func (m *mockECS) ListTaskDefinitionsPages(input *ecs.ListTaskDefinitionsInput,
+	fn func(*ecs.ListTaskDefinitionsOutput, bool) bool) error {
+	m.Lock()
+	defer m.Unlock()
+
+	output := &ecs.ListTaskDefinitionsOutput{}
+	for _, arn := range m.taskDefinitionArns {
+		if strings.HasPrefix(taskDefinitionFamily(arn), *input.FamilyPrefix) {
+			output.TaskDefinitionArns = append(output.TaskDefinitionArns, aws.String(arn))
+		}
+	}
+
+	fn(output, true)
+	return nil
+}
+
+func (m *mockECS) DeregisterTaskDefinition(input *ecs.DeregisterTaskDefinitionInput) (*ecs.DeregisterTaskDefinitionOutput, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.deregistered = append(m.deregistered, *input.TaskDefinition)
+	return &ecs.DeregisterTaskDefinitionOutput{}, nil
+}
+
+func (m *mockECS) DeregisterTaskDefinitionWithContext(ctx aws.Context, input *ecs.DeregisterTaskDefinitionInput, opts ...request.Option) (*ecs.DeregisterTaskDefinitionOutput, error) {
+	select {
+	case <-time.After(m.deregisterDelay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return m.DeregisterTaskDefinition(input)
+}
+
+func TestExecuteCommandWarningsWithoutTaskRole(t *testing.T) {
+	warnings := executeCommandWarnings(&ecs.RegisterTaskDefinitionInput{}, false, "")
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "task role") {
+		t.Fatalf("Expected a task role warning, got %q", warnings)
+	}
+
+	warnings = executeCommandWarnings(&ecs.RegisterTaskDefinitionInput{
+		TaskRoleArn: aws.String("arn:aws:iam::012345678910:role/my-role"),
+	}, false, "")
+	if len(warnings) != 0 {
+		t.Fatalf("Expected no warnings, got %q", warnings)
+	}
+}
+
+func TestExecuteCommandWarningsPlatformVersion(t *testing.T) {
+	def := &ecs.RegisterTaskDefinitionInput{
+		TaskRoleArn: aws.String("arn:aws:iam::012345678910:role/my-role"),
+	}
+
+	for version, expected := range map[string]int{
+		"":       0,
+		"LATEST": 0,
+		"1.4.0":  0,
+		"1.3.0":  1,
+		"1.0.0":  1,
+	} {
+		if warnings := executeCommandWarnings(def, true, version); len(warnings) != expected {
+			t.Fatalf("Expected %d warnings for platform version %q, got %q", expected, version, warnings)
+		}
+	}
+}
+
+func (m *mockECS) RunTask(input *ecs.RunTaskInput) (*ecs.RunTaskOutput, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.runTaskInputs = append(m.runTaskInputs, input)
+	if len(m.runTaskErrors) > 0 {
+		err := m.runTaskErrors[0]
+		m.runTaskErrors = m.runTaskErrors[1:]
+		return nil, err
+	}
+	output := &ecs.RunTaskOutput{}
+	for i := int64(0); i < aws.Int64Value(input.Count); i++ {
+		output.Tasks = append(output.Tasks, &ecs.Task{
+			TaskArn: aws.String(fmt.Sprintf("task-%d-%d", len(m.runTaskInputs), i)),
+		})
+	}
+	return output, nil
+}
+
+func (m *mockECS) StartTask(input *ecs.StartTaskInput) (*ecs.StartTaskOutput, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.startTaskInputs = append(m.startTaskInputs, input)
+	if len(m.startTaskErrors) > 0 {
+		err := m.startTaskErrors[0]
+		m.startTaskErrors = m.startTaskErrors[1:]
+		return nil, err
+	}
+	return &ecs.StartTaskOutput{}, nil
+}
+
+func (m *mockECS) DescribeTaskDefinition(input *ecs.DescribeTaskDefinitionInput) (*ecs.DescribeTaskDefinitionOutput, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.described = append(m.described, *input.TaskDefinition)
+	if m.throttledDescribes > 0 {
+		m.throttledDescribes--
+		return nil, awserr.New("ThrottlingException", "Rate exceeded", nil)
+	}
+	def, ok := m.taskDefinitions[*input.TaskDefinition]
+	if !ok {
+		return nil, fmt.Errorf("Unable to describe task definition %s", *input.TaskDefinition)
+	}
+	return &ecs.DescribeTaskDefinitionOutput{TaskDefinition: def, Tags: m.taskDefinitionTags[*input.TaskDefinition]}, nil
+}
+
+func (m *mockECS) RegisterTaskDefinition(input *ecs.RegisterTaskDefinitionInput) (*ecs.RegisterTaskDefinitionOutput, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.registered = append(m.registered, input)
+	return &ecs.RegisterTaskDefinitionOutput{
+		TaskDefinition: &ecs.TaskDefinition{
+			TaskDefinitionArn: aws.String(fmt.Sprintf("arn:aws:ecs:us-east-1:012345678910:task-definition/%s:%d",
+				*input.Family, len(m.registered))),
+			Family:               input.Family,
+			Revision:             aws.Int64(int64(len(m.registered))),
+			ContainerDefinitions: input.ContainerDefinitions,
+		},
+	}, nil
+}
+
+func (m *mockECS) ListTasksPages(input *ecs.ListTasksInput,
+	fn func(*ecs.ListTasksOutput, bool) bool) error {
+	m.Lock()
+	defer m.Unlock()
+	fn(&ecs.ListTasksOutput{
+		TaskArns: aws.StringSlice(m.serviceTasks[*input.ServiceName]),
+	}, true)
+	return nil
+}
+
+func (m *mockECS) StopTask(input *ecs.StopTaskInput) (*ecs.StopTaskOutput, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.stopped = append(m.stopped, *input.Task)
+	m.stopReasons = append(m.stopReasons, aws.StringValue(input.Reason))
+	return &ecs.StopTaskOutput{}, nil
+}
+
+func (m *mockECS) DescribeTasks(input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if len(input.Tasks) > maxDescribeTasks {
+		return nil, awserr.New(ecs.ErrCodeInvalidParameterException, "Tasks cannot be longer than 100", nil)
+	}
+
+	output := &ecs.DescribeTasksOutput{}
+	for _, arn := range input.Tasks {
+		if task, ok := m.tasks[*arn]; ok {
+			output.Tasks = append(output.Tasks, task)
+		}
+	}
+	return output, nil
+}
+
+func TestRunTaskRetriesTransientErrors(t *testing.T) {
+	svc := &mockECS{
+		runTaskErrors: []error{
+			awserr.New("ThrottlingException", "Rate exceeded", nil),
+			awserr.New(ecs.ErrCodeServerException, "Service Unavailable", nil),
+		},
+	}
+
+	var slept []time.Duration
+	sleep := func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+
+	output, err := runTaskChunks(context.Background(), svc, &ecs.RunTaskInput{
+		Count:       aws.Int64(1),
+		ClientToken: aws.String("token"),
+	}, 0, 3, sleep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(output.Tasks); l != 1 {
+		t.Fatal("bad number of tasks", l)
+	}
+	if l := len(svc.runTaskInputs); l != 3 {
+		t.Fatal("bad number of calls to RunTask", l)
+	}
+	if len(slept) != 2 || slept[0] != runTaskRetryDelay || slept[1] != 2*runTaskRetryDelay {
+		t.Fatalf("Expected exponential backoff, got %v", slept)
+	}
+	for _, input := range svc.runTaskInputs {
+		if *input.ClientToken != "token" {
+			t.Fatalf("Expected retries to reuse the client token, got %q", *input.ClientToken)
+		}
+	}
+}
+
+func TestStartTaskRetriesThrottling(t *testing.T) {
+	svc := &mockECS{
+		startTaskErrors: []error{
+			awserr.New("ThrottlingException", "Rate exceeded", nil),
+			awserr.New(ecs.ErrCodeServerException, "Service Unavailable", nil),
+		},
+	}
+
+	var slept []time.Duration
+	sleep := func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+
+	// a server error isn't retried, as the task may have started
+	_, err := retryStartTask(context.Background(), svc, &ecs.StartTaskInput{}, 3, sleep)
+	if err == nil || !strings.Contains(err.Error(), "Service Unavailable") {
+		t.Fatalf("Expected the server error, got %v", err)
+	}
+	if l := len(svc.startTaskInputs); l != 2 {
+		t.Fatal("bad number of calls to StartTask", l)
+	}
+	if len(slept) != 1 || slept[0] != runTaskRetryDelay {
+		t.Fatalf("Expected a single backoff for the throttling, got %v", slept)
+	}
+}
+
+func TestRunTaskRetriesExhausted(t *testing.T) {
+	svc := &mockECS{
+		runTaskErrors: []error{
+			awserr.New("ThrottlingException", "Rate exceeded", nil),
+			awserr.New("ThrottlingException", "Rate exceeded", nil),
+			awserr.New("ThrottlingException", "Rate exceeded", nil),
+		},
+	}
+	sleep := func(ctx context.Context, d time.Duration) error { return nil }
+
+	_, err := runTaskChunks(context.Background(), svc, &ecs.RunTaskInput{Count: aws.Int64(1)}, 0, 2, sleep)
+	if err == nil || !strings.Contains(err.Error(), "Rate exceeded") || !strings.Contains(err.Error(), "after 2 retries") {
+		t.Fatalf("Expected the final throttling error, got %v", err)
+	}
+	if l := len(svc.runTaskInputs); l != 3 {
+		t.Fatal("bad number of calls to RunTask", l)
+	}
+
+	// errors that won't go away aren't retried
+	svc = &mockECS{
+		runTaskErrors: []error{awserr.New(ecs.ErrCodeInvalidParameterException, "No Container Instances were found", nil)},
+	}
+	if _, err := runTaskChunks(context.Background(), svc, &ecs.RunTaskInput{Count: aws.Int64(1)}, 0, 2, sleep); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	if l := len(svc.runTaskInputs); l != 1 {
+		t.Fatal("Expected no retries of a client error", l)
+	}
+}
@@ -0,0 +1,101 @@
+package runner
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// envFileKeyPrefix is where uploaded env files are put in the bucket, under
+// the run id
+const envFileKeyPrefix = "ecs-run-task"
+
+type s3Interface interface {
+	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+	DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
+}
+
+// uploadedEnvFile is a local env file uploaded to S3 for a container
+type uploadedEnvFile struct {
+	Container string
+	LocalPath string
+	Key       string
+}
+
+// parseUploadEnvFiles parses env files in the form CONTAINER:localpath,
+// giving each a key under the run in the bucket
+func parseUploadEnvFiles(specs []string, runID string) ([]uploadedEnvFile, error) {
+	var files []uploadedEnvFile
+	for i, s := range specs {
+		container, localPath, err := parseContainerValue(s)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, uploadedEnvFile{
+			Container: container,
+			LocalPath: localPath,
+			// the index keeps files with the same name for a container apart
+			Key: path.Join(envFileKeyPrefix, runID, container, fmt.Sprintf("%d-%s", i, filepath.Base(localPath))),
+		})
+	}
+	return files, nil
+}
+
+// uploadEnvFiles uploads local env files to the bucket and adds them to the
+// environmentFiles of their containers. The uploaded files are returned even
+// on error, so they can be deleted.
+func uploadEnvFiles(client s3Interface, bucket, region string, defs []*ecs.ContainerDefinition, files []uploadedEnvFile) ([]uploadedEnvFile, error) {
+	partition := partitionForRegion(region)
+
+	var uploaded []uploadedEnvFile
+	for _, file := range files {
+		def, err := containerDefinition(defs, file.Container)
+		if err != nil {
+			return uploaded, err
+		}
+
+		f, err := os.Open(file.LocalPath)
+		if err != nil {
+			return uploaded, err
+		}
+		log.Printf("Uploading env file %s for %s to s3://%s/%s", file.LocalPath, file.Container, bucket, file.Key)
+		_, err = client.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(file.Key),
+			Body:   f,
+		})
+		f.Close()
+		if err != nil {
+			return uploaded, fmt.Errorf("failed to upload env file %s: %v", file.LocalPath, err)
+		}
+		uploaded = append(uploaded, file)
+
+		def.EnvironmentFiles = append(def.EnvironmentFiles, &ecs.EnvironmentFile{
+			Type:  aws.String(ecs.EnvironmentFileTypeS3),
+			Value: aws.String(fmt.Sprintf("arn:%s:s3:::%s/%s", partition, bucket, file.Key)),
+		})
+	}
+	return uploaded, nil
+}
+
+// deleteEnvFiles deletes uploaded env files, logging rather than failing so
+// every file gets a chance to be deleted
+func deleteEnvFiles(client s3Interface, bucket string, files []uploadedEnvFile) {
+	for _, file := range files {
+		_, err := client.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(file.Key),
+		})
+		if err != nil {
+			log.Printf("Failed to delete env file s3://%s/%s: %v", bucket, file.Key, err)
+			continue
+		}
+		log.Printf("Deleted env file s3://%s/%s", bucket, file.Key)
+	}
+}
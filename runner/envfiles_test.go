@@ -0,0 +1,100 @@
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type mockS3 struct {
+	objects map[string]string
+	deleted []string
+}
+
+func (m *mockS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	if m.objects == nil {
+		m.objects = map[string]string{}
+	}
+	m.objects[*input.Bucket+"/"+*input.Key] = string(body)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *mockS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	m.deleted = append(m.deleted, *input.Bucket+"/"+*input.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestUploadEnvFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "app.env")
+	if err := ioutil.WriteFile(file, []byte("DB_HOST=db.internal\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	svc := &mockECS{
+		taskDefinitions: map[string]*ecs.TaskDefinition{
+			"my-task:3": {
+				Family:               aws.String("my-task"),
+				ExecutionRoleArn:     aws.String("arn:aws:iam::012345678910:role/ecsTaskExecutionRole"),
+				ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("app")}},
+			},
+		},
+	}
+	m := &mockS3{}
+
+	r := New()
+	r.Region = "us-east-1"
+	r.RunID = "abc123"
+	r.ExistingTaskDefinition = "my-task:3"
+	r.UploadEnvFiles = []string{"app:" + file}
+	r.EnvFileBucket = "my-bucket"
+	r.s3 = m
+
+	if err := r.dryRun(context.Background(), svc, "my-prefix"); err != nil {
+		t.Fatal(err)
+	}
+
+	key := "my-bucket/ecs-run-task/abc123/app/0-app.env"
+	if body, ok := m.objects[key]; !ok || body != "DB_HOST=db.internal\n" {
+		t.Fatalf("Expected the env file to be uploaded to %s, got %v", key, m.objects)
+	}
+
+	files := svc.registered[0].ContainerDefinitions[0].EnvironmentFiles
+	if len(files) != 1 || *files[0].Type != "s3" || *files[0].Value != "arn:aws:s3:::"+key {
+		t.Fatalf("bad environment files %v", files)
+	}
+
+	if len(m.deleted) != 1 || m.deleted[0] != key {
+		t.Fatalf("Expected the env file to be cleaned up, got %v", m.deleted)
+	}
+}
+
+func TestUploadEnvFilesUnknownContainer(t *testing.T) {
+	files, err := parseUploadEnvFiles([]string{"llamas:/nope.env"}, "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockS3{}
+	defs := []*ecs.ContainerDefinition{{Name: aws.String("app")}}
+	if _, err := uploadEnvFiles(m, "my-bucket", "us-east-1", defs, files); err == nil {
+		t.Fatal("Expected an error for an unknown container")
+	}
+	if len(m.objects) != 0 {
+		t.Fatalf("Expected nothing to be uploaded, got %v", m.objects)
+	}
+}
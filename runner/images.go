@@ -0,0 +1,85 @@
+package runner
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// ecrImageRegexp matches private ECR image references, capturing the
+// registry id, region and the repository with its tag or digest
+var ecrImageRegexp = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(?:-fips)?\.([a-z0-9-]+)\.amazonaws\.com(?:\.cn)?/(.+)$`)
+
+type ecrInterface interface {
+	DescribeImages(input *ecr.DescribeImagesInput) (*ecr.DescribeImagesOutput, error)
+}
+
+// ecrImage is a reference to an image in a private ECR repository
+type ecrImage struct {
+	RegistryID string
+	Region     string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// parseECRImage parses a private ECR image reference, returning false for
+// images from other registries
+func parseECRImage(image string) (ecrImage, bool) {
+	m := ecrImageRegexp.FindStringSubmatch(image)
+	if m == nil {
+		return ecrImage{}, false
+	}
+
+	ref := ecrImage{RegistryID: m[1], Region: m[2], Repository: m[3], Tag: "latest"}
+	if i := strings.Index(ref.Repository, "@"); i >= 0 {
+		ref.Repository, ref.Digest, ref.Tag = ref.Repository[:i], ref.Repository[i+1:], ""
+	} else if i := strings.LastIndex(ref.Repository, ":"); i >= 0 {
+		ref.Repository, ref.Tag = ref.Repository[:i], ref.Repository[i+1:]
+	}
+	return ref, true
+}
+
+// validateImages checks that every private ECR image in the container
+// definitions exists, using a client for the image's region. Images from
+// other registries are skipped.
+func validateImages(clients func(region string) ecrInterface, defs []*ecs.ContainerDefinition) error {
+	for _, def := range defs {
+		image := aws.StringValue(def.Image)
+		ref, ok := parseECRImage(image)
+		if !ok {
+			log.Printf("Skipping validating image %s of %s, it isn't in ECR", image, aws.StringValue(def.Name))
+			continue
+		}
+
+		id := &ecr.ImageIdentifier{}
+		if ref.Digest != "" {
+			id.ImageDigest = aws.String(ref.Digest)
+		} else {
+			id.ImageTag = aws.String(ref.Tag)
+		}
+
+		_, err := clients(ref.Region).DescribeImages(&ecr.DescribeImagesInput{
+			RegistryId:     aws.String(ref.RegistryID),
+			RepositoryName: aws.String(ref.Repository),
+			ImageIds:       []*ecr.ImageIdentifier{id},
+		})
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case ecr.ErrCodeImageNotFoundException, ecr.ErrCodeRepositoryNotFoundException:
+				return fmt.Errorf("image %s of %s doesn't exist: %s", image, aws.StringValue(def.Name), aerr.Message())
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to validate image %s of %s: %v", image, aws.StringValue(def.Name), err)
+		}
+		log.Printf("Validated image %s of %s exists", image, aws.StringValue(def.Name))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package runner
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+type mockECR struct {
+	// images are repository:tag references that exist
+	images  map[string]bool
+	regions []string
+	inputs  []*ecr.DescribeImagesInput
+}
+
+func (m *mockECR) client(region string) ecrInterface {
+	m.regions = append(m.regions, region)
+	return m
+}
+
+func (m *mockECR) DescribeImages(input *ecr.DescribeImagesInput) (*ecr.DescribeImagesOutput, error) {
+	m.inputs = append(m.inputs, input)
+	ref := *input.RepositoryName + ":" + aws.StringValue(input.ImageIds[0].ImageTag)
+	if !m.images[ref] {
+		return nil, awserr.New(ecr.ErrCodeImageNotFoundException,
+			"The image with imageId {imageTag:'"+aws.StringValue(input.ImageIds[0].ImageTag)+"'} does not exist", nil)
+	}
+	return &ecr.DescribeImagesOutput{}, nil
+}
+
+func TestParseECRImage(t *testing.T) {
+	for _, tc := range []struct {
+		image    string
+		expected ecrImage
+	}{
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/myapp:v1", ecrImage{"123456789012", "us-east-1", "myapp", "v1", ""}},
+		{"123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/myapp", ecrImage{"123456789012", "eu-west-1", "team/myapp", "latest", ""}},
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/myapp@sha256:abc", ecrImage{"123456789012", "us-east-1", "myapp", "", "sha256:abc"}},
+	} {
+		ref, ok := parseECRImage(tc.image)
+		if !ok || ref != tc.expected {
+			t.Fatalf("Expected %+v for %s, got %+v", tc.expected, tc.image, ref)
+		}
+	}
+
+	for _, image := range []string{"alpine:latest", "public.ecr.aws/docker/library/busybox:stable", "localhost:5000/myapp"} {
+		if _, ok := parseECRImage(image); ok {
+			t.Fatalf("Expected %s not to be an ECR image", image)
+		}
+	}
+}
+
+func TestValidateImagesMissingTag(t *testing.T) {
+	m := &mockECR{images: map[string]bool{"myapp:v1": true}}
+	defs := []*ecs.ContainerDefinition{
+		{Name: aws.String("app"), Image: aws.String("123456789012.dkr.ecr.us-east-1.amazonaws.com/myapp:v1")},
+		{Name: aws.String("proxy"), Image: aws.String("envoyproxy/envoy:v1.28")},
+		{Name: aws.String("worker"), Image: aws.String("123456789012.dkr.ecr.us-west-2.amazonaws.com/myapp:v1.O")},
+	}
+
+	err := validateImages(m.client, defs)
+	if err == nil {
+		t.Fatal("Expected an error for the missing tag, got nil")
+	}
+	if !strings.Contains(err.Error(), "123456789012.dkr.ecr.us-west-2.amazonaws.com/myapp:v1.O of worker doesn't exist") {
+		t.Fatalf("bad error message returned: %q", err.Error())
+	}
+	if len(m.inputs) != 2 {
+		t.Fatalf("Expected the non-ECR image to be skipped, got %d describes", len(m.inputs))
+	}
+	if len(m.regions) != 2 || m.regions[1] != "us-west-2" {
+		t.Fatalf("Expected a client for each image's region, got %v", m.regions)
+	}
+	if id := *m.inputs[0].RegistryId; id != "123456789012" {
+		t.Fatalf("bad registry id %q", id)
+	}
+
+	if err := validateImages(m.client, defs[:2]); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,79 @@
+package runner
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+type ec2Interface interface {
+	DescribeSubnets(input *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error)
+	DescribeSecurityGroups(input *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error)
+	DescribeNetworkInterfaces(input *ec2.DescribeNetworkInterfacesInput) (*ec2.DescribeNetworkInterfacesOutput, error)
+}
+
+// validateNetwork checks that the subnets and security groups exist in the
+// region and are all in the same VPC
+func validateNetwork(svc ec2Interface, region string, subnets, securityGroups []string) error {
+	var vpc, vpcSource string
+
+	checkVpc := func(resource, vpcID string) error {
+		if vpc == "" {
+			vpc, vpcSource = vpcID, resource
+			return nil
+		}
+		if vpcID != vpc {
+			return fmt.Errorf("%s is in %s, but %s is in %s", resource, vpcID, vpcSource, vpc)
+		}
+		return nil
+	}
+
+	if len(subnets) > 0 {
+		log.Printf("Validating subnets %s", strings.Join(subnets, ", "))
+		resp, err := svc.DescribeSubnets(&ec2.DescribeSubnetsInput{
+			SubnetIds: aws.StringSlice(subnets),
+		})
+		if err != nil {
+			return networkError("subnets", region, err)
+		}
+		for _, subnet := range resp.Subnets {
+			az := aws.StringValue(subnet.AvailabilityZone)
+			if region != "" && !strings.HasPrefix(az, region) {
+				return fmt.Errorf("subnet %s is in %s, which isn't in region %s",
+					*subnet.SubnetId, az, region)
+			}
+			if err := checkVpc("subnet "+*subnet.SubnetId, aws.StringValue(subnet.VpcId)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(securityGroups) > 0 {
+		log.Printf("Validating security groups %s", strings.Join(securityGroups, ", "))
+		resp, err := svc.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+			GroupIds: aws.StringSlice(securityGroups),
+		})
+		if err != nil {
+			return networkError("security groups", region, err)
+		}
+		for _, group := range resp.SecurityGroups {
+			if err := checkVpc("security group "+*group.GroupId, aws.StringValue(group.VpcId)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// networkError explains that missing resources may be in another region
+func networkError(resources, region string, err error) error {
+	if aerr, ok := err.(awserr.Error); ok && strings.HasSuffix(aerr.Code(), ".NotFound") {
+		return fmt.Errorf("Failed to find %s in region %s: %s", resources, region, aerr.Message())
+	}
+	return fmt.Errorf("Failed to describe %s: %v", resources, err)
+}
@@ -0,0 +1,126 @@
+package runner
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestValidateNetwork(t *testing.T) {
+	svc := &mockEC2{
+		subnets: []*ec2.Subnet{
+			{SubnetId: aws.String("subnet-a"), VpcId: aws.String("vpc-1"), AvailabilityZone: aws.String("us-east-1a")},
+			{SubnetId: aws.String("subnet-b"), VpcId: aws.String("vpc-1"), AvailabilityZone: aws.String("us-east-1b")},
+		},
+		securityGroups: []*ec2.SecurityGroup{
+			{GroupId: aws.String("sg-a"), VpcId: aws.String("vpc-1")},
+		},
+	}
+
+	err := validateNetwork(svc, "us-east-1", []string{"subnet-a", "subnet-b"}, []string{"sg-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateNetworkMismatchedVpc(t *testing.T) {
+	svc := &mockEC2{
+		subnets: []*ec2.Subnet{
+			{SubnetId: aws.String("subnet-a"), VpcId: aws.String("vpc-1"), AvailabilityZone: aws.String("us-east-1a")},
+		},
+		securityGroups: []*ec2.SecurityGroup{
+			{GroupId: aws.String("sg-a"), VpcId: aws.String("vpc-2")},
+		},
+	}
+
+	err := validateNetwork(svc, "us-east-1", []string{"subnet-a"}, []string{"sg-a"})
+	if err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	if err.Error() != "security group sg-a is in vpc-2, but subnet subnet-a is in vpc-1" {
+		t.Fatalf("bad error message returned: %q", err.Error())
+	}
+}
+
+func TestValidateNetworkWrongRegion(t *testing.T) {
+	svc := &mockEC2{
+		subnets: []*ec2.Subnet{
+			{SubnetId: aws.String("subnet-a"), VpcId: aws.String("vpc-1"), AvailabilityZone: aws.String("us-west-2a")},
+		},
+	}
+
+	err := validateNetwork(svc, "us-east-1", []string{"subnet-a"}, nil)
+	if err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	if err.Error() != "subnet subnet-a is in us-west-2a, which isn't in region us-east-1" {
+		t.Fatalf("bad error message returned: %q", err.Error())
+	}
+}
+
+func TestValidateNetworkNotFound(t *testing.T) {
+	svc := &mockEC2{}
+
+	err := validateNetwork(svc, "us-east-1", []string{"subnet-a"}, nil)
+	if err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	if !strings.HasPrefix(err.Error(), "Failed to find subnets in region us-east-1") {
+		t.Fatalf("bad error message returned: %q", err.Error())
+	}
+}
+
+type mockEC2 struct {
+	subnets           []*ec2.Subnet
+	securityGroups    []*ec2.SecurityGroup
+	networkInterfaces []*ec2.NetworkInterface
+}
+
+func (m *mockEC2) DescribeSubnets(input *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	output := &ec2.DescribeSubnetsOutput{}
+	for _, id := range input.SubnetIds {
+		var found bool
+		for _, subnet := range m.subnets {
+			if *subnet.SubnetId == *id {
+				output.Subnets = append(output.Subnets, subnet)
+				found = true
+			}
+		}
+		if !found {
+			return nil, awserr.New("InvalidSubnetID.NotFound", "The subnet ID '"+*id+"' does not exist", nil)
+		}
+	}
+	return output, nil
+}
+
+func (m *mockEC2) DescribeSecurityGroups(input *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+	output := &ec2.DescribeSecurityGroupsOutput{}
+	for _, id := range input.GroupIds {
+		var found bool
+		for _, group := range m.securityGroups {
+			if *group.GroupId == *id {
+				output.SecurityGroups = append(output.SecurityGroups, group)
+				found = true
+			}
+		}
+		if !found {
+			return nil, awserr.New("InvalidGroup.NotFound", "The security group '"+*id+"' does not exist", nil)
+		}
+	}
+	return output, nil
+}
+
+func (m *mockEC2) DescribeNetworkInterfaces(input *ec2.DescribeNetworkInterfacesInput) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	output := &ec2.DescribeNetworkInterfacesOutput{}
+	for _, id := range input.NetworkInterfaceIds {
+		for _, ni := range m.networkInterfaces {
+			if *ni.NetworkInterfaceId == *id {
+				output.NetworkInterfaces = append(output.NetworkInterfaces, ni)
+			}
+		}
+	}
+	return output, nil
+}
@@ -0,0 +1,63 @@
+package runner
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// limitedLogs bounds how many log streams are polled at once. A slot is held
+// for each request rather than for a watcher's lifetime, so every watcher
+// keeps up with its stream and only waits its turn to poll it.
+type limitedLogs struct {
+	cloudwatchLogsInterface
+	slots chan struct{}
+}
+
+// limitLogPolling wraps a CloudWatch Logs client so at most max streams are
+// polled at once. A max of zero is unbounded.
+func limitLogPolling(cwl cloudwatchLogsInterface, max int) cloudwatchLogsInterface {
+	if max <= 0 {
+		return cwl
+	}
+	return &limitedLogs{cloudwatchLogsInterface: cwl, slots: make(chan struct{}, max)}
+}
+
+func (l *limitedLogs) DescribeLogStreamsPages(input *cloudwatchlogs.DescribeLogStreamsInput,
+	fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool) error {
+	l.slots <- struct{}{}
+	defer func() { <-l.slots }()
+	return l.cloudwatchLogsInterface.DescribeLogStreamsPages(input, fn)
+}
+
+func (l *limitedLogs) FilterLogEventsPages(input *cloudwatchlogs.FilterLogEventsInput,
+	fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool) error {
+	l.slots <- struct{}{}
+	defer func() { <-l.slots }()
+	return l.cloudwatchLogsInterface.FilterLogEventsPages(input, fn)
+}
+
+// watchErrors records the error each container's log watcher stopped with, so
+// one failing watcher is reported without affecting the others
+type watchErrors struct {
+	mu   sync.Mutex
+	errs map[string]error
+}
+
+func newWatchErrors() *watchErrors {
+	return &watchErrors{errs: map[string]error{}}
+}
+
+// Set records the error a container's watcher stopped with
+func (w *watchErrors) Set(taskArn, container string, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.errs[taskArn+"/"+container] = err
+}
+
+// Get returns the error a container's watcher stopped with, if any
+func (w *watchErrors) Get(taskArn, container string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.errs[taskArn+"/"+container]
+}
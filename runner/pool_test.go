@@ -0,0 +1,149 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// streamLogs is a CloudWatch Logs client with events per stream, which
+// honours StartTime and records how many requests are in flight at once
+type streamLogs struct {
+	mockCloudWatchLogs
+
+	mu     sync.Mutex
+	events map[string][]*cloudwatchlogs.FilteredLogEvent
+
+	inFlight, peak int32
+}
+
+func (s *streamLogs) append(stream, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[stream] = append(s.events[stream], &cloudwatchlogs.FilteredLogEvent{
+		Message:   aws.String(message),
+		Timestamp: aws.Int64(time.Now().UnixNano()/int64(time.Millisecond) + 1),
+	})
+}
+
+func (s *streamLogs) DescribeLogStreamsPages(input *cloudwatchlogs.DescribeLogStreamsInput,
+	fn func(*cloudwatchlogs.DescribeLogStreamsOutput, bool) bool) error {
+	s.track()
+	defer atomic.AddInt32(&s.inFlight, -1)
+	fn(&cloudwatchlogs.DescribeLogStreamsOutput{
+		LogStreams: []*cloudwatchlogs.LogStream{{LogStreamName: input.LogStreamNamePrefix}},
+	}, true)
+	return nil
+}
+
+func (s *streamLogs) FilterLogEventsPages(input *cloudwatchlogs.FilterLogEventsInput,
+	fn func(*cloudwatchlogs.FilterLogEventsOutput, bool) bool) error {
+	s.track()
+	defer atomic.AddInt32(&s.inFlight, -1)
+
+	s.mu.Lock()
+	var events []*cloudwatchlogs.FilteredLogEvent
+	for _, ev := range s.events[*input.LogStreamNames[0]] {
+		if *ev.Timestamp >= *input.StartTime {
+			events = append(events, ev)
+		}
+	}
+	s.mu.Unlock()
+
+	fn(&cloudwatchlogs.FilterLogEventsOutput{Events: events}, true)
+	return nil
+}
+
+// track counts a request in flight, holding it briefly so overlapping
+// requests are seen
+func (s *streamLogs) track() {
+	n := atomic.AddInt32(&s.inFlight, 1)
+	for {
+		p := atomic.LoadInt32(&s.peak)
+		if n <= p || atomic.CompareAndSwapInt32(&s.peak, p, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+}
+
+func TestLimitLogPollingWatchesEveryStream(t *testing.T) {
+	logs := &streamLogs{events: map[string][]*cloudwatchlogs.FilteredLogEvent{}}
+	pollLogs := limitLogPolling(logs, 2)
+	var watchers sync.WaitGroup
+
+	var mu sync.Mutex
+	printed := map[string]bool{}
+
+	streams := []string{"app", "sidecar", "proxy", "agent", "migrate"}
+	for _, stream := range streams {
+		stream := stream
+		watcher := &logWatcher{
+			CloudWatchLogs: pollLogs,
+			LogGroupName:   "my-group",
+			LogStreamName:  stream,
+			Interval:       time.Millisecond * 5,
+			Timeout:        time.Second * 5,
+			Printer: func(ev *cloudwatchlogs.FilteredLogEvent) bool {
+				if strings.HasPrefix(*ev.Message, "Container "+stream+" exited with") {
+					return false
+				}
+				mu.Lock()
+				printed[stream] = true
+				mu.Unlock()
+				return true
+			},
+		}
+		watchers.Add(1)
+		go func() {
+			defer watchers.Done()
+			if err := watcher.Watch(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	// every container logs while they're all still running, which is more
+	// containers than can be polled at once
+	for _, stream := range streams {
+		logs.append(stream, "hello from "+stream)
+	}
+	deadline := time.Now().Add(time.Second * 2)
+	for {
+		mu.Lock()
+		n := len(printed)
+		mu.Unlock()
+		if n == len(streams) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected logs from all %d containers while they run, got %d", len(streams), n)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	for _, stream := range streams {
+		logs.append(stream, fmt.Sprintf("Container %s exited with 0", stream))
+	}
+	done := make(chan struct{})
+	go func() {
+		watchers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("Expected every watcher to stop at its container's exit line")
+	}
+
+	if peak := atomic.LoadInt32(&logs.peak); peak > 2 {
+		t.Fatalf("Expected at most 2 streams polled at once, got %d", peak)
+	}
+}
@@ -0,0 +1,81 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// logPrefixFields are the fields available to a log prefix template
+type logPrefixFields struct {
+	Task      string
+	Container string
+	Cluster   string
+}
+
+// logPrefix formats the prefix printed before each log line
+type logPrefix struct {
+	tmpl *template.Template
+
+	// Container prefixes lines with [container-name]
+	Container bool
+
+	// Timestamps prefixes lines with the event's RFC3339 timestamp
+	Timestamps bool
+}
+
+// newLogPrefix parses a log prefix template, which may be empty
+func newLogPrefix(text string) (*logPrefix, error) {
+	p := &logPrefix{}
+	if text == "" {
+		return p, nil
+	}
+
+	tmpl, err := template.New("log-prefix").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --log-prefix-template: %v", err)
+	}
+
+	// render with sample fields so unknown fields are caught at startup
+	p.tmpl = tmpl
+	if _, err := p.render(logPrefixFields{}); err != nil {
+		return nil, fmt.Errorf("invalid --log-prefix-template: %v", err)
+	}
+
+	return p, nil
+}
+
+func (p *logPrefix) render(fields logPrefixFields) (string, error) {
+	var buf bytes.Buffer
+	if err := p.tmpl.Execute(&buf, fields); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Format returns a log line with the prefixes in front of it
+func (p *logPrefix) Format(fields logPrefixFields, line string) string {
+	if p.tmpl != nil {
+		if prefix, err := p.render(fields); err == nil {
+			line = prefix + line
+		}
+	}
+	if p.Container {
+		line = fmt.Sprintf("[%s] %s", fields.Container, line)
+	}
+	return line
+}
+
+// FormatEvent formats a log event's message, adding its timestamp if enabled
+func (p *logPrefix) FormatEvent(fields logPrefixFields, ev *cloudwatchlogs.FilteredLogEvent) string {
+	line := p.Format(fields, aws.StringValue(ev.Message))
+	if p.Timestamps && ev.Timestamp != nil {
+		ts := time.Unix(0, *ev.Timestamp*int64(time.Millisecond)).UTC()
+		line = ts.Format(time.RFC3339) + " " + line
+	}
+	return line
+}
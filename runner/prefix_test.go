@@ -0,0 +1,64 @@
+package runner
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+func TestLogPrefixFormat(t *testing.T) {
+	p, err := newLogPrefix("[{{.Cluster}}/{{.Task}}/{{.Container}}] ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := p.Format(logPrefixFields{
+		Task:      "abc123",
+		Container: "app",
+		Cluster:   "my-cluster",
+	}, "hello world")
+	if line != "[my-cluster/abc123/app] hello world" {
+		t.Fatalf("bad line %q", line)
+	}
+}
+
+func TestLogPrefixWithoutTemplate(t *testing.T) {
+	p, err := newLogPrefix("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := p.Format(logPrefixFields{Task: "abc123"}, "hello world"); line != "hello world" {
+		t.Fatalf("bad line %q", line)
+	}
+}
+
+func TestLogPrefixInvalid(t *testing.T) {
+	for _, text := range []string{"{{.Task", "{{.Llamas}}"} {
+		if _, err := newLogPrefix(text); err == nil {
+			t.Errorf("Expected an error for %q", text)
+		}
+	}
+}
+
+func TestLogPrefixFormatEvent(t *testing.T) {
+	p, err := newLogPrefix("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Container = true
+	fields := logPrefixFields{Task: "abc123", Container: "app"}
+	ev := &cloudwatchlogs.FilteredLogEvent{
+		Message:   aws.String("hello world"),
+		Timestamp: aws.Int64(1577836800000),
+	}
+
+	if line := p.FormatEvent(fields, ev); line != "[app] hello world" {
+		t.Fatalf("bad line %q", line)
+	}
+
+	p.Timestamps = true
+	if line := p.FormatEvent(fields, ev); line != "2020-01-01T00:00:00Z [app] hello world" {
+		t.Fatalf("bad line %q", line)
+	}
+}
@@ -0,0 +1,53 @@
+package runner
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// requestIDs records the AWS request IDs of the calls that change things, so
+// a run can be correlated with CloudTrail
+type requestIDs struct {
+	mu  sync.Mutex
+	ops map[string]bool
+	ids map[string][]string
+}
+
+func newRequestIDs(ops ...string) *requestIDs {
+	r := &requestIDs{ops: map[string]bool{}, ids: map[string][]string{}}
+	for _, op := range ops {
+		r.ops[op] = true
+	}
+	return r
+}
+
+// Handler records the request ID of a completed request, including failed
+// ones, once the response has been read
+func (r *requestIDs) Handler() request.NamedHandler {
+	return request.NamedHandler{
+		Name: "ecsRunTask.RequestIDs",
+		Fn: func(req *request.Request) {
+			if req.Operation == nil || !r.ops[req.Operation.Name] || req.RequestID == "" {
+				return
+			}
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.ids[req.Operation.Name] = append(r.ids[req.Operation.Name], req.RequestID)
+		},
+	}
+}
+
+// Map returns the request IDs by operation, in the order they were made
+func (r *requestIDs) Map() map[string][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.ids) == 0 {
+		return nil
+	}
+	out := make(map[string][]string, len(r.ids))
+	for op, ids := range r.ids {
+		out[op] = append([]string(nil), ids...)
+	}
+	return out
+}
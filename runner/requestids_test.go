@@ -0,0 +1,93 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestRequestIDsAreInTheSummary(t *testing.T) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	}))
+
+	svc := ecs.New(sess)
+	reqIDs := newRequestIDs("RegisterTaskDefinition", "RunTask")
+	svc.Handlers.Complete.PushBackNamed(reqIDs.Handler())
+
+	// respond without sending anything, with a request ID like ECS does
+	var count int
+	svc.Handlers.Send.Clear()
+	svc.Handlers.Send.PushBack(func(r *request.Request) {
+		count++
+		body := `{}`
+		if r.Operation.Name == "RunTask" {
+			body = `{"tasks":[{"taskArn":"arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123"}]}`
+		}
+		r.HTTPResponse = &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"X-Amzn-Requestid": []string{fmt.Sprintf("request-%d", count)}},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}
+	})
+
+	if _, err := svc.RegisterTaskDefinition(&ecs.RegisterTaskDefinitionInput{
+		Family:               aws.String("my-task"),
+		ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("app")}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.RunTask(&ecs.RunTaskInput{TaskDefinition: aws.String("my-task:1")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.DescribeTasks(&ecs.DescribeTasksInput{Tasks: aws.StringSlice([]string{"abc123"})}); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := newSummary(nil)
+	summary.RequestIDs = reqIDs.Map()
+
+	var buf bytes.Buffer
+	if err := writeSummary(&buf, OutputJSON, summary); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		RequestIDs map[string][]string `json:"requestIds"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"RegisterTaskDefinition": {"request-1"},
+		"RunTask":                {"request-2"},
+	}
+	if !reflect.DeepEqual(decoded.RequestIDs, expected) {
+		t.Fatalf("Expected %v, got %v", expected, decoded.RequestIDs)
+	}
+}
+
+func TestRequestIDsAreOmittedWhenEmpty(t *testing.T) {
+	summary := newSummary(nil)
+	summary.RequestIDs = newRequestIDs("RunTask").Map()
+
+	var buf bytes.Buffer
+	if err := writeSummary(&buf, OutputJSON, summary); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "requestIds") {
+		t.Fatalf("Expected no requestIds, got %s", buf.String())
+	}
+}
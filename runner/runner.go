@@ -2,21 +2,73 @@ package runner
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/buildkite/ecs-run-task/parser"
+	"github.com/buildkite/interpolate"
+)
+
+const (
+	// managedByTag marks tasks as launched by ecs-run-task, so orphaned tasks
+	// can be found later, and task definitions as registered by it
+	managedByTag   = "ManagedBy"
+	managedByValue = "ecs-run-task"
+
+	// runIDTag identifies the run a task was launched by
+	runIDTag = "RunId"
+
+	// defaultStartedBy is the startedBy of tasks if none is given
+	defaultStartedBy = "ecs-run-task"
+
+	// maxStartedByLength is the longest startedBy ECS accepts
+	maxStartedByLength = 128
+
+	// defaultDeregisterTimeout is how long deregistering the task definition
+	// can take if no timeout is given
+	defaultDeregisterTimeout = time.Second * 30
+
+	// minEphemeralStorageGiB and maxEphemeralStorageGiB are the ephemeral
+	// storage FARGATE allows, rather than the default of 20 GiB
+	minEphemeralStorageGiB = 21
+	maxEphemeralStorageGiB = 200
+)
+
+const (
+	// PrintEnvKeys prints the names of the container environment variables
+	PrintEnvKeys = "keys"
+
+	// PrintEnvFull prints the container environment variables with values
+	PrintEnvFull = "full"
 )
 
 // Override ..
@@ -27,127 +79,609 @@ type Override struct {
 
 // Runner ..
 type Runner struct {
-	Service            string
-	TaskName           string
-	TaskDefinitionFile string
-	Cluster            string
-	LogGroupName       string
-	Region             string
-	Config             *aws.Config
-	Overrides          []Override
-	Fargate            bool
-	SecurityGroups     []string
-	Subnets            []string
-	Environment        []string
-	Count              int64
-	Deregister         bool
+	Service               string
+	TaskName              string
+	TaskDefinitionFile    string
+	VarsFile              string
+	VarsPrecedence        string
+	Cluster               string
+	LogGroupName          string
+	LogGroupClass         string
+	Region                string
+	Profile               string
+	AssumeRoleARN         string
+	AssumeRoleSessionName string
+	EndpointURL           string
+	EndpointSkipTLSVerify bool
+	MaxRetries            int
+	ArnFile               string
+
+	// LogPollInterval and LogWaitTimeout are how often log streams are
+	// polled and how long to wait for them to exist, defaulting to 2s and 60m
+	LogPollInterval          time.Duration
+	LogWaitTimeout           time.Duration
+	Config                   *aws.Config
+	Overrides                []Override
+	Fargate                  bool
+	SecurityGroups           []string
+	Subnets                  []string
+	AssignPublicIp           string
+	CapacityProviderStrategy []ecs.CapacityProviderStrategyItem
+	Environment              []string
+	EnvFiles                 []string
+	Count                    int64
+	Deregister               bool
+	DeregisterPrevious       bool
+	TTY                      []string
+	InjectTaskMetadata       bool
+	PlatformVersion          string
+	EnableExecuteCommand     bool
+	Output                   string
+	ContainerInstance        string
+	StopTimeout              int64
+	AddHosts                 []string
+	ContainerCPU             []string
+	CredentialSpecs          []string
+	RunID                    string
+	PropagateTags            string
+	Tags                     []*ecs.Tag
+	PlacementConstraints     []*ecs.PlacementConstraint
+	PlacementStrategy        []*ecs.PlacementStrategy
+	StartedBy                string
+	PrintInsightsQuery       bool
+	DNSServers               []string
+	DNSSearchDomains         []string
+	Hostnames                []string
+	ValidateNetwork          bool
+	ResultWebhook            string
+	ResultWebhookTimeout     time.Duration
+	StrictWebhook            bool
+
+	// AttachService tails the logs of an existing service's running tasks
+	// rather than running a new task
+	AttachService string
+
+	// ExistingTaskDefinition is a family:revision to run instead of a task
+	// definition file
+	ExistingTaskDefinition string
+	NoDescribeOnExisting   bool
+
+	// MaxConcurrentWatchers caps how many log streams are polled at once,
+	// zero means no limit
+	MaxConcurrentWatchers int
+
+	// WaitForLog returns successfully once a log line matches, stopping the
+	// tasks unless LeaveRunning is set
+	WaitForLog   string
+	LeaveRunning bool
+
+	// ReadyWhen is a CONTAINER:REGEX that returns successfully, leaving the
+	// tasks running, once the named container logs a matching line
+	ReadyWhen string
+
+	// ClientToken makes RunTask idempotent. If empty, one is generated from
+	// the run ID and task definition, so retries within a run collapse
+	// without separate runs colliding.
+	ClientToken string
+
+	// DryRun registers the task definition but doesn't run it
+	DryRun bool
+
+	// PerTaskTimeout stops any task that runs for longer than it, without
+	// affecting the other tasks in the run
+	PerTaskTimeout time.Duration
+
+	// OverlayFiles are deep merged over the task definition file in order
+	OverlayFiles []string
+
+	// Patch is an RFC 6902 JSON Patch applied to the task definition file
+	Patch string
+
+	// LogPrefixTemplate is a Go template for the prefix of each log line,
+	// with .Task, .Container and .Cluster fields
+	LogPrefixTemplate string
+
+	// LogPrefix and Timestamps prefix each log line with the container name
+	// and the time it was logged
+	LogPrefix  bool
+	Timestamps bool
+
+	// CreateLogGroup creates the log group if it doesn't exist, otherwise
+	// it must already exist
+	CreateLogGroup bool
+
+	// RetentionDays sets the retention of the log group if it's non-zero
+	RetentionDays int64
+
+	// LogKmsKeyID is a KMS key to encrypt the log group with if it's created
+	LogKmsKeyID string
+
+	// LaunchStagger is how long to wait between RunTask calls when Count
+	// needs more than one
+	LaunchStagger time.Duration
+
+	// PrintEnv prints the container environment to stderr, either
+	// PrintEnvKeys or PrintEnvFull
+	PrintEnv string
+
+	// ExponentialDescribe backs off describing the tasks while waiting for
+	// them to stop, for long running tasks
+	ExponentialDescribe bool
+
+	// NoColor disables coloring each container's log lines
+	NoColor bool
+
+	// DeregisterTimeout caps how long deregistering the task definition can
+	// take, defaulting to 30 seconds
+	DeregisterTimeout time.Duration
+
+	// ImageOverrides replaces container images by container name, where an
+	// empty name is the first container
+	ImageOverrides map[string]string
+
+	// Essential marks containers essential or not, in the form
+	// CONTAINER=true|false
+	Essential []string
+
+	// ValidateImages checks that private ECR images exist before registering
+	// the task definition
+	ValidateImages bool
+
+	// ecrClient returns an ECR client for a region, set by Run
+	ecrClient func(region string) ecrInterface
+
+	// UploadEnvFiles are CONTAINER:localpath env files to upload to
+	// EnvFileBucket and add to the container's environmentFiles, deleting
+	// them once the run is done
+	UploadEnvFiles []string
+	EnvFileBucket  string
+
+	// s3 uploads env files, set by Run
+	s3 s3Interface
+
+	// WorkingDirectories are CONTAINER:dir values that replace the working
+	// directory from the task definition
+	WorkingDirectories []string
+
+	// Secrets are Secrets Manager or SSM Parameter Store secrets to expose as
+	// environment variables, by container name, where an empty name is the
+	// first container
+	Secrets map[string][]*ecs.Secret
+
+	// SecretFiles are CONTAINER:path=arn secrets to write to read only files
+	SecretFiles []string
+
+	// Annotate annotates the Buildkite build or GitHub Actions workflow
+	// with the result of the run
+	Annotate bool
+
+	// Detach prints the ARNs of the tasks once they're launched and returns,
+	// without tailing their logs or waiting for them. Deregister is ignored
+	// as the tasks still need the task definition.
+	Detach bool
+
+	// DescribeAfter describes the tasks again once they've stopped and prints
+	// their attachments and network interfaces for debugging
+	DescribeAfter bool
+
+	// ExitCodeStrategy is how the exit code is chosen from the containers'
+	// exit codes, defaulting to ExitCodeFirst
+	ExitCodeStrategy string
+
+	// EphemeralStorageGiB is the ephemeral storage of FARGATE tasks, which
+	// defaults to 20 GiB
+	EphemeralStorageGiB int64
+
+	// IgnoredContainers are the names of containers whose exit codes don't
+	// count towards the exit code, such as sidecars
+	IgnoredContainers []string
+
+	// TaskCPU and TaskMemory set the task level cpu and memory, such as to
+	// size FARGATE tasks, in the forms the task definition accepts. They're
+	// set on a registered task definition and overridden when running it.
+	TaskCPU    string
+	TaskMemory string
+
+	// RuntimePlatform sets the cpu architecture and operating system family
+	// of the task definition, such as ARM64 for Graviton, leaving either as
+	// the task definition has it if they're not set
+	RuntimePlatform *ecs.RuntimePlatform
+
+	// TaskRoleArn and ExecutionRoleArn replace the roles of the task
+	// definition, such as to run it in different environments
+	TaskRoleArn      string
+	ExecutionRoleArn string
+
+	// ExpandCommandEnv expands $VAR and ${VAR} in override commands with the
+	// container's environment, rather than leaving it to the container
+	ExpandCommandEnv bool
+
+	// WaitForAttachment prints the IPs of the tasks' network interfaces once
+	// they're attached, waiting up to AttachmentTimeout, which defaults to
+	// two minutes
+	WaitForAttachment bool
+	AttachmentTimeout time.Duration
+
+	// AuditSecrets prints the secrets and repository credentials the
+	// registered task definition references, and adds them to the summary
+	AuditSecrets bool
+
+	// taskDefinitionInput is the parsed task definition file, so it's only
+	// read once, and so each of several in one file can be run on its own
+	taskDefinitionInput *ecs.RegisterTaskDefinitionInput
 }
 
 // New creates a new instance of a runner
 func New() *Runner {
 	return &Runner{
-		Region: os.Getenv("AWS_REGION"),
-		Config: aws.NewConfig(),
+		Region:         os.Getenv("AWS_REGION"),
+		Config:         aws.NewConfig(),
+		CreateLogGroup: true,
+		MaxRetries:     defaultRunTaskRetries,
 	}
 }
 
+// RunResult describes how a run went, for callers that need more than
+// whether it failed
+type RunResult struct {
+	// TaskDefinition is the family:revision that was run, or the first of
+	// them if the task definition file had several
+	TaskDefinition string
+
+	// TaskDefinitions are each family:revision that was run
+	TaskDefinitions []string
+
+	// TaskArns are the tasks that were launched
+	TaskArns []string
+
+	// Tasks are how the tasks and their containers finished, which is empty
+	// if the tasks weren't waited for, such as with Detach
+	Tasks []TaskSummary
+
+	// ExitCode is chosen from the containers' exit codes with the
+	// ExitCodeStrategy
+	ExitCode int
+
+	// summary is reported once the run is done, and is nil if the tasks
+	// weren't waited for
+	summary *Summary
+}
+
 // Run runs the runner
 func (r *Runner) Run(ctx context.Context) error {
-	taskDefinitionInput, err := parser.Parse(r.TaskDefinitionFile, os.Environ())
+	_, err := r.RunWithResult(ctx)
+	return err
+}
+
+// RunWithResult runs the runner and returns what it ran and how it went. The
+// result has as much as is known even if an error is returned, such as the
+// tasks that were launched before one of them failed.
+//
+// A task definition file with several YAML documents runs each of them as
+// its own task definition at the same time, with the results combined.
+func (r *Runner) RunWithResult(ctx context.Context) (*RunResult, error) {
+	if r.TaskDefinitionFile != "" && r.AttachService == "" && r.taskDefinitionInput == nil {
+		// check the options before reading the file, as run would
+		if err := validOutput(r.Output); err != nil {
+			return &RunResult{}, err
+		}
+		if err := r.validate(); err != nil {
+			return &RunResult{}, err
+		}
+		inputs, err := r.parseTaskDefinitionFiles()
+		if err != nil {
+			return &RunResult{}, err
+		}
+		if len(inputs) > 1 {
+			return r.runEach(ctx, inputs)
+		}
+		r.taskDefinitionInput = inputs[0]
+		defer func() { r.taskDefinitionInput = nil }()
+	}
+
+	result := &RunResult{}
+	err := r.run(ctx, result)
+	return result, r.report(result.summary, err)
+}
+
+// runEach runs several task definitions from the one file concurrently, each
+// with a copy of the runner sharing a run ID, and combines how they went
+func (r *Runner) runEach(ctx context.Context, inputs []*ecs.RegisterTaskDefinitionInput) (*RunResult, error) {
+	if r.ArnFile != "" {
+		return &RunResult{}, errors.New("--arn-file can't be used with several task definitions in one file")
+	}
+	if r.RunID == "" {
+		runID, err := newRunID(os.LookupEnv)
+		if err != nil {
+			return &RunResult{}, err
+		}
+		r.RunID = runID
+	}
+
+	results := make([]*RunResult, len(inputs))
+	errs := make([]error, len(inputs))
+
+	var wg sync.WaitGroup
+	for i, input := range inputs {
+		each := *r
+		each.taskDefinitionInput = input
+		// ECS rejects a token reused for another task definition, so each
+		// document gets its own, derived so retries still share it
+		if r.ClientToken != "" {
+			each.ClientToken = clientToken(r.ClientToken, strconv.Itoa(i))
+		}
+		// the SDK sets up a custom CA bundle on the config's HTTP client, which
+		// is otherwise the shared default one
+		each.Config = r.Config.Copy()
+		if each.Config.HTTPClient == nil || each.Config.HTTPClient == http.DefaultClient {
+			each.Config.HTTPClient = &http.Client{}
+		}
+		results[i] = &RunResult{}
+
+		wg.Add(1)
+		go func(i int, each *Runner) {
+			defer wg.Done()
+			errs[i] = each.run(ctx, results[i])
+		}(i, &each)
+	}
+	wg.Wait()
+
+	combined := &RunResult{}
+	var summaries []*Summary
+	var firstErr error
+	for i, result := range results {
+		if result.summary != nil {
+			summaries = append(summaries, result.summary)
+		}
+		if result.TaskDefinition != "" {
+			combined.TaskDefinitions = append(combined.TaskDefinitions, result.TaskDefinition)
+		}
+		combined.TaskArns = append(combined.TaskArns, result.TaskArns...)
+		combined.Tasks = append(combined.Tasks, result.Tasks...)
+		if _, ok := errs[i].(*exitError); errs[i] != nil && !ok && firstErr == nil {
+			firstErr = errs[i]
+		}
+	}
+	if len(combined.TaskDefinitions) > 0 {
+		combined.TaskDefinition = combined.TaskDefinitions[0]
+	}
+
+	exitTasks, _ := ignoreContainers(combined.Tasks, r.IgnoredContainers)
+	var reason string
+	combined.ExitCode, reason = computeExitCode(exitTasks, r.ExitCodeStrategy)
+
+	if len(summaries) > 0 {
+		combined.summary = combineSummaries(summaries)
+		combined.summary.ExitCode, combined.summary.ExitReason = combined.ExitCode, reason
+	}
+
+	err := firstErr
+	if err == nil && combined.ExitCode != 0 {
+		err = &exitError{errors.New(reason), combined.ExitCode}
+	}
+	return combined, r.report(combined.summary, err)
+}
+
+// report writes the summary of a finished run, annotates the build and posts
+// it to the webhook, once for the whole run. An error doing so is returned
+// ahead of the run's exit code, but not of another error from the run.
+func (r *Runner) report(summary *Summary, runErr error) error {
+	if summary == nil {
+		return runErr
+	}
+	if _, ok := runErr.(*exitError); runErr != nil && !ok {
+		return runErr
+	}
+
+	if r.Output != "" {
+		if err := writeSummary(os.Stdout, r.Output, summary); err != nil {
+			return err
+		}
+	}
+
+	if r.Annotate {
+		if a := newAnnotation(os.LookupEnv, summary, r.IgnoredContainers); a != nil {
+			if err := a.Write(os.Stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: failed to annotate build: %v\n", err)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "WARNING: --annotate is only supported in Buildkite and GitHub Actions\n")
+		}
+	}
+
+	if r.ResultWebhook != "" {
+		if err := postSummary(r.ResultWebhook, r.ResultWebhookTimeout, summary); err != nil {
+			if r.StrictWebhook {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "WARNING: %s\n", err)
+		}
+	}
+
+	return runErr
+}
+
+func (r *Runner) run(ctx context.Context, result *RunResult) (err error) {
+	if err := validOutput(r.Output); err != nil {
+		return err
+	}
+
+	prefix, err := newLogPrefix(r.LogPrefixTemplate)
 	if err != nil {
 		return err
 	}
+	prefix.Container = r.LogPrefix
+	prefix.Timestamps = r.Timestamps
+	printer := newColorPrinter(prefix, r.NoColor)
+
+	if r.AttachService != "" {
+		return r.attach(ctx, printer)
+	}
+
+	if err := r.validate(); err != nil {
+		return err
+	}
+
+	var matcher *logMatcher
+	if r.WaitForLog != "" {
+		var err error
+		if matcher, err = newLogMatcher(r.WaitForLog); err != nil {
+			return fmt.Errorf("invalid --wait-for-log: %v", err)
+		}
+	}
+	if r.ReadyWhen != "" {
+		var err error
+		if matcher, err = newContainerLogMatcher(r.ReadyWhen); err != nil {
+			return fmt.Errorf("invalid --ready-when: %v", err)
+		}
+	}
+
+	if r.RunID == "" {
+		runID, err := newRunID(os.LookupEnv)
+		if err != nil {
+			return err
+		}
+		r.RunID = runID
+	}
+	log.Printf("Starting run %s", r.RunID)
 
 	streamPrefix := r.TaskName
 	if streamPrefix == "" {
-		streamPrefix = fmt.Sprintf("run_task_%d", time.Now().Nanosecond())
+		var err error
+		if streamPrefix, err = randomStreamPrefix(); err != nil {
+			return err
+		}
 	}
 
-	sess := session.Must(session.NewSession(r.Config.WithRegion(r.Region)))
-
-	if err := createLogGroup(sess, r.LogGroupName); err != nil {
+	sess, err := r.newSession()
+	if err != nil {
 		return err
 	}
 
-	log.Printf("Setting tasks to use log group %s", r.LogGroupName)
-	for _, def := range taskDefinitionInput.ContainerDefinitions {
-		def.LogConfiguration = &ecs.LogConfiguration{
-			LogDriver: aws.String("awslogs"),
-			Options: map[string]*string{
-				"awslogs-group":         aws.String(r.LogGroupName),
-				"awslogs-region":        aws.String(r.Region),
-				"awslogs-stream-prefix": aws.String(streamPrefix),
-			},
+	if r.ValidateNetwork {
+		if err := validateNetwork(ec2.New(sess), r.Region, r.Subnets, r.SecurityGroups); err != nil {
+			return err
 		}
 	}
 
+	reqIDs := newRequestIDs("RegisterTaskDefinition", "RunTask")
 	svc := ecs.New(sess)
+	svc.Handlers.Complete.PushBackNamed(reqIDs.Handler())
+	r.s3 = s3.New(sess)
+	r.ecrClient = func(region string) ecrInterface {
+		return ecr.New(sess, aws.NewConfig().WithRegion(region))
+	}
 
-	log.Printf("Registering a task for %s", *taskDefinitionInput.Family)
-	resp, err := svc.RegisterTaskDefinition(taskDefinitionInput)
+	if r.DryRun {
+		return r.dryRun(ctx, svc, streamPrefix)
+	}
+
+	cwl := cloudwatchlogs.New(sess)
+
+	if err := r.setupLogGroup(cwl); err != nil {
+		return err
+	}
+
+	// the log group ARN is only needed for the summary, and finding it takes
+	// an extra call that needs sts:GetCallerIdentity
+	var groupArn string
+	if r.Output != "" || r.ResultWebhook != "" {
+		groupArn, err = logGroupArn(sts.New(sess), r.Region, r.LogGroupName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: can't find the log group ARN: %v\n", err)
+		} else {
+			log.Printf("Logging to log group %s", groupArn)
+		}
+	}
+
+	reg, err := r.register(ctx, svc, streamPrefix)
 	if err != nil {
 		return err
 	}
 
-	taskDefinition := fmt.Sprintf("%s:%d",
-		*resp.TaskDefinition.Family, *resp.TaskDefinition.Revision)
+	taskDefinition := reg.TaskDefinition
+	result.TaskDefinition = taskDefinition
+	result.TaskDefinitions = []string{taskDefinition}
+
+	var secretRefs []SecretReference
+	if r.AuditSecrets {
+		secretRefs = reg.Secrets
+		writeSecretsAudit(os.Stderr, secretRefs)
+	}
 
+	// env files are only deleted once every task is known to have stopped,
+	// as running and detached tasks may still need them
+	envFilesDeleted := false
 	defer func() {
-		if !r.Deregister {
-			return
+		if !envFilesDeleted && len(reg.UploadedEnvFiles) > 0 {
+			log.Printf("Leaving %d uploaded env files in s3://%s, as the tasks may still need them",
+				len(reg.UploadedEnvFiles), r.EnvFileBucket)
 		}
+	}()
 
-		log.Printf("Deregistering task %s", taskDefinition)
-		_, err := svc.DeregisterTaskDefinition(&ecs.DeregisterTaskDefinitionInput{
-			TaskDefinition: &taskDefinition,
-		})
-		if err != nil {
-			log.Printf("Failed to deregister task %s: %s", taskDefinition, err.Error())
+	if r.ArnFile != "" {
+		if err := writeArnFile(r.ArnFile, reg); err != nil {
+			return err
+		}
+	}
+
+	// deregister on every return, surfacing the error unless there's already
+	// one from the run
+	defer func() {
+		if !r.Deregister || !reg.Registered || r.Detach {
 			return
 		}
-		log.Printf("Successfully deregistered task %s", taskDefinition)
+		if derr := deregisterTaskDefinition(svc, taskDefinition, r.deregisterTimeout()); derr != nil {
+			if err == nil {
+				err = derr
+			} else {
+				log.Printf("%v", derr)
+			}
+		}
 	}()
 
-	runTaskInput := &ecs.RunTaskInput{
-		TaskDefinition: aws.String(taskDefinition),
-		Cluster:        aws.String(r.Cluster),
-		Count:          aws.Int64(r.Count),
-		Overrides: &ecs.TaskOverride{
-			ContainerOverrides: []*ecs.ContainerOverride{},
-		},
-	}
-	if r.Fargate {
-		runTaskInput.LaunchType = aws.String("FARGATE")
-	}
-	if len(r.Subnets) > 0 || len(r.SecurityGroups) > 0 {
-		runTaskInput.NetworkConfiguration = &ecs.NetworkConfiguration{
-			AwsvpcConfiguration: &ecs.AwsVpcConfiguration{
-				Subnets:        awsStrings(r.Subnets),
-				AssignPublicIp: aws.String("ENABLED"),
-				SecurityGroups: awsStrings(r.SecurityGroups),
-			},
-		}
+	runTaskInput := r.runTaskInput(taskDefinition)
+
+	environment, err := r.environment()
+	if err != nil {
+		return err
 	}
 
-	env, err := awsKeyValuePairForEnv(os.LookupEnv, r.Environment)
+	env, err := awsKeyValuePairForEnv(os.LookupEnv, environment)
 	if err != nil {
 		return err
 	}
 
+	if r.InjectTaskMetadata {
+		env = append(env, taskMetadataEnv(r.Cluster, taskDefinition)...)
+	}
+
+	if r.PrintEnv != "" {
+		writeEnv(os.Stderr, r.PrintEnv, env)
+	}
+
 	for _, override := range r.Overrides {
 		if len(override.Command) > 0 {
 			cmds := []*string{}
 
 			if override.Service == "" {
-				if len(taskDefinitionInput.ContainerDefinitions) != 1 {
-					return fmt.Errorf("No service provided for override and can't determine default service with %d container definitions", len(taskDefinitionInput.ContainerDefinitions))
+				if len(reg.ContainerDefinitions) != 1 {
+					return fmt.Errorf("No service provided for override and can't determine default service with %d container definitions", len(reg.ContainerDefinitions))
 				}
 
-				override.Service = *taskDefinitionInput.ContainerDefinitions[0].Name
+				override.Service = *reg.ContainerDefinitions[0].Name
 				log.Printf("Assuming override applies to '%s'", override.Service)
 			}
 
-			for _, command := range override.Command {
+			args := override.Command
+			if r.ExpandCommandEnv {
+				def, _ := containerDefinition(reg.ContainerDefinitions, override.Service)
+				if args, err = expandCommand(args, def, env); err != nil {
+					return err
+				}
+			}
+
+			for _, command := range args {
 				cmds = append(cmds, aws.String(command))
 			}
 
@@ -163,36 +697,95 @@ func (r *Runner) Run(ctx context.Context) error {
 	}
 
 	// If no overrides specified, but Environment variables were - should still be overridden
-	if len(r.Overrides) == 0 {
+	if len(r.Overrides) == 0 && len(reg.ContainerDefinitions) > 0 {
 		runTaskInput.Overrides.ContainerOverrides = append(
 			runTaskInput.Overrides.ContainerOverrides,
 			&ecs.ContainerOverride{
-				Name:        taskDefinitionInput.ContainerDefinitions[0].Name,
+				Name:        reg.ContainerDefinitions[0].Name,
 				Environment: env,
 			},
 		)
 	}
 
+	for _, s := range r.ContainerCPU {
+		name, units, err := parseContainerCPU(s)
+		if err != nil {
+			return err
+		}
+		containerOverride(runTaskInput.Overrides, name).Cpu = aws.Int64(units)
+	}
+
+	// container cpu has to fit in the task's, overridden or not
+	taskCPU := reg.Cpu
+	if r.TaskCPU != "" {
+		taskCPU = r.TaskCPU
+	}
+	if err := validateContainerCPU(taskCPU, runTaskInput.Overrides.ContainerOverrides); err != nil {
+		return err
+	}
+
+	if r.ClientToken != "" {
+		runTaskInput.ClientToken = aws.String(r.ClientToken)
+	} else {
+		params, err := json.Marshal(runTaskInput)
+		if err != nil {
+			return err
+		}
+		runTaskInput.ClientToken = aws.String(clientToken(r.RunID, string(params)))
+	}
+
 	log.Printf("Running task %s", taskDefinition)
-	runResp, err := svc.RunTask(runTaskInput)
+	runResp, err := runTask(ctx, svc, runTaskInput, r.ContainerInstance, r.LaunchStagger, r.MaxRetries)
+	if runResp != nil {
+		for _, task := range runResp.Tasks {
+			result.TaskArns = append(result.TaskArns, aws.StringValue(task.TaskArn))
+		}
+	}
 	if err != nil {
+		if runResp != nil && len(runResp.Tasks) > 0 {
+			var launched []*string
+			for _, task := range runResp.Tasks {
+				launched = append(launched, task.TaskArn)
+			}
+			if stopErr := r.StopTasks(svc, launched, interruptedReason); stopErr != nil {
+				log.Printf("Failed to stop launched tasks: %v", stopErr)
+			}
+		}
 		return fmt.Errorf("Unable to run task: %s", err.Error())
 	}
 
-	cwl := cloudwatchlogs.New(sess)
-	var wg sync.WaitGroup
+	if r.Detach {
+		return printDetached(os.Stdout, runResp)
+	}
+
+	watchCtx, cancelWatchers := context.WithCancel(ctx)
+	defer cancelWatchers()
+
+	// the watchers all start straight away so none miss their container's logs
+	var watchers sync.WaitGroup
+	watchErrs := newWatchErrors()
+	pollLogs := limitLogPolling(cwl, r.MaxConcurrentWatchers)
+	logWatchers := map[string]*logWatcher{}
+
+	followedTasks := runResp.Tasks
+	if !reg.LogsFollowed {
+		fmt.Fprintf(os.Stderr, "WARNING: not following logs, as %s isn't known to log to log group %s with stream prefix %s\n",
+			reg.TaskDefinition, r.LogGroupName, streamPrefix)
+		followedTasks = nil
+	}
 
 	// spawn a log watcher for each container
-	for _, task := range runResp.Tasks {
+	for _, task := range followedTasks {
 		for _, container := range task.Containers {
 			containerID := path.Base(*container.ContainerArn)
-			watcher := &logWatcher{
-				LogGroupName:   r.LogGroupName,
-				LogStreamName:  logStreamName(streamPrefix, container, task),
-				CloudWatchLogs: cwl,
-
-				// watch for the finish message to terminate the logger
-				Printer: func(ev *cloudwatchlogs.FilteredLogEvent) bool {
+			fields := logPrefixFields{
+				Task:      path.Base(*task.TaskArn),
+				Container: *container.Name,
+				Cluster:   r.Cluster,
+			}
+			// watch for the finish message to terminate the logger
+			watcher := r.newLogWatcher(pollLogs, r.LogGroupName, logStreamName(streamPrefix, container, task),
+				func(ev *cloudwatchlogs.FilteredLogEvent) bool {
 					finishedPrefix := fmt.Sprintf(
 						"Container %s exited with",
 						containerID,
@@ -202,16 +795,21 @@ func (r *Runner) Run(ctx context.Context) error {
 							containerID, *ev.Message)
 						return false
 					}
-					fmt.Println(*ev.Message)
+					printer.Print(fields, ev)
+					if matcher != nil {
+						matcher.MatchContainer(fields.Container, *ev.Message)
+					}
 					return true
-				},
-			}
+				})
 
-			wg.Add(1)
+			taskArn, name := *task.TaskArn, *container.Name
+			logWatchers[taskArn+"/"+name] = watcher
+			watchers.Add(1)
 			go func() {
-				defer wg.Done()
-				if err := watcher.Watch(ctx); err != nil {
-					log.Printf("Log watcher returned error: %v", err)
+				defer watchers.Done()
+				if err := watcher.Watch(watchCtx); err != nil && err != context.Canceled {
+					fmt.Fprintf(os.Stderr, "WARNING: failed to stream logs of %s: %v\n", name, err)
+					watchErrs.Set(taskArn, name, err)
 				}
 			}()
 		}
@@ -223,36 +821,87 @@ func (r *Runner) Run(ctx context.Context) error {
 		taskARNs = append(taskARNs, task.TaskArn)
 	}
 
-	for {
-		werr := svc.WaitUntilTasksStopped(&ecs.DescribeTasksInput{
-			Cluster: aws.String(r.Cluster),
-			Tasks:   taskARNs,
-		})
-		if werr == nil {
-			break
+	var timeouts *taskTimeouts
+	if r.PerTaskTimeout > 0 {
+		timeouts = newTaskTimeouts(svc, r.Cluster, r.PerTaskTimeout)
+		go timeouts.Watch(watchCtx, taskARNs)
+	}
+
+	if r.WaitForAttachment {
+		ec2svc := ec2.New(sess)
+		go func() {
+			err := waitForAttachments(watchCtx, os.Stderr, svc, ec2svc, r.Cluster, taskARNs, r.attachmentTimeout(), sleepContext)
+			if err != nil && err != context.Canceled {
+				fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+			}
+		}()
+	}
+
+	wait := func(ctx context.Context) error {
+		return waitUntilTasksStopped(ctx, svc, r.Cluster, taskARNs)
+	}
+	if r.ExponentialDescribe {
+		backoff := &describeBackoff{min: minDescribeInterval, max: maxDescribeInterval}
+		wait = func(ctx context.Context) error {
+			return pollUntilStopped(ctx, svc, r.Cluster, taskARNs, backoff, sleepContext)
+		}
+	}
+
+	matched, err := waitUntilStopped(ctx, wait, matcher)
+	if err != nil {
+		if ctx.Err() != nil {
+			return r.cancelRun(ctx, svc, taskARNs)
 		}
-		if !isAwsTimeOutError(werr) {
-			return werr
+		return err
+	}
+
+	if matched {
+		if r.ReadyWhen != "" {
+			log.Printf("Container is ready, leaving tasks running")
+		} else if !r.LeaveRunning {
+			if err := stopTasks(svc, r.Cluster, taskARNs, "Matched --wait-for-log"); err != nil {
+				return err
+			}
 		}
+		cancelWatchers()
+		watchers.Wait()
+		return nil
 	}
 
 	log.Printf("All tasks have stopped")
 
-	output, err := svc.DescribeTasks(&ecs.DescribeTasksInput{
-		Cluster: aws.String(r.Cluster),
-		Tasks:   taskARNs,
-	})
+	deleteEnvFiles(r.s3, r.EnvFileBucket, reg.UploadedEnvFiles)
+	envFilesDeleted = true
+
+	output, err := describeTasks(svc, r.Cluster, taskARNs)
 	if err != nil {
 		return err
 	}
 
-	// Get the final state of each task and container and write to cloudwatch logs
-	for _, task := range output.Tasks {
+	// Get the final state of each task and container and write to cloudwatch
+	// logs, if they're followed
+	followedTasks = output.Tasks
+	if !reg.LogsFollowed {
+		followedTasks = nil
+	}
+	for _, task := range followedTasks {
 		for _, container := range task.Containers {
+			// a container that never ran has no exit code to write, so its
+			// watcher is stopped and it fails the run through the summary
+			if container.ExitCode == nil {
+				fmt.Fprintf(os.Stderr, "WARNING: container %s stopped without an exit code: %s\n",
+					aws.StringValue(container.Name), noExitCodeReason(task, container))
+				if watcher, ok := logWatchers[aws.StringValue(task.TaskArn)+"/"+aws.StringValue(container.Name)]; ok {
+					watcher.Stop()
+				}
+				continue
+			}
 			lw := &logWriter{
 				LogGroupName:   r.LogGroupName,
 				LogStreamName:  logStreamName(streamPrefix, container, task),
 				CloudWatchLogs: cwl,
+				Interval:       r.LogPollInterval,
+				Timeout:        r.LogWaitTimeout,
 			}
 			if err := writeContainerFinishedMessage(ctx, lw, task, container); err != nil {
 				return err
@@ -261,27 +910,829 @@ func (r *Runner) Run(ctx context.Context) error {
 	}
 
 	log.Printf("Waiting for logs to finish")
-	wg.Wait()
+	watchers.Wait()
 
-	// Determine exit code based on the first non-zero exit code
-	for _, task := range output.Tasks {
-		for _, container := range task.Containers {
-			if *container.ExitCode != 0 {
-				return &exitError{
-					fmt.Errorf(
-						"container %s exited with %d",
-						*container.Name,
-						*container.ExitCode,
-					),
-					int(*container.ExitCode),
-				}
-			}
+	summary := newSummary(output.Tasks)
+	summary.RunID = r.RunID
+	exitTasks, unknown := ignoreContainers(summary.Tasks, r.IgnoredContainers)
+	for _, name := range unknown {
+		fmt.Fprintf(os.Stderr, "WARNING: ignored container %s isn't in the tasks\n", name)
+	}
+	summary.ExitCode, summary.ExitReason = computeExitCode(exitTasks, r.ExitCodeStrategy)
+	summary.LogGroupArn = groupArn
+	summary.RequestIDs = reqIDs.Map()
+	summary.Secrets = secretRefs
+	summary.setLogErrors(watchErrs)
+	result.Tasks = summary.Tasks
+	result.ExitCode = summary.ExitCode
+	result.summary = summary
+	if timeouts != nil {
+		for i, task := range summary.Tasks {
+			summary.Tasks[i].TimedOut = timeouts.TimedOut(task.TaskArn)
 		}
 	}
 
-	return err
-}
-
+	if r.DescribeAfter {
+		if err := describeStoppedTasks(os.Stderr, svc, r.Cluster, taskARNs); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %v\n", err)
+		}
+	}
+
+	if r.PrintInsightsQuery {
+		fmt.Fprintf(os.Stderr, "\nCloudWatch Logs Insights query for log group %s:\n\n%s\n\n%s\n",
+			r.LogGroupName, insightsQuery(streamPrefix), insightsConsoleURL(r.Region))
+	}
+
+	if summary.ExitCode != 0 {
+		return &exitError{errors.New(summary.ExitReason), summary.ExitCode}
+	}
+
+	return err
+}
+
+// validate checks the runner's options are consistent before anything is run
+func (r *Runner) validate() error {
+	switch r.AssignPublicIp {
+	case "", ecs.AssignPublicIpEnabled, ecs.AssignPublicIpDisabled:
+	default:
+		return fmt.Errorf("unknown assign public ip %q, expected %q or %q",
+			r.AssignPublicIp, ecs.AssignPublicIpEnabled, ecs.AssignPublicIpDisabled)
+	}
+
+	switch r.PropagateTags {
+	case "", ecs.PropagateTagsTaskDefinition, ecs.PropagateTagsService:
+	default:
+		return fmt.Errorf("unknown propagate tags %q, expected %q or %q",
+			r.PropagateTags, ecs.PropagateTagsTaskDefinition, ecs.PropagateTagsService)
+	}
+
+	switch r.VarsPrecedence {
+	case "", parser.VarsPrecedenceEnv, parser.VarsPrecedenceFile:
+	default:
+		return fmt.Errorf("unknown vars precedence %q, expected %q or %q",
+			r.VarsPrecedence, parser.VarsPrecedenceFile, parser.VarsPrecedenceEnv)
+	}
+
+	if r.DeregisterPrevious && r.TaskDefinitionFile == "" && r.ExistingTaskDefinition != "" {
+		return errors.New("--deregister-previous can't be used with --task, as the previous revision is the one being run")
+	}
+
+	// workflow commands would be mixed in with the summary on stdout
+	if r.Annotate && r.Output != "" && isGitHubActions(os.LookupEnv) {
+		return errors.New("--annotate can't be used with --output in GitHub Actions, as both are printed to stdout")
+	}
+
+	if len(r.ImageOverrides) > 0 && r.TaskDefinitionFile == "" && r.NoDescribeOnExisting {
+		return errors.New("--image can't be used with --no-describe-on-existing, as the task definition isn't registered")
+	}
+
+	if len(r.Essential) > 0 && r.TaskDefinitionFile == "" && r.NoDescribeOnExisting {
+		return errors.New("--essential can't be used with --no-describe-on-existing, as the task definition isn't registered")
+	}
+
+	if r.TaskCPU != "" {
+		if _, err := parseTaskCPU(r.TaskCPU); err != nil {
+			return fmt.Errorf("invalid --task-cpu: %v", err)
+		}
+	}
+	if r.TaskMemory != "" {
+		if _, err := parseTaskMemory(r.TaskMemory); err != nil {
+			return fmt.Errorf("invalid --task-memory: %v", err)
+		}
+	}
+
+	for _, role := range []struct {
+		flag, arn string
+	}{
+		{"--task-role-arn", r.TaskRoleArn},
+		{"--execution-role-arn", r.ExecutionRoleArn},
+	} {
+		if role.arn == "" {
+			continue
+		}
+		if a, err := arn.Parse(role.arn); err != nil || a.Service != "iam" || !strings.HasPrefix(a.Resource, "role/") {
+			return fmt.Errorf("invalid %s %q, expected an IAM role ARN", role.flag, role.arn)
+		}
+		if r.TaskDefinitionFile == "" && r.NoDescribeOnExisting {
+			return fmt.Errorf("%s can't be used with --no-describe-on-existing, as the task definition isn't registered", role.flag)
+		}
+	}
+
+	if r.RuntimePlatform != nil {
+		if err := validRuntimePlatform(r.RuntimePlatform); err != nil {
+			return err
+		}
+		if r.TaskDefinitionFile == "" && r.NoDescribeOnExisting {
+			return errors.New("--cpu-architecture and --os-family can't be used with --no-describe-on-existing, as the task definition isn't registered")
+		}
+	}
+
+	if len(r.Secrets) > 0 && r.TaskDefinitionFile == "" && r.NoDescribeOnExisting {
+		return errors.New("--secret can't be used with --no-describe-on-existing, as the task definition isn't registered")
+	}
+
+	if r.EphemeralStorageGiB != 0 {
+		if r.EphemeralStorageGiB < minEphemeralStorageGiB || r.EphemeralStorageGiB > maxEphemeralStorageGiB {
+			return fmt.Errorf("invalid --ephemeral-storage %d, expected %d to %d GiB",
+				r.EphemeralStorageGiB, minEphemeralStorageGiB, maxEphemeralStorageGiB)
+		}
+		if r.TaskDefinitionFile == "" && r.NoDescribeOnExisting {
+			return errors.New("--ephemeral-storage can't be used with --no-describe-on-existing, as the task definition isn't registered")
+		}
+	}
+
+	if r.AuditSecrets && r.TaskDefinitionFile == "" && r.NoDescribeOnExisting {
+		return errors.New("--audit-secrets can't be used with --no-describe-on-existing, as the task definition isn't described")
+	}
+
+	if r.ValidateImages && r.TaskDefinitionFile == "" && r.NoDescribeOnExisting {
+		return errors.New("--validate-images can't be used with --no-describe-on-existing")
+	}
+
+	if len(r.UploadEnvFiles) > 0 {
+		if r.EnvFileBucket == "" {
+			return errors.New("--upload-env-file needs --env-file-bucket")
+		}
+		if r.TaskDefinitionFile == "" && r.NoDescribeOnExisting {
+			return errors.New("--upload-env-file can't be used with --no-describe-on-existing, as the task definition isn't registered")
+		}
+	}
+
+	if r.AssumeRoleARN != "" && !arn.IsARN(r.AssumeRoleARN) {
+		return fmt.Errorf("invalid --assume-role-arn %q", r.AssumeRoleARN)
+	}
+	if r.EndpointURL != "" {
+		if u, err := url.Parse(r.EndpointURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid --endpoint-url %q, expected a URL like http://localhost:4566", r.EndpointURL)
+		}
+	}
+	if r.LogPollInterval < 0 || r.LogWaitTimeout < 0 {
+		return errors.New("--log-poll-interval and --log-wait-timeout can't be negative")
+	}
+
+	if err := validExitCodeStrategy(r.ExitCodeStrategy); err != nil {
+		return err
+	}
+
+	if r.MaxRetries < 0 {
+		return fmt.Errorf("invalid --max-retries %d, expected zero or more", r.MaxRetries)
+	}
+
+	if r.EndpointSkipTLSVerify && r.EndpointURL == "" {
+		return errors.New("--endpoint-skip-tls-verify needs --endpoint-url")
+	}
+
+	if r.AssumeRoleSessionName != "" && r.AssumeRoleARN == "" {
+		return errors.New("--assume-role-session-name needs --assume-role-arn")
+	}
+
+	if r.Detach {
+		for _, f := range []struct {
+			flag string
+			set  bool
+		}{
+			{"--wait-for-log", r.WaitForLog != ""},
+			{"--ready-when", r.ReadyWhen != ""},
+			{"--per-task-timeout", r.PerTaskTimeout > 0},
+			{"--output", r.Output != ""},
+			{"--result-webhook", r.ResultWebhook != ""},
+			{"--wait-for-attachment", r.WaitForAttachment},
+		} {
+			if f.set {
+				return fmt.Errorf("%s can't be used with --detach, as the tasks aren't waited for", f.flag)
+			}
+		}
+	}
+
+	if r.WaitForLog != "" && r.ReadyWhen != "" {
+		return errors.New("--wait-for-log and --ready-when can't be used together")
+	}
+
+	switch r.PrintEnv {
+	case "", PrintEnvKeys, PrintEnvFull:
+	default:
+		return fmt.Errorf("unknown print env %q, expected %q or %q", r.PrintEnv, PrintEnvKeys, PrintEnvFull)
+	}
+
+	if r.RetentionDays != 0 {
+		if err := validLogRetentionDays(r.RetentionDays); err != nil {
+			return err
+		}
+	}
+
+	if r.LogKmsKeyID != "" {
+		if err := validLogKmsKeyID(r.LogKmsKeyID); err != nil {
+			return err
+		}
+	}
+
+	if len(r.StartedBy) > maxStartedByLength {
+		return fmt.Errorf("--started-by can be at most %d characters, got %d", maxStartedByLength, len(r.StartedBy))
+	}
+
+	if (r.TaskDefinitionFile == "") == (r.ExistingTaskDefinition == "") {
+		return errors.New("exactly one of a task definition file or an existing task definition is required")
+	}
+
+	if r.Patch != "" {
+		if r.TaskDefinitionFile == "" {
+			return errors.New("--patch can only be used with a task definition file")
+		}
+		if err := parser.ValidatePatch(r.Patch); err != nil {
+			return err
+		}
+	}
+
+	if len(r.CapacityProviderStrategy) > 0 && r.Fargate {
+		return errors.New("--capacity-provider can't be used with --fargate, use the FARGATE capacity provider instead")
+	}
+
+	if r.ContainerInstance != "" {
+		if r.Fargate {
+			return errors.New("--container-instance can't be used with FARGATE")
+		}
+		if len(r.CapacityProviderStrategy) > 0 {
+			return errors.New("--container-instance can't be used with --capacity-provider")
+		}
+		if r.Count > 1 {
+			return errors.New("--container-instance can only start a single task")
+		}
+	}
+
+	return nil
+}
+
+// runTaskInput returns the input for running the task definition, without
+// any container overrides
+func (r *Runner) runTaskInput(taskDefinition string) *ecs.RunTaskInput {
+	runTaskInput := &ecs.RunTaskInput{
+		TaskDefinition: aws.String(taskDefinition),
+		Cluster:        aws.String(r.Cluster),
+		Count:          aws.Int64(r.Count),
+		StartedBy:      aws.String(defaultStartedBy),
+		Overrides: &ecs.TaskOverride{
+			ContainerOverrides: []*ecs.ContainerOverride{},
+		},
+		Tags: append([]*ecs.Tag{
+			{Key: aws.String(managedByTag), Value: aws.String(managedByValue)},
+			{Key: aws.String(runIDTag), Value: aws.String(r.RunID)},
+		}, r.Tags...),
+	}
+	if r.Fargate {
+		runTaskInput.LaunchType = aws.String("FARGATE")
+	}
+	// task level sizing doesn't depend on there being container overrides
+	if r.TaskCPU != "" {
+		runTaskInput.Overrides.Cpu = aws.String(r.TaskCPU)
+	}
+	if r.TaskMemory != "" {
+		runTaskInput.Overrides.Memory = aws.String(r.TaskMemory)
+	}
+	for i := range r.CapacityProviderStrategy {
+		// ECS rejects a launch type with a capacity provider strategy, so
+		// LaunchType is left unset
+		runTaskInput.CapacityProviderStrategy = append(
+			runTaskInput.CapacityProviderStrategy, &r.CapacityProviderStrategy[i])
+	}
+	if r.PlatformVersion != "" {
+		runTaskInput.PlatformVersion = aws.String(r.PlatformVersion)
+	}
+	if r.EnableExecuteCommand {
+		runTaskInput.EnableExecuteCommand = aws.Bool(true)
+	}
+	if r.StartedBy != "" {
+		runTaskInput.StartedBy = aws.String(r.StartedBy)
+	}
+	if r.PropagateTags != "" {
+		runTaskInput.PropagateTags = aws.String(r.PropagateTags)
+	}
+	if len(r.PlacementConstraints) > 0 {
+		if r.Fargate {
+			// FARGATE rejects placement constraints
+			log.Printf("Ignoring placement constraints for FARGATE")
+		} else {
+			runTaskInput.PlacementConstraints = r.PlacementConstraints
+		}
+	}
+	if len(r.PlacementStrategy) > 0 {
+		if r.Fargate {
+			// FARGATE rejects placement strategies
+			log.Printf("Ignoring placement strategy for FARGATE")
+		} else {
+			runTaskInput.PlacementStrategy = r.PlacementStrategy
+		}
+	}
+	runTaskInput.NetworkConfiguration = networkConfiguration(r.Subnets, r.SecurityGroups, r.AssignPublicIp)
+
+	return runTaskInput
+}
+
+// registration is a task definition that is ready to run
+type registration struct {
+	// TaskDefinition is the family:revision to run
+	TaskDefinition string
+
+	// TaskDefinitionArn is the ARN of the task definition, if it's known
+	TaskDefinitionArn string
+
+	// ContainerDefinitions are empty if an existing task definition is run
+	// without describing it
+	ContainerDefinitions []*ecs.ContainerDefinition
+
+	// Registered is whether a new revision was registered for this run
+	Registered bool
+
+	// Cpu is the task level cpu, if it's known
+	Cpu string
+
+	// LogsFollowed is whether the containers are known to log to the log
+	// group and stream prefix that are watched, which isn't the case for an
+	// existing task definition that's run as is unless it's been described
+	LogsFollowed bool
+
+	// UploadedEnvFiles are env files uploaded to S3 for this run, which are
+	// deleted once it's done
+	UploadedEnvFiles []uploadedEnvFile
+
+	// Secrets are referenced by the container definitions as registered,
+	// including the container that writes secret files
+	Secrets []SecretReference
+}
+
+// register loads the task definition from a file or an existing task
+// definition and registers it with the runner's log configuration. With
+// NoDescribeOnExisting an existing task definition is run as is.
+func (r *Runner) register(ctx context.Context, svc ecsInterface, streamPrefix string) (*registration, error) {
+	if r.TaskDefinitionFile == "" && r.NoDescribeOnExisting {
+		reg := &registration{TaskDefinition: r.ExistingTaskDefinition}
+
+		// overrides without a service name default to the only container,
+		// a bare family is resolved so the run uses a known revision, and
+		// with a --name the logs are only followed if it's where they go
+		if r.needsContainerNames() || isBareFamily(r.ExistingTaskDefinition) || r.TaskName != "" {
+			def, err := fetchTaskDefinition(ctx, svc, r.ExistingTaskDefinition)
+			if err != nil {
+				return nil, err
+			}
+			if isBareFamily(r.ExistingTaskDefinition) {
+				reg.TaskDefinition = fmt.Sprintf("%s:%d", *def.Family, *def.Revision)
+			}
+			reg.ContainerDefinitions = def.ContainerDefinitions
+			reg.TaskDefinitionArn = aws.StringValue(def.TaskDefinitionArn)
+			reg.Cpu = aws.StringValue(def.Cpu)
+			reg.LogsFollowed = logsTo(def.ContainerDefinitions, r.LogGroupName, streamPrefix)
+			reg.Secrets = auditSecrets(def.ContainerDefinitions)
+		}
+
+		log.Printf("Running existing task %s without registering", reg.TaskDefinition)
+		return reg, nil
+	}
+
+	taskDefinitionInput, err := r.loadTaskDefinition(ctx, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.TaskRoleArn != "" {
+		log.Printf("Setting task role to %s", r.TaskRoleArn)
+		taskDefinitionInput.TaskRoleArn = aws.String(r.TaskRoleArn)
+	}
+	if r.ExecutionRoleArn != "" {
+		log.Printf("Setting execution role to %s", r.ExecutionRoleArn)
+		taskDefinitionInput.ExecutionRoleArn = aws.String(r.ExecutionRoleArn)
+	}
+
+	// FARGATE checks the task size is a supported combination when it's
+	// registered, so it's set on the definition as well as the overrides
+	if r.TaskCPU != "" {
+		taskDefinitionInput.Cpu = aws.String(r.TaskCPU)
+	}
+	if r.TaskMemory != "" {
+		taskDefinitionInput.Memory = aws.String(r.TaskMemory)
+	}
+
+	// the containers before any are added for secret files, which overrides
+	// and defaults apply to
+	containerDefinitions := taskDefinitionInput.ContainerDefinitions
+
+	if len(r.Secrets) > 0 {
+		if taskDefinitionInput.ExecutionRoleArn == nil {
+			fmt.Fprintf(os.Stderr, "WARNING: --secret needs a task execution role that can read the secrets\n")
+		}
+		if err := addSecrets(containerDefinitions, r.Secrets); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(r.SecretFiles) > 0 {
+		var files []secretFile
+		for _, s := range r.SecretFiles {
+			file, err := parseSecretFile(s)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+		}
+		if taskDefinitionInput.ExecutionRoleArn == nil {
+			fmt.Fprintf(os.Stderr, "WARNING: --secret-file needs a task execution role that can read the secrets\n")
+		}
+		if err := addSecretFiles(taskDefinitionInput, files); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Setting tasks to use log group %s", r.LogGroupName)
+	for _, def := range taskDefinitionInput.ContainerDefinitions {
+		def.LogConfiguration = &ecs.LogConfiguration{
+			LogDriver: aws.String("awslogs"),
+			Options: map[string]*string{
+				"awslogs-group":         aws.String(r.LogGroupName),
+				"awslogs-region":        aws.String(r.Region),
+				"awslogs-stream-prefix": aws.String(streamPrefix),
+			},
+		}
+	}
+
+	if err := setPseudoTerminal(taskDefinitionInput.ContainerDefinitions, r.TTY); err != nil {
+		return nil, err
+	}
+
+	if r.StopTimeout > 0 {
+		setStopTimeout(taskDefinitionInput.ContainerDefinitions, r.StopTimeout)
+	}
+
+	networkMode := aws.StringValue(taskDefinitionInput.NetworkMode)
+	if r.Fargate {
+		// FARGATE only supports awsvpc
+		networkMode = ecs.NetworkModeAwsvpc
+	}
+
+	if r.RuntimePlatform != nil {
+		setRuntimePlatform(taskDefinitionInput, r.RuntimePlatform)
+	}
+
+	if r.EphemeralStorageGiB > 0 {
+		if r.Fargate {
+			taskDefinitionInput.EphemeralStorage = &ecs.EphemeralStorage{SizeInGiB: aws.Int64(r.EphemeralStorageGiB)}
+		} else {
+			fmt.Fprintf(os.Stderr, "WARNING: --ephemeral-storage only applies to FARGATE\n")
+		}
+	}
+
+	if len(r.AddHosts) > 0 {
+		if networkMode == ecs.NetworkModeAwsvpc {
+			fmt.Fprintf(os.Stderr, "WARNING: --add-host isn't supported by ECS with the awsvpc network mode\n")
+		}
+		if err := addHosts(taskDefinitionInput.ContainerDefinitions, r.AddHosts); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := setHostnames(taskDefinitionInput.ContainerDefinitions, networkMode, r.Hostnames); err != nil {
+		return nil, err
+	}
+
+	if err := setWorkingDirectories(taskDefinitionInput.ContainerDefinitions, r.WorkingDirectories); err != nil {
+		return nil, err
+	}
+
+	if err := setImages(taskDefinitionInput.ContainerDefinitions, r.ImageOverrides); err != nil {
+		return nil, err
+	}
+
+	if err := setEssential(taskDefinitionInput.ContainerDefinitions, r.Essential); err != nil {
+		return nil, err
+	}
+
+	if r.ValidateImages {
+		if err := validateImages(r.ecrClient, taskDefinitionInput.ContainerDefinitions); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateSystemControls(taskDefinitionInput.ContainerDefinitions, r.Fargate); err != nil {
+		return nil, err
+	}
+
+	if problems := compatibilityProblems(taskDefinitionInput, networkMode, r.Fargate); len(problems) > 0 {
+		return nil, fmt.Errorf("task definition isn't compatible with ECS:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	if err := addCredentialSpecs(taskDefinitionInput.ContainerDefinitions, r.CredentialSpecs); err != nil {
+		return nil, err
+	}
+
+	if len(r.DNSServers) > 0 || len(r.DNSSearchDomains) > 0 {
+		if r.Fargate {
+			fmt.Fprintf(os.Stderr, "WARNING: --dns-server and --dns-search are ignored by FARGATE\n")
+		}
+		if err := addDNSServers(taskDefinitionInput.ContainerDefinitions, r.DNSServers); err != nil {
+			return nil, err
+		}
+		if err := addDNSSearchDomains(taskDefinitionInput.ContainerDefinitions, r.DNSSearchDomains); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.EnableExecuteCommand {
+		for _, warning := range executeCommandWarnings(taskDefinitionInput, r.Fargate, r.PlatformVersion) {
+			fmt.Fprintf(os.Stderr, "WARNING: %s\n", warning)
+		}
+	}
+
+	taskDefinitionInput.Tags = append(taskDefinitionInput.Tags, r.Tags...)
+	if _, ok := tagValue(taskDefinitionInput.Tags, managedByTag); !ok {
+		taskDefinitionInput.Tags = append(taskDefinitionInput.Tags,
+			&ecs.Tag{Key: aws.String(managedByTag), Value: aws.String(managedByValue)})
+	}
+
+	sortContainerDefinitions(taskDefinitionInput.ContainerDefinitions)
+
+	if r.DeregisterPrevious {
+		if err := deregisterPreviousTaskDefinition(svc, *taskDefinitionInput.Family); err != nil {
+			return nil, err
+		}
+	}
+
+	// upload env files last, so there's less to clean up if anything fails
+	var uploaded []uploadedEnvFile
+	if len(r.UploadEnvFiles) > 0 {
+		files, err := parseUploadEnvFiles(r.UploadEnvFiles, r.RunID)
+		if err != nil {
+			return nil, err
+		}
+		if taskDefinitionInput.ExecutionRoleArn == nil {
+			fmt.Fprintf(os.Stderr, "WARNING: --upload-env-file needs a task execution role that can read the files from s3://%s\n", r.EnvFileBucket)
+		}
+		uploaded, err = uploadEnvFiles(r.s3, r.EnvFileBucket, r.Region, taskDefinitionInput.ContainerDefinitions, files)
+		if err != nil {
+			deleteEnvFiles(r.s3, r.EnvFileBucket, uploaded)
+			return nil, err
+		}
+	}
+
+	log.Printf("Registering a task for %s", *taskDefinitionInput.Family)
+	resp, err := svc.RegisterTaskDefinition(taskDefinitionInput)
+	if err != nil {
+		deleteEnvFiles(r.s3, r.EnvFileBucket, uploaded)
+		return nil, err
+	}
+
+	return &registration{
+		TaskDefinition: fmt.Sprintf("%s:%d",
+			*resp.TaskDefinition.Family, *resp.TaskDefinition.Revision),
+		TaskDefinitionArn:    aws.StringValue(resp.TaskDefinition.TaskDefinitionArn),
+		ContainerDefinitions: containerDefinitions,
+		Registered:           true,
+		Cpu:                  aws.StringValue(taskDefinitionInput.Cpu),
+		UploadedEnvFiles:     uploaded,
+		LogsFollowed:         true,
+		Secrets:              auditSecrets(taskDefinitionInput.ContainerDefinitions),
+	}, nil
+}
+
+// logsTo returns whether every container logs to the log group with the
+// stream prefix, so their streams can be found
+func logsTo(defs []*ecs.ContainerDefinition, group, streamPrefix string) bool {
+	if len(defs) == 0 {
+		return false
+	}
+	for _, def := range defs {
+		g, prefix, ok := awslogsConfiguration(def)
+		if !ok || g != group || prefix != streamPrefix {
+			return false
+		}
+	}
+	return true
+}
+
+// setupLogGroup creates the log group if it doesn't exist, or if creating it
+// is disabled checks that it exists
+func (r *Runner) setupLogGroup(cwl cloudwatchLogsInterface) error {
+	if r.CreateLogGroup {
+		return createLogGroup(cwl, r.LogGroupName, r.LogGroupClass, r.LogKmsKeyID, r.RetentionDays)
+	}
+
+	group, err := describeLogGroup(cwl, r.LogGroupName)
+	if err != nil {
+		return err
+	}
+	if group == nil {
+		return fmt.Errorf("log group %s doesn't exist, create it or remove --no-create-log-group", r.LogGroupName)
+	}
+	return setLogRetention(cwl, group, r.RetentionDays)
+}
+
+// sessionOptions returns the options for the AWS session, loading the named
+// profile from the shared config if one is given. An explicit region wins
+// over the profile's. An endpoint URL is used for every AWS service, such as
+// for testing against LocalStack.
+func (r *Runner) sessionOptions() session.Options {
+	opts := session.Options{
+		Config:  *r.Config.Copy().WithRegion(r.Region),
+		Profile: r.Profile,
+	}
+	if r.Profile != "" {
+		opts.SharedConfigState = session.SharedConfigEnable
+	}
+	if r.EndpointURL != "" {
+		opts.Config.Endpoint = aws.String(r.EndpointURL)
+	}
+	if r.EndpointSkipTLSVerify {
+		opts.Config.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+	}
+	return opts
+}
+
+// newSession creates the AWS session, filling in the region from the profile
+// if none was given, and assuming the role if there is one
+func (r *Runner) newSession() (*session.Session, error) {
+	sess, err := session.NewSessionWithOptions(r.sessionOptions())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create AWS session: %v", err)
+	}
+	if r.Region == "" {
+		r.Region = aws.StringValue(sess.Config.Region)
+	}
+	if r.AssumeRoleARN != "" {
+		log.Printf("Assuming role %s", r.AssumeRoleARN)
+		sess = sess.Copy(&aws.Config{
+			Credentials: stscreds.NewCredentials(sess, r.AssumeRoleARN, r.configureAssumeRole),
+		})
+	}
+	return sess, nil
+}
+
+// configureAssumeRole sets the session name of the assumed role, which
+// otherwise defaults to a generated one
+func (r *Runner) configureAssumeRole(p *stscreds.AssumeRoleProvider) {
+	if r.AssumeRoleSessionName != "" {
+		p.RoleSessionName = r.AssumeRoleSessionName
+	}
+}
+
+// printDetached prints the ARNs of the launched tasks, one per line, rather
+// than waiting for them. Failures to launch some of the tasks are an error.
+func printDetached(w io.Writer, resp *ecs.RunTaskOutput) error {
+	for _, task := range resp.Tasks {
+		fmt.Fprintln(w, aws.StringValue(task.TaskArn))
+	}
+	if len(resp.Failures) > 0 {
+		var reasons []string
+		for _, f := range resp.Failures {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", aws.StringValue(f.Arn), aws.StringValue(f.Reason)))
+		}
+		return fmt.Errorf("failed to launch %d tasks: %s", len(resp.Failures), strings.Join(reasons, ", "))
+	}
+	return nil
+}
+
+// newLogWatcher returns a watcher for a log stream that polls and waits for
+// the stream to exist as configured, or with the defaults if not
+func (r *Runner) newLogWatcher(cwl cloudwatchLogsInterface, group, stream string, printer func(*cloudwatchlogs.FilteredLogEvent) bool) *logWatcher {
+	return &logWatcher{
+		LogGroupName:   group,
+		LogStreamName:  stream,
+		CloudWatchLogs: cwl,
+		Printer:        printer,
+		Interval:       r.LogPollInterval,
+		Timeout:        r.LogWaitTimeout,
+	}
+}
+
+// writeArnFile writes the task definition ARN to a file for later steps,
+// creating its directory if needed. If the ARN isn't known, because an
+// existing task definition is run without describing it, the family:revision
+// is written instead.
+func writeArnFile(file string, reg *registration) error {
+	taskDefinition := reg.TaskDefinitionArn
+	if taskDefinition == "" {
+		taskDefinition = reg.TaskDefinition
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, []byte(taskDefinition+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write task definition ARN file: %v", err)
+	}
+	log.Printf("Wrote task definition %s to %s", taskDefinition, file)
+	return nil
+}
+
+// attachmentTimeout is how long to wait for the tasks' network interfaces
+func (r *Runner) attachmentTimeout() time.Duration {
+	if r.AttachmentTimeout > 0 {
+		return r.AttachmentTimeout
+	}
+	return defaultAttachmentTimeout
+}
+
+// deregisterTimeout is how long to wait for deregistering the task definition
+func (r *Runner) deregisterTimeout() time.Duration {
+	if r.DeregisterTimeout > 0 {
+		return r.DeregisterTimeout
+	}
+	return defaultDeregisterTimeout
+}
+
+// dryRun registers the task definition and reports it without running any
+// tasks, deregistering it again if asked to
+func (r *Runner) dryRun(ctx context.Context, svc ecsInterface, streamPrefix string) error {
+	reg, err := r.register(ctx, svc, streamPrefix)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Dry run: registered %s, not running it\n", reg.TaskDefinition)
+
+	if r.ArnFile != "" {
+		if err := writeArnFile(r.ArnFile, reg); err != nil {
+			return err
+		}
+	}
+
+	deleteEnvFiles(r.s3, r.EnvFileBucket, reg.UploadedEnvFiles)
+
+	if r.Deregister && reg.Registered {
+		return deregisterTaskDefinition(svc, reg.TaskDefinition, r.deregisterTimeout())
+	}
+	return nil
+}
+
+// loadTaskDefinition reads the task definition file, or describes the
+// existing task definition if there's no file
+func (r *Runner) loadTaskDefinition(ctx context.Context, svc ecsInterface) (*ecs.RegisterTaskDefinitionInput, error) {
+	if r.TaskDefinitionFile == "" {
+		return describeTaskDefinition(ctx, svc, r.ExistingTaskDefinition)
+	}
+	if r.taskDefinitionInput != nil {
+		return r.taskDefinitionInput, nil
+	}
+
+	inputs, err := r.parseTaskDefinitionFiles()
+	if err != nil {
+		return nil, err
+	}
+	if len(inputs) > 1 {
+		return nil, fmt.Errorf("%s has %d task definitions, expected one", r.TaskDefinitionFile, len(inputs))
+	}
+	return inputs[0], nil
+}
+
+// parseTaskDefinitionFiles parses each of the task definitions in the task
+// definition file, with the overlays and patch applied
+func (r *Runner) parseTaskDefinitionFiles() ([]*ecs.RegisterTaskDefinitionInput, error) {
+	interpolationEnv := os.Environ()
+	if r.VarsFile != "" {
+		vars, err := parser.ReadVarsFile(r.VarsFile)
+		if err != nil {
+			return nil, err
+		}
+		interpolationEnv, err = parser.MergeVars(interpolationEnv, vars, r.VarsPrecedence)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	files := append([]string{r.TaskDefinitionFile}, r.OverlayFiles...)
+
+	// the files are read before the run's clients are created, so any
+	// s3:// files need a client of their own
+	var s3Client parser.ObjectGetter
+	for _, file := range files {
+		if parser.IsS3URL(file) {
+			sess, err := r.newSession()
+			if err != nil {
+				return nil, err
+			}
+			s3Client = s3.New(sess)
+			break
+		}
+	}
+
+	return parser.ParseAll(files, interpolationEnv, r.Patch, s3Client)
+}
+
+// needsContainerNames returns whether the container overrides need to know
+// the container names from the task definition, or their environment to
+// expand commands with
+func (r *Runner) needsContainerNames() bool {
+	if r.ExpandCommandEnv && len(r.Overrides) > 0 {
+		return true
+	}
+	for _, override := range r.Overrides {
+		if len(override.Command) > 0 && override.Service == "" {
+			return true
+		}
+	}
+	return len(r.Overrides) == 0 && (len(r.Environment) > 0 || len(r.EnvFiles) > 0 || r.InjectTaskMetadata)
+}
+
 func isAwsTimeOutError(err error) bool {
 	if aerr, ok := err.(awserr.Error); ok {
 		if aerr.Code() == "ResourceNotReady" {
@@ -291,6 +1742,54 @@ func isAwsTimeOutError(err error) bool {
 	return false
 }
 
+// randomStreamPrefix returns a log stream prefix that won't be shared with
+// other runs started at the same time, so they don't tail each other's logs
+func randomStreamPrefix() (string, error) {
+	suffix, err := randomHex(8)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("run_task_%d_%s", time.Now().Unix(), suffix), nil
+}
+
+// clientToken returns a RunTask client token for a run with the given
+// parameters. ECS rejects a token reused with different parameters, so it's
+// only shared by retries of the same run making the same call.
+func clientToken(runID, params string) string {
+	h := sha256.Sum256([]byte(runID + "\n" + params))
+
+	// ECS accepts client tokens of up to 64 characters
+	return hex.EncodeToString(h[:])
+}
+
+// newRunID returns the ID for a run that isn't given one. In CI it's derived
+// from the job, so a retry of the job gets the same ID, and with it the same
+// client token. Otherwise it's random.
+func newRunID(lookupEnv func(string) (string, bool)) (string, error) {
+	var job []string
+	if id, ok := lookupEnv("BUILDKITE_JOB_ID"); ok && id != "" {
+		job = []string{"buildkite", id}
+	} else if id, ok := lookupEnv("GITHUB_RUN_ID"); ok && id != "" {
+		name, _ := lookupEnv("GITHUB_JOB")
+		attempt, _ := lookupEnv("GITHUB_RUN_ATTEMPT")
+		job = []string{"github", id, name, attempt}
+	}
+	if len(job) == 0 {
+		return randomHex(8)
+	}
+	h := sha256.Sum256([]byte(strings.Join(job, "\n")))
+	return hex.EncodeToString(h[:8]), nil
+}
+
+// randomHex returns n random bytes encoded as hex
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 func logStreamName(logStreamPrefix string, container *ecs.Container, task *ecs.Task) string {
 	return fmt.Sprintf(
 		"%s/%s/%s",
@@ -301,19 +1800,26 @@ func logStreamName(logStreamPrefix string, container *ecs.Container, task *ecs.T
 }
 
 func writeContainerFinishedMessage(ctx context.Context, w *logWriter, task *ecs.Task, container *ecs.Container) error {
-	if *container.LastStatus != `STOPPED` {
-		return fmt.Errorf("expected container to be STOPPED, got %s", *container.LastStatus)
+	if status := aws.StringValue(container.LastStatus); status != ecs.DesiredStatusStopped {
+		return fmt.Errorf("expected container to be STOPPED, got %s", status)
 	}
 	if container.ExitCode == nil {
-		return errors.New(*container.Reason)
+		return fmt.Errorf("container %s stopped without an exit code: %s",
+			aws.StringValue(container.Name), noExitCodeReason(task, container))
 	}
 	return w.WriteString(ctx, fmt.Sprintf(
 		"Container %s exited with %d",
-		path.Base(*container.ContainerArn),
+		path.Base(aws.StringValue(container.ContainerArn)),
 		*container.ExitCode,
 	))
 }
 
+// noExitCodeReason is why a container that never ran has no exit code, from
+// why it or its task stopped
+func noExitCodeReason(task *ecs.Task, container *ecs.Container) string {
+	return firstNonEmpty(aws.StringValue(container.Reason), aws.StringValue(task.StoppedReason), "unknown reason")
+}
+
 type exitError struct {
 	error
 	exitCode int
@@ -323,6 +1829,137 @@ func (ee *exitError) ExitCode() int {
 	return ee.exitCode
 }
 
+// setPseudoTerminal allocates a TTY for the named containers, or for every
+// container if one of the names is "all"
+func setPseudoTerminal(defs []*ecs.ContainerDefinition, containers []string) error {
+	for _, name := range containers {
+		var found bool
+		for _, def := range defs {
+			if name == "all" || *def.Name == name {
+				log.Printf("Allocating a pseudo terminal for %s", *def.Name)
+				def.PseudoTerminal = aws.Bool(true)
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("no container definition named %q to allocate a tty for", name)
+		}
+	}
+	return nil
+}
+
+// taskMetadataEnv returns the task metadata that is known at launch time as
+// environment variables. The task ARN isn't known until the task has been
+// run, so it isn't included
+func taskMetadataEnv(cluster, taskDefinition string) []*ecs.KeyValuePair {
+	return []*ecs.KeyValuePair{
+		{Name: aws.String("ECS_CLUSTER"), Value: aws.String(cluster)},
+		{Name: aws.String("ECS_TASK_DEFINITION"), Value: aws.String(taskDefinition)},
+	}
+}
+
+// ParseCapacityProvider parses a capacity provider strategy item in the form
+// name=weight[:base]
+func ParseCapacityProvider(s string) (ecs.CapacityProviderStrategyItem, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return ecs.CapacityProviderStrategyItem{}, fmt.Errorf("invalid capacity provider %q, expected name=weight[:base]", s)
+	}
+
+	item := ecs.CapacityProviderStrategyItem{
+		CapacityProvider: aws.String(parts[0]),
+	}
+
+	weightAndBase := strings.SplitN(parts[1], ":", 2)
+	weight, err := strconv.ParseInt(weightAndBase[0], 10, 64)
+	if err != nil {
+		return ecs.CapacityProviderStrategyItem{}, fmt.Errorf("invalid capacity provider %q, weight %q isn't an integer", s, weightAndBase[0])
+	}
+	item.Weight = aws.Int64(weight)
+
+	if len(weightAndBase) == 2 {
+		base, err := strconv.ParseInt(weightAndBase[1], 10, 64)
+		if err != nil {
+			return ecs.CapacityProviderStrategyItem{}, fmt.Errorf("invalid capacity provider %q, base %q isn't an integer", s, weightAndBase[1])
+		}
+		item.Base = aws.Int64(base)
+	}
+
+	return item, nil
+}
+
+// NewRuntimePlatform returns a runtime platform with the cpu architecture and
+// operating system family that are given, or nil if neither are
+func NewRuntimePlatform(cpuArchitecture, osFamily string) *ecs.RuntimePlatform {
+	if cpuArchitecture == "" && osFamily == "" {
+		return nil
+	}
+	platform := &ecs.RuntimePlatform{}
+	if cpuArchitecture != "" {
+		platform.CpuArchitecture = aws.String(cpuArchitecture)
+	}
+	if osFamily != "" {
+		platform.OperatingSystemFamily = aws.String(osFamily)
+	}
+	return platform
+}
+
+// setRuntimePlatform sets the parts of the runtime platform that are given
+func setRuntimePlatform(input *ecs.RegisterTaskDefinitionInput, platform *ecs.RuntimePlatform) {
+	if input.RuntimePlatform == nil {
+		input.RuntimePlatform = &ecs.RuntimePlatform{}
+	}
+	if platform.CpuArchitecture != nil {
+		log.Printf("Setting cpu architecture to %s", *platform.CpuArchitecture)
+		input.RuntimePlatform.CpuArchitecture = platform.CpuArchitecture
+	}
+	if platform.OperatingSystemFamily != nil {
+		log.Printf("Setting operating system family to %s", *platform.OperatingSystemFamily)
+		input.RuntimePlatform.OperatingSystemFamily = platform.OperatingSystemFamily
+	}
+}
+
+// validRuntimePlatform returns an error if the cpu architecture or operating
+// system family aren't ones ECS knows
+func validRuntimePlatform(platform *ecs.RuntimePlatform) error {
+	if arch := platform.CpuArchitecture; arch != nil && !containsString(ecs.CPUArchitecture_Values(), *arch) {
+		return fmt.Errorf("invalid --cpu-architecture %q, expected one of %s",
+			*arch, strings.Join(ecs.CPUArchitecture_Values(), ", "))
+	}
+	if family := platform.OperatingSystemFamily; family != nil && !containsString(ecs.OSFamily_Values(), *family) {
+		return fmt.Errorf("invalid --os-family %q, expected one of %s",
+			*family, strings.Join(ecs.OSFamily_Values(), ", "))
+	}
+	return nil
+}
+
+// setStopTimeout sets how long containers have to handle their stop signal
+// before they are killed
+func setStopTimeout(defs []*ecs.ContainerDefinition, seconds int64) {
+	for _, def := range defs {
+		log.Printf("Setting a stop timeout of %ds for %s", seconds, *def.Name)
+		def.StopTimeout = aws.Int64(seconds)
+	}
+}
+
+// networkConfiguration returns the awsvpc configuration for the subnets and
+// security groups, or nil if there are none
+func networkConfiguration(subnets, securityGroups []string, assignPublicIp string) *ecs.NetworkConfiguration {
+	if len(subnets) == 0 && len(securityGroups) == 0 {
+		return nil
+	}
+	if assignPublicIp == "" {
+		assignPublicIp = ecs.AssignPublicIpEnabled
+	}
+	return &ecs.NetworkConfiguration{
+		AwsvpcConfiguration: &ecs.AwsVpcConfiguration{
+			Subnets:        awsStrings(subnets),
+			AssignPublicIp: aws.String(assignPublicIp),
+			SecurityGroups: awsStrings(securityGroups),
+		},
+	}
+}
+
 func awsStrings(ss []string) []*string {
 	out := make([]*string, len(ss))
 	for i := range ss {
@@ -331,8 +1968,177 @@ func awsStrings(ss []string) []*string {
 	return out
 }
 
+// ParsePlacementConstraint parses a placement constraint in the form
+// type=expression, or just type for distinctInstance
+func ParsePlacementConstraint(s string) (*ecs.PlacementConstraint, error) {
+	parts := strings.SplitN(s, "=", 2)
+	constraint := &ecs.PlacementConstraint{Type: aws.String(parts[0])}
+
+	switch parts[0] {
+	case ecs.PlacementConstraintTypeMemberOf:
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid placement constraint %q, expected memberOf=expression", s)
+		}
+		constraint.Expression = aws.String(strings.TrimSpace(parts[1]))
+	case ecs.PlacementConstraintTypeDistinctInstance:
+		if len(parts) == 2 {
+			return nil, fmt.Errorf("invalid placement constraint %q, distinctInstance doesn't take an expression", s)
+		}
+	default:
+		return nil, fmt.Errorf("invalid placement constraint %q, expected a type of %q or %q",
+			s, ecs.PlacementConstraintTypeMemberOf, ecs.PlacementConstraintTypeDistinctInstance)
+	}
+
+	return constraint, nil
+}
+
+// ParsePlacementAttributes parses instance attributes in the form key=value
+// into a memberOf placement constraint that places tasks on instances with
+// all of them, or nil if there are none
+func ParsePlacementAttributes(attributes []string) (*ecs.PlacementConstraint, error) {
+	if len(attributes) == 0 {
+		return nil, nil
+	}
+	var expressions []string
+	for _, s := range attributes {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || !placementAttributePattern.MatchString(parts[0]) || !placementAttributePattern.MatchString(parts[1]) {
+			return nil, fmt.Errorf("invalid placement attribute %q, expected key=value", s)
+		}
+		expressions = append(expressions, fmt.Sprintf("attribute:%s == %s", parts[0], parts[1]))
+	}
+	return &ecs.PlacementConstraint{
+		Type:       aws.String(ecs.PlacementConstraintTypeMemberOf),
+		Expression: aws.String(strings.Join(expressions, " and ")),
+	}, nil
+}
+
+// placementAttributePattern is the attribute names and values that can be
+// used in a cluster query expression without quoting
+var placementAttributePattern = regexp.MustCompile(`^[A-Za-z0-9_.@/:\\-]+$`)
+
+// ParsePlacementStrategy parses a placement strategy in the form type[:field],
+// such as spread:attribute:ecs.availability-zone, binpack:memory or random
+func ParsePlacementStrategy(s string) (*ecs.PlacementStrategy, error) {
+	parts := strings.SplitN(s, ":", 2)
+	strategy := &ecs.PlacementStrategy{Type: aws.String(parts[0])}
+
+	switch parts[0] {
+	case ecs.PlacementStrategyTypeSpread, ecs.PlacementStrategyTypeBinpack:
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid placement strategy %q, %s requires a field like %s:field", s, parts[0], parts[0])
+		}
+		strategy.Field = aws.String(parts[1])
+	case ecs.PlacementStrategyTypeRandom:
+		if len(parts) == 2 {
+			return nil, fmt.Errorf("invalid placement strategy %q, random doesn't take a field", s)
+		}
+	default:
+		return nil, fmt.Errorf("invalid placement strategy %q, expected a type of %q, %q or %q", s,
+			ecs.PlacementStrategyTypeSpread, ecs.PlacementStrategyTypeBinpack, ecs.PlacementStrategyTypeRandom)
+	}
+
+	return strategy, nil
+}
+
+// ParseTags parses tags in the form KEY=VALUE
+func ParseTags(tags []string) ([]*ecs.Tag, error) {
+	var out []*ecs.Tag
+	for _, s := range tags {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid tag %q, expected KEY=VALUE", s)
+		}
+		out = append(out, &ecs.Tag{
+			Key:   aws.String(parts[0]),
+			Value: aws.String(parts[1]),
+		})
+	}
+	return out, nil
+}
+
+// ParseImageOverrides parses images in the form NAME=URI, keyed by container
+// name. A bare URI is for the service container if one is given, otherwise
+// the first container.
+func ParseImageOverrides(images []string, service string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, s := range images {
+		name, image := service, s
+		if parts := strings.SplitN(s, "=", 2); len(parts) == 2 {
+			name, image = parts[0], parts[1]
+			if name == "" {
+				return nil, fmt.Errorf("invalid image %q, expected NAME=URI or URI", s)
+			}
+		}
+		if image == "" {
+			return nil, fmt.Errorf("invalid image %q, expected NAME=URI or URI", s)
+		}
+		if _, ok := out[name]; ok {
+			return nil, fmt.Errorf("image given more than once for container %q", name)
+		}
+		out[name] = image
+	}
+	return out, nil
+}
+
+// expandCommand expands $VAR and ${VAR} in a command with the environment of
+// the container it runs in, which is its task definition environment with
+// env overriding it. The host's environment isn't used, and variables that
+// aren't set expand to nothing like they would in a shell.
+func expandCommand(command []string, def *ecs.ContainerDefinition, env []*ecs.KeyValuePair) ([]string, error) {
+	vars := map[string]string{}
+	if def != nil {
+		for _, pair := range def.Environment {
+			vars[aws.StringValue(pair.Name)] = aws.StringValue(pair.Value)
+		}
+	}
+	for _, pair := range env {
+		vars[aws.StringValue(pair.Name)] = aws.StringValue(pair.Value)
+	}
+
+	expanded := make([]string, len(command))
+	for i, arg := range command {
+		s, err := interpolate.Interpolate(interpolate.NewMapEnv(vars), arg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand command %q: %v", arg, err)
+		}
+		expanded[i] = s
+	}
+	return expanded, nil
+}
+
+// environment returns the variables from the env files in order, followed by
+// the ones from --env, so later ones win
+func (r *Runner) environment() ([]string, error) {
+	var environment []string
+	for _, file := range r.EnvFiles {
+		env, err := parser.ReadEnvFile(file)
+		if err != nil {
+			return nil, err
+		}
+		environment = append(environment, env...)
+	}
+	return append(environment, r.Environment...), nil
+}
+
+// writeEnv writes the environment passed to the containers, with only the
+// names unless the mode is PrintEnvFull
+func writeEnv(w io.Writer, mode string, env []*ecs.KeyValuePair) {
+	fmt.Fprintf(w, "Container environment:\n")
+	for _, kv := range env {
+		if mode == PrintEnvFull {
+			fmt.Fprintf(w, "  %s=%s\n", aws.StringValue(kv.Name), aws.StringValue(kv.Value))
+		} else {
+			fmt.Fprintf(w, "  %s\n", aws.StringValue(kv.Name))
+		}
+	}
+}
+
+// awsKeyValuePairForEnv converts KEY=value and KEY variables to key value
+// pairs. If a key is given more than once, the last value wins.
 func awsKeyValuePairForEnv(lookupEnv func(key string) (string, bool), wanted []string) ([]*ecs.KeyValuePair, error) {
 	var kvp []*ecs.KeyValuePair
+	index := map[string]int{}
 	for _, s := range wanted {
 		parts := strings.SplitN(s, "=", 2)
 		key := parts[0]
@@ -347,6 +2153,11 @@ func awsKeyValuePairForEnv(lookupEnv func(key string) (string, bool), wanted []s
 			value = v2
 		}
 
+		if i, ok := index[key]; ok {
+			kvp[i].Value = &value
+			continue
+		}
+		index[key] = len(kvp)
 		kvp = append(kvp, &ecs.KeyValuePair{
 			Name:  &key,
 			Value: &value,
@@ -355,3 +2166,12 @@ func awsKeyValuePairForEnv(lookupEnv func(key string) (string, bool), wanted []s
 
 	return kvp, nil
 }
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,30 @@
 package runner
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
 
 func TestAWSKeyValuePairForEnvEmpty(t *testing.T) {
 	lookupEnv := func(key string) (string, bool) {
@@ -74,3 +98,1819 @@ func TestAWSKeyValuePairForEnvMissing(t *testing.T) {
 		t.Fatalf("bad error message returned: %q", err.Error())
 	}
 }
+
+func TestSetPseudoTerminal(t *testing.T) {
+	defs := []*ecs.ContainerDefinition{
+		{Name: aws.String("app")},
+		{Name: aws.String("sidecar")},
+	}
+
+	if err := setPseudoTerminal(defs, []string{"app"}); err != nil {
+		t.Fatal(err)
+	}
+	if !aws.BoolValue(defs[0].PseudoTerminal) {
+		t.Fatal("Expected app to have a pseudo terminal")
+	}
+	if defs[1].PseudoTerminal != nil {
+		t.Fatal("Expected sidecar to not have a pseudo terminal")
+	}
+
+	if err := setPseudoTerminal(defs, []string{"all"}); err != nil {
+		t.Fatal(err)
+	}
+	if !aws.BoolValue(defs[1].PseudoTerminal) {
+		t.Fatal("Expected sidecar to have a pseudo terminal")
+	}
+
+	if err := setPseudoTerminal(defs, []string{"missing"}); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+}
+
+func TestTaskMetadataEnv(t *testing.T) {
+	kvp := taskMetadataEnv("my-cluster", "my-family:3")
+
+	expected := map[string]string{
+		"ECS_CLUSTER":         "my-cluster",
+		"ECS_TASK_DEFINITION": "my-family:3",
+	}
+
+	if len(kvp) != len(expected) {
+		t.Fatalf("Unexpected number of key value pairs. Expected %d, actual %d", len(expected), len(kvp))
+	}
+
+	for _, pair := range kvp {
+		if v := expected[*pair.Name]; v != *pair.Value {
+			t.Fatalf("Bad value for key %q. Expected %q, actual %q", *pair.Name, v, *pair.Value)
+		}
+	}
+}
+
+func TestRegisterExistingWithoutDescribing(t *testing.T) {
+	svc := &mockECS{}
+
+	r := New()
+	r.ExistingTaskDefinition = "my-task:3"
+	r.NoDescribeOnExisting = true
+
+	reg, err := r.register(context.Background(), svc, "my-prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reg.TaskDefinition != "my-task:3" || reg.Registered {
+		t.Fatalf("Expected to run my-task:3 as is, got %+v", reg)
+	}
+	if len(svc.described) != 0 || len(svc.registered) != 0 {
+		t.Fatal("Expected no describe or register calls")
+	}
+	if reg.LogsFollowed {
+		t.Fatal("Expected logs not to be followed when where they go isn't known")
+	}
+}
+
+func TestRegisterExistingFollowsLogsOnlyWhenTheyMatch(t *testing.T) {
+	awslogs := func(group, prefix string) *ecs.LogConfiguration {
+		return &ecs.LogConfiguration{
+			LogDriver: aws.String("awslogs"),
+			Options: map[string]*string{
+				"awslogs-group":         aws.String(group),
+				"awslogs-stream-prefix": aws.String(prefix),
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		logs     *ecs.LogConfiguration
+		followed bool
+	}{
+		{"matching", awslogs("my-group", "my-prefix"), true},
+		{"other group", awslogs("other-group", "my-prefix"), false},
+		{"other prefix", awslogs("my-group", "run_task_123"), false},
+		{"no awslogs", nil, false},
+	} {
+		svc := &mockECS{
+			taskDefinitions: map[string]*ecs.TaskDefinition{
+				"my-task:7": {
+					Family:   aws.String("my-task"),
+					Revision: aws.Int64(7),
+					ContainerDefinitions: []*ecs.ContainerDefinition{
+						{Name: aws.String("app"), LogConfiguration: tc.logs},
+					},
+				},
+			},
+		}
+
+		// with a --name it's described to check where it logs
+		r := New()
+		r.ExistingTaskDefinition = "my-task:7"
+		r.NoDescribeOnExisting = true
+		r.LogGroupName = "my-group"
+		r.TaskName = "my-prefix"
+
+		reg, err := r.register(context.Background(), svc, "my-prefix")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reg.LogsFollowed != tc.followed {
+			t.Errorf("%s: expected LogsFollowed %v, got %v", tc.name, tc.followed, reg.LogsFollowed)
+		}
+	}
+}
+
+func TestRegisterExistingDescribesForOverrides(t *testing.T) {
+	svc := &mockECS{
+		taskDefinitions: map[string]*ecs.TaskDefinition{
+			"my-task:3": {
+				Family:               aws.String("my-task"),
+				ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("app")}},
+			},
+		},
+	}
+
+	r := New()
+	r.ExistingTaskDefinition = "my-task:3"
+	r.NoDescribeOnExisting = true
+	r.Overrides = []Override{{Command: []string{"echo", "hello"}}}
+
+	reg, err := r.register(context.Background(), svc, "my-prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reg.TaskDefinition != "my-task:3" || len(reg.ContainerDefinitions) != 1 {
+		t.Fatalf("Expected my-task:3 with its container definitions, got %+v", reg)
+	}
+	if len(svc.described) != 1 || len(svc.registered) != 0 {
+		t.Fatal("Expected a describe call and no register calls")
+	}
+}
+
+func TestRegisterExistingResolvesBareFamily(t *testing.T) {
+	svc := &mockECS{
+		taskDefinitions: map[string]*ecs.TaskDefinition{
+			"my-task": {
+				Family:               aws.String("my-task"),
+				Revision:             aws.Int64(7),
+				ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("app")}},
+			},
+		},
+	}
+
+	r := New()
+	r.ExistingTaskDefinition = "my-task"
+	r.NoDescribeOnExisting = true
+
+	reg, err := r.register(context.Background(), svc, "my-prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reg.TaskDefinition != "my-task:7" || reg.Registered {
+		t.Fatalf("Expected my-task to resolve to my-task:7, got %+v", reg)
+	}
+	if len(svc.described) != 1 || len(svc.registered) != 0 {
+		t.Fatal("Expected a describe call and no register calls")
+	}
+	if input := r.runTaskInput(reg.TaskDefinition); *input.TaskDefinition != "my-task:7" {
+		t.Fatalf("Expected the resolved revision to be run, got %q", *input.TaskDefinition)
+	}
+}
+
+func TestRegisterEphemeralStorage(t *testing.T) {
+	for _, tc := range []struct {
+		fargate  bool
+		gib      int64
+		expected *int64
+	}{
+		{fargate: true, gib: 50, expected: aws.Int64(50)},
+		{fargate: true, gib: 0},
+		{fargate: false, gib: 50},
+	} {
+		svc := &mockECS{
+			taskDefinitions: map[string]*ecs.TaskDefinition{
+				"my-task:3": {
+					Family:               aws.String("my-task"),
+					ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("app")}},
+				},
+			},
+		}
+
+		r := New()
+		r.ExistingTaskDefinition = "my-task:3"
+		r.Fargate = tc.fargate
+		r.EphemeralStorageGiB = tc.gib
+
+		if _, err := r.register(context.Background(), svc, "my-prefix"); err != nil {
+			t.Fatal(err)
+		}
+
+		storage := svc.registered[0].EphemeralStorage
+		if tc.expected == nil && storage != nil {
+			t.Errorf("fargate %v, %d GiB: expected no ephemeral storage, got %v", tc.fargate, tc.gib, storage)
+		} else if tc.expected != nil && (storage == nil || *storage.SizeInGiB != *tc.expected) {
+			t.Errorf("fargate %v, %d GiB: expected %d GiB, got %v", tc.fargate, tc.gib, *tc.expected, storage)
+		}
+	}
+}
+
+func TestValidateEphemeralStorage(t *testing.T) {
+	for gib, valid := range map[int64]bool{0: true, 20: false, 21: true, 200: true, 201: false, -1: false} {
+		r := New()
+		r.ExistingTaskDefinition = "my-task:3"
+		r.EphemeralStorageGiB = gib
+		if err := r.validate(); (err == nil) != valid {
+			t.Errorf("%d GiB: expected valid %v, got %v", gib, valid, err)
+		}
+	}
+}
+
+func TestRegisterRoleOverrides(t *testing.T) {
+	for _, tc := range []struct {
+		taskRole, executionRole string
+		expectedTaskRole        string
+		expectedExecutionRole   string
+	}{
+		{
+			taskRole:              "arn:aws:iam::012345678910:role/staging-task",
+			executionRole:         "arn:aws:iam::012345678910:role/staging-execution",
+			expectedTaskRole:      "arn:aws:iam::012345678910:role/staging-task",
+			expectedExecutionRole: "arn:aws:iam::012345678910:role/staging-execution",
+		},
+		{
+			taskRole:              "arn:aws:iam::012345678910:role/staging-task",
+			expectedTaskRole:      "arn:aws:iam::012345678910:role/staging-task",
+			expectedExecutionRole: "arn:aws:iam::012345678910:role/execution",
+		},
+		{
+			expectedTaskRole:      "arn:aws:iam::012345678910:role/task",
+			expectedExecutionRole: "arn:aws:iam::012345678910:role/execution",
+		},
+	} {
+		svc := &mockECS{
+			taskDefinitions: map[string]*ecs.TaskDefinition{
+				"my-task:3": {
+					Family:               aws.String("my-task"),
+					ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("app")}},
+					TaskRoleArn:          aws.String("arn:aws:iam::012345678910:role/task"),
+					ExecutionRoleArn:     aws.String("arn:aws:iam::012345678910:role/execution"),
+				},
+			},
+		}
+
+		r := New()
+		r.ExistingTaskDefinition = "my-task:3"
+		r.TaskRoleArn = tc.taskRole
+		r.ExecutionRoleArn = tc.executionRole
+
+		if _, err := r.register(context.Background(), svc, "my-prefix"); err != nil {
+			t.Fatal(err)
+		}
+
+		registered := svc.registered[0]
+		if aws.StringValue(registered.TaskRoleArn) != tc.expectedTaskRole ||
+			aws.StringValue(registered.ExecutionRoleArn) != tc.expectedExecutionRole {
+			t.Errorf("Expected roles %s and %s, got %s and %s", tc.expectedTaskRole, tc.expectedExecutionRole,
+				aws.StringValue(registered.TaskRoleArn), aws.StringValue(registered.ExecutionRoleArn))
+		}
+	}
+}
+
+func TestValidateRoleOverrides(t *testing.T) {
+	r := New()
+	r.ExistingTaskDefinition = "my-task:3"
+	r.TaskRoleArn = "arn:aws:iam::012345678910:role/path/my-role"
+	if err := r.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, role := range []string{"my-role", "arn:aws:iam::012345678910:user/me", "arn:aws:s3:::my-bucket"} {
+		r.ExecutionRoleArn = role
+		if err := r.validate(); err == nil {
+			t.Errorf("Expected an error for %q", role)
+		}
+	}
+}
+
+func TestValidateVarsPrecedenceWithoutVarsFile(t *testing.T) {
+	r := New()
+	r.ExistingTaskDefinition = "my-task:3"
+	r.VarsPrecedence = "flie"
+	if err := r.validate(); err == nil {
+		t.Fatal("Expected an error for an unknown vars precedence")
+	}
+
+	r.VarsPrecedence = "file"
+	if err := r.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateDeregisterPreviousWithTask(t *testing.T) {
+	r := New()
+	r.ExistingTaskDefinition = "my-task:3"
+	r.DeregisterPrevious = true
+	if err := r.validate(); err == nil {
+		t.Fatal("Expected an error for --deregister-previous with --task")
+	}
+}
+
+func TestValidateAnnotateWithOutputInGitHubActions(t *testing.T) {
+	r := New()
+	r.ExistingTaskDefinition = "my-task:3"
+	r.Annotate = true
+	r.Output = "json"
+
+	os.Setenv("GITHUB_ACTIONS", "true")
+	defer os.Unsetenv("GITHUB_ACTIONS")
+	if err := r.validate(); err == nil {
+		t.Fatal("Expected an error for --annotate with --output in GitHub Actions")
+	}
+
+	os.Unsetenv("GITHUB_ACTIONS")
+	if err := r.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterRuntimePlatform(t *testing.T) {
+	for _, tc := range []struct {
+		existing *ecs.RuntimePlatform
+		platform *ecs.RuntimePlatform
+		arch     string
+		family   string
+	}{
+		{
+			platform: NewRuntimePlatform("ARM64", ""),
+			arch:     "ARM64",
+		},
+		{
+			existing: NewRuntimePlatform("X86_64", "LINUX"),
+			platform: NewRuntimePlatform("", "WINDOWS_SERVER_2022_CORE"),
+			arch:     "X86_64",
+			family:   "WINDOWS_SERVER_2022_CORE",
+		},
+		{
+			existing: NewRuntimePlatform("ARM64", "LINUX"),
+			arch:     "ARM64",
+			family:   "LINUX",
+		},
+	} {
+		svc := &mockECS{
+			taskDefinitions: map[string]*ecs.TaskDefinition{
+				"my-task:3": {
+					Family:               aws.String("my-task"),
+					ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("app")}},
+					RuntimePlatform:      tc.existing,
+				},
+			},
+		}
+
+		r := New()
+		r.ExistingTaskDefinition = "my-task:3"
+		r.RuntimePlatform = tc.platform
+
+		if _, err := r.register(context.Background(), svc, "my-prefix"); err != nil {
+			t.Fatal(err)
+		}
+
+		platform := svc.registered[0].RuntimePlatform
+		if platform == nil || aws.StringValue(platform.CpuArchitecture) != tc.arch ||
+			aws.StringValue(platform.OperatingSystemFamily) != tc.family {
+			t.Errorf("Expected %s %s, got %v", tc.arch, tc.family, platform)
+		}
+	}
+}
+
+func TestValidateRuntimePlatform(t *testing.T) {
+	if NewRuntimePlatform("", "") != nil {
+		t.Fatal("Expected no runtime platform without an architecture or family")
+	}
+
+	for _, tc := range []struct {
+		arch, family string
+		valid        bool
+	}{
+		{"ARM64", "", true},
+		{"X86_64", "WINDOWS_SERVER_2019_FULL", true},
+		{"", "LINUX", true},
+		{"arm64", "", false},
+		{"", "WINDOWS", false},
+	} {
+		r := New()
+		r.ExistingTaskDefinition = "my-task:3"
+		r.RuntimePlatform = NewRuntimePlatform(tc.arch, tc.family)
+		if err := r.validate(); (err == nil) != tc.valid {
+			t.Errorf("%q %q: expected valid %v, got %v", tc.arch, tc.family, tc.valid, err)
+		}
+	}
+}
+
+func TestRegisterExistingReregisters(t *testing.T) {
+	svc := &mockECS{
+		taskDefinitions: map[string]*ecs.TaskDefinition{
+			"my-task:3": {
+				Family:               aws.String("my-task"),
+				ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("app")}},
+			},
+		},
+	}
+
+	r := New()
+	r.ExistingTaskDefinition = "my-task:3"
+	r.LogGroupName = "my-group"
+
+	reg, err := r.register(context.Background(), svc, "my-prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reg.Registered || reg.TaskDefinition != "my-task:1" {
+		t.Fatalf("Expected a new revision to be registered, got %+v", reg)
+	}
+	if l := len(svc.registered); l != 1 {
+		t.Fatal("bad number of task definitions registered", l)
+	}
+	group := svc.registered[0].ContainerDefinitions[0].LogConfiguration.Options["awslogs-group"]
+	if *group != "my-group" {
+		t.Fatalf("bad log group %q", *group)
+	}
+}
+
+func TestSetStopTimeout(t *testing.T) {
+	defs := []*ecs.ContainerDefinition{
+		{Name: aws.String("app")},
+		{Name: aws.String("sidecar"), StopTimeout: aws.Int64(5)},
+	}
+
+	setStopTimeout(defs, 90)
+
+	for _, def := range defs {
+		if aws.Int64Value(def.StopTimeout) != 90 {
+			t.Fatalf("Expected %s to have a stop timeout of 90, got %v", *def.Name, def.StopTimeout)
+		}
+	}
+}
+
+func TestRandomStreamPrefixIsDistinct(t *testing.T) {
+	prefixes := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			prefix, err := randomStreamPrefix()
+			if err != nil {
+				t.Error(err)
+			}
+			prefixes <- prefix
+		}()
+	}
+
+	first, second := <-prefixes, <-prefixes
+	if first == second {
+		t.Fatalf("Expected distinct prefixes, got %q twice", first)
+	}
+	if !strings.HasPrefix(first, "run_task_") {
+		t.Fatalf("bad prefix %q", first)
+	}
+}
+
+func TestNetworkConfigurationAssignPublicIp(t *testing.T) {
+	for assignPublicIp, expected := range map[string]string{
+		"":         "ENABLED",
+		"ENABLED":  "ENABLED",
+		"DISABLED": "DISABLED",
+	} {
+		nc := networkConfiguration([]string{"subnet-a"}, []string{"sg-a"}, assignPublicIp)
+		if nc == nil {
+			t.Fatal("Expected a network configuration")
+		}
+		if v := aws.StringValue(nc.AwsvpcConfiguration.AssignPublicIp); v != expected {
+			t.Fatalf("Expected %q for %q, got %q", expected, assignPublicIp, v)
+		}
+	}
+}
+
+func TestNetworkConfigurationWithoutSubnetsOrSecurityGroups(t *testing.T) {
+	if nc := networkConfiguration(nil, nil, "ENABLED"); nc != nil {
+		t.Fatalf("Expected no network configuration, got %v", nc)
+	}
+}
+
+func TestRunValidatesAssignPublicIp(t *testing.T) {
+	r := New()
+	r.TaskDefinitionFile = "taskdefinition.json"
+	r.AssignPublicIp = "YES"
+
+	err := r.Run(context.Background())
+	if err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	if !strings.Contains(err.Error(), `unknown assign public ip "YES"`) {
+		t.Fatalf("bad error message returned: %q", err.Error())
+	}
+}
+
+func TestParseCapacityProvider(t *testing.T) {
+	item, err := ParseCapacityProvider("FARGATE_SPOT=3:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *item.CapacityProvider != "FARGATE_SPOT" || *item.Weight != 3 || *item.Base != 1 {
+		t.Fatalf("bad capacity provider %v", item)
+	}
+
+	item, err = ParseCapacityProvider("FARGATE=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *item.CapacityProvider != "FARGATE" || *item.Weight != 1 || item.Base != nil {
+		t.Fatalf("bad capacity provider %v", item)
+	}
+
+	for _, s := range []string{"FARGATE", "=1", "FARGATE=llamas", "FARGATE=1:llamas"} {
+		if _, err := ParseCapacityProvider(s); err == nil {
+			t.Fatalf("Expected an error for %q, got nil", s)
+		}
+	}
+}
+
+func TestValidateCapacityProviderWithFargate(t *testing.T) {
+	r := New()
+	r.TaskDefinitionFile = "taskdefinition.json"
+	r.CapacityProviderStrategy = []ecs.CapacityProviderStrategyItem{
+		{CapacityProvider: aws.String("FARGATE_SPOT"), Weight: aws.Int64(1)},
+	}
+
+	if err := r.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	r.Fargate = true
+	if err := r.validate(); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+}
+
+func TestRunTaskInputTags(t *testing.T) {
+	r := New()
+	r.RunID = "my-run"
+
+	input := r.runTaskInput("my-task:1")
+
+	tags := map[string]string{}
+	for _, tag := range input.Tags {
+		tags[*tag.Key] = *tag.Value
+	}
+	if tags["ManagedBy"] != "ecs-run-task" {
+		t.Fatalf("bad ManagedBy tag %q", tags["ManagedBy"])
+	}
+	if tags["RunId"] != "my-run" {
+		t.Fatalf("bad RunId tag %q", tags["RunId"])
+	}
+}
+
+func TestRunTaskInputEnableExecuteCommand(t *testing.T) {
+	r := New()
+
+	if input := r.runTaskInput("my-task:1"); input.EnableExecuteCommand != nil {
+		t.Fatal("Expected EnableExecuteCommand to be unset")
+	}
+
+	r.EnableExecuteCommand = true
+	if input := r.runTaskInput("my-task:1"); !aws.BoolValue(input.EnableExecuteCommand) {
+		t.Fatal("Expected EnableExecuteCommand to be true")
+	}
+}
+
+func TestRunTaskInputPropagateTags(t *testing.T) {
+	r := New()
+
+	if input := r.runTaskInput("my-task:1"); input.PropagateTags != nil {
+		t.Fatal("Expected PropagateTags to be unset")
+	}
+
+	r.PropagateTags = "TASK_DEFINITION"
+	if input := r.runTaskInput("my-task:1"); aws.StringValue(input.PropagateTags) != "TASK_DEFINITION" {
+		t.Fatalf("bad PropagateTags %v", input.PropagateTags)
+	}
+}
+
+func TestRunValidatesPropagateTags(t *testing.T) {
+	r := New()
+	r.TaskDefinitionFile = "taskdefinition.json"
+	r.PropagateTags = "LLAMAS"
+
+	err := r.Run(context.Background())
+	if err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	if !strings.Contains(err.Error(), `unknown propagate tags "LLAMAS"`) {
+		t.Fatalf("bad error message returned: %q", err.Error())
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags([]string{"team=platform", "cost-center=1234", "empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"team":        "platform",
+		"cost-center": "1234",
+		"empty":       "",
+	}
+	if len(tags) != len(expected) {
+		t.Fatalf("Unexpected number of tags. Expected %d, actual %d", len(expected), len(tags))
+	}
+	for _, tag := range tags {
+		if v, ok := expected[*tag.Key]; !ok || v != *tag.Value {
+			t.Fatalf("Bad value for tag %q: %q", *tag.Key, *tag.Value)
+		}
+	}
+}
+
+func TestParseTagsMalformed(t *testing.T) {
+	for _, s := range []string{"team", "=platform"} {
+		if _, err := ParseTags([]string{s}); err == nil {
+			t.Fatalf("Expected an error for %q, got nil", s)
+		}
+	}
+}
+
+func TestParseImageOverrides(t *testing.T) {
+	images, err := ParseImageOverrides([]string{"app=myapp:v2", "sidecar=123456789012.dkr.ecr.us-east-1.amazonaws.com/proxy:1.0"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images["app"] != "myapp:v2" || images["sidecar"] != "123456789012.dkr.ecr.us-east-1.amazonaws.com/proxy:1.0" {
+		t.Fatalf("bad images %v", images)
+	}
+
+	// the old single value form is for the --service container, or the first
+	images, err = ParseImageOverrides([]string{"myapp:v2"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[""] != "myapp:v2" {
+		t.Fatalf("bad images %v", images)
+	}
+	images, err = ParseImageOverrides([]string{"myapp:v2"}, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images["app"] != "myapp:v2" {
+		t.Fatalf("bad images %v", images)
+	}
+
+	for _, s := range [][]string{{"=myapp:v2"}, {"app="}, {"app=a", "app=b"}} {
+		if _, err := ParseImageOverrides(s, ""); err == nil {
+			t.Fatalf("Expected an error for %q, got nil", s)
+		}
+	}
+}
+
+func TestTagsAppliedToRegisterAndRun(t *testing.T) {
+	svc := &mockECS{
+		taskDefinitions: map[string]*ecs.TaskDefinition{
+			"my-task:3": {
+				Family:               aws.String("my-task"),
+				ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("app")}},
+			},
+		},
+	}
+
+	r := New()
+	r.ExistingTaskDefinition = "my-task:3"
+	r.Tags = []*ecs.Tag{{Key: aws.String("team"), Value: aws.String("platform")}}
+
+	if _, err := r.register(context.Background(), svc, "my-prefix"); err != nil {
+		t.Fatal(err)
+	}
+	tags := svc.registered[0].Tags
+	if v, _ := tagValue(tags, "team"); v != "platform" {
+		t.Fatalf("bad registered tags %v", tags)
+	}
+	if v, _ := tagValue(tags, "ManagedBy"); v != "ecs-run-task" {
+		t.Fatalf("Expected the task definition to be marked as registered by ecs-run-task, got %v", tags)
+	}
+
+	var found bool
+	for _, tag := range r.runTaskInput("my-task:4").Tags {
+		if *tag.Key == "team" && *tag.Value == "platform" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("Expected the team tag on the run task input")
+	}
+}
+
+func TestParsePlacementConstraint(t *testing.T) {
+	constraint, err := ParsePlacementConstraint("memberOf=attribute:ecs.instance-type == t3.medium")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *constraint.Type != "memberOf" || *constraint.Expression != "attribute:ecs.instance-type == t3.medium" {
+		t.Fatalf("bad placement constraint %v", constraint)
+	}
+
+	constraint, err = ParsePlacementConstraint("distinctInstance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *constraint.Type != "distinctInstance" || constraint.Expression != nil {
+		t.Fatalf("bad placement constraint %v", constraint)
+	}
+
+	for _, s := range []string{"memberOf", "memberOf=", "distinctInstance=llamas", "llamas=foo"} {
+		if _, err := ParsePlacementConstraint(s); err == nil {
+			t.Fatalf("Expected an error for %q, got nil", s)
+		}
+	}
+}
+
+func TestRunTaskInputFargateSizing(t *testing.T) {
+	for _, overrides := range [][]Override{
+		nil,
+		{{Service: "app", Command: []string{"echo", "hello"}}},
+	} {
+		r := New()
+		r.Fargate = true
+		r.TaskCPU = "2 vCPU"
+		r.TaskMemory = "4096"
+		r.Overrides = overrides
+
+		input := r.runTaskInput("my-task:1")
+		if aws.StringValue(input.Overrides.Cpu) != "2 vCPU" || aws.StringValue(input.Overrides.Memory) != "4096" {
+			t.Fatalf("Expected task level sizing with %d command overrides, got %v", len(overrides), input.Overrides)
+		}
+		for _, override := range input.Overrides.ContainerOverrides {
+			if override.Cpu != nil || override.Memory != nil {
+				t.Fatalf("Expected no container level sizing, got %v", override)
+			}
+		}
+	}
+
+	r := New()
+	r.Fargate = true
+	if input := r.runTaskInput("my-task:1"); input.Overrides.Cpu != nil || input.Overrides.Memory != nil {
+		t.Fatalf("Expected the task definition's sizing without overrides, got %v", input.Overrides)
+	}
+}
+
+func TestRegisterTaskSizing(t *testing.T) {
+	svc := &mockECS{
+		taskDefinitions: map[string]*ecs.TaskDefinition{
+			"my-task:3": {
+				Family:               aws.String("my-task"),
+				ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("app")}},
+				Cpu:                  aws.String("256"),
+				Memory:               aws.String("512"),
+			},
+		},
+	}
+
+	r := New()
+	r.ExistingTaskDefinition = "my-task:3"
+	r.Fargate = true
+	r.TaskCPU = "1 vCPU"
+
+	reg, err := r.register(context.Background(), svc, "my-prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registered := svc.registered[0]
+	if aws.StringValue(registered.Cpu) != "1 vCPU" || aws.StringValue(registered.Memory) != "512" {
+		t.Fatalf("Expected 1 vCPU and the existing 512 memory, got %v and %v",
+			aws.StringValue(registered.Cpu), aws.StringValue(registered.Memory))
+	}
+	if reg.Cpu != "1 vCPU" {
+		t.Fatalf("Expected the registration to have the task cpu, got %q", reg.Cpu)
+	}
+	for _, def := range registered.ContainerDefinitions {
+		if def.Cpu != nil || def.Memory != nil {
+			t.Fatalf("Expected the containers to be left alone, got %v", def)
+		}
+	}
+}
+
+func TestValidateTaskSizing(t *testing.T) {
+	for _, tc := range []struct {
+		cpu, memory string
+		valid       bool
+	}{
+		{"1024", "2048", true},
+		{"1 vCPU", "2 GB", true},
+		{"", "0.5GB", true},
+		{"lots", "", false},
+		{"", "2 TB", false},
+		{"", "-1", false},
+	} {
+		r := New()
+		r.ExistingTaskDefinition = "my-task:3"
+		r.TaskCPU = tc.cpu
+		r.TaskMemory = tc.memory
+		if err := r.validate(); (err == nil) != tc.valid {
+			t.Errorf("cpu %q memory %q: expected valid %v, got %v", tc.cpu, tc.memory, tc.valid, err)
+		}
+	}
+}
+
+func TestExpandCommand(t *testing.T) {
+	os.Setenv("ECS_RUN_TASK_HOST_ONLY", "from-host")
+	defer os.Unsetenv("ECS_RUN_TASK_HOST_ONLY")
+
+	def := &ecs.ContainerDefinition{
+		Name: aws.String("app"),
+		Environment: []*ecs.KeyValuePair{
+			{Name: aws.String("STAGE"), Value: aws.String("staging")},
+			{Name: aws.String("REGION"), Value: aws.String("us-east-1")},
+		},
+	}
+	env := []*ecs.KeyValuePair{
+		{Name: aws.String("STAGE"), Value: aws.String("production")},
+	}
+
+	command, err := expandCommand([]string{
+		"deploy", "--stage=$STAGE", "--region", "${REGION}", "$ECS_RUN_TASK_HOST_ONLY", "$$HOME",
+	}, def, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"deploy", "--stage=production", "--region", "us-east-1", "", "$HOME"}
+	if !reflect.DeepEqual(command, expected) {
+		t.Fatalf("Expected %q, got %q", expected, command)
+	}
+
+	if _, err := expandCommand([]string{"${STAGE"}, def, env); err == nil {
+		t.Fatal("Expected an error for an unterminated expansion")
+	}
+}
+
+func TestParsePlacementAttributes(t *testing.T) {
+	constraint, err := ParsePlacementAttributes([]string{"gpu=true", "stack=ci-prod", "ecs.os-type=linux"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "attribute:gpu == true and attribute:stack == ci-prod and attribute:ecs.os-type == linux"
+	if *constraint.Type != "memberOf" || *constraint.Expression != expected {
+		t.Fatalf("Expected memberOf %q, got %v", expected, constraint)
+	}
+
+	if constraint, err = ParsePlacementAttributes(nil); err != nil || constraint != nil {
+		t.Fatalf("Expected no constraint without attributes, got %v %v", constraint, err)
+	}
+
+	for _, s := range []string{"gpu", "gpu=", "=true", "gpu=true or 1 == 1", "name='x'"} {
+		if _, err := ParsePlacementAttributes([]string{s}); err == nil {
+			t.Errorf("Expected an error for %q, got nil", s)
+		}
+	}
+}
+
+func TestRunTaskInputPlacementConstraints(t *testing.T) {
+	constraint, err := ParsePlacementConstraint("memberOf=attribute:ecs.instance-type == t3.medium")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := New()
+	r.PlacementConstraints = []*ecs.PlacementConstraint{constraint}
+
+	if input := r.runTaskInput("my-task:1"); len(input.PlacementConstraints) != 1 {
+		t.Fatal("Expected the placement constraint on the run task input")
+	}
+
+	r.Fargate = true
+	if input := r.runTaskInput("my-task:1"); input.PlacementConstraints != nil {
+		t.Fatal("Expected placement constraints to be dropped for FARGATE")
+	}
+}
+
+func TestParsePlacementStrategy(t *testing.T) {
+	for s, expected := range map[string]ecs.PlacementStrategy{
+		"spread:attribute:ecs.availability-zone": {Type: aws.String("spread"), Field: aws.String("attribute:ecs.availability-zone")},
+		"binpack:memory":                         {Type: aws.String("binpack"), Field: aws.String("memory")},
+		"random":                                 {Type: aws.String("random")},
+	} {
+		strategy, err := ParsePlacementStrategy(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *strategy.Type != *expected.Type || aws.StringValue(strategy.Field) != aws.StringValue(expected.Field) {
+			t.Fatalf("Expected %q to parse to %v, got %v", s, expected, strategy)
+		}
+	}
+
+	for _, s := range []string{"spread", "binpack:", "random:cpu", "llamas:cpu"} {
+		if _, err := ParsePlacementStrategy(s); err == nil {
+			t.Fatalf("Expected an error for %q, got nil", s)
+		}
+	}
+}
+
+func TestRunTaskInputStartedBy(t *testing.T) {
+	r := New()
+
+	if input := r.runTaskInput("my-task:1"); aws.StringValue(input.StartedBy) != "ecs-run-task" {
+		t.Fatalf("Expected the default startedBy, got %v", input.StartedBy)
+	}
+
+	r.StartedBy = "buildkite/my-pipeline/123"
+	if input := r.runTaskInput("my-task:1"); aws.StringValue(input.StartedBy) != "buildkite/my-pipeline/123" {
+		t.Fatalf("bad startedBy %v", input.StartedBy)
+	}
+}
+
+func TestValidateStartedByLength(t *testing.T) {
+	r := New()
+	r.TaskDefinitionFile = "taskdefinition.json"
+	r.StartedBy = strings.Repeat("a", 129)
+
+	if err := r.validate(); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+
+	r.StartedBy = strings.Repeat("a", 128)
+	if err := r.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientTokenIsPerRun(t *testing.T) {
+	first := clientToken("abc123", "my-task:1")
+
+	if retry := clientToken("abc123", "my-task:1"); first != retry {
+		t.Fatalf("Expected retries of a run to share a token, got %q and %q", first, retry)
+	}
+	if other := clientToken("def456", "my-task:1"); first == other {
+		t.Fatal("Expected another run to get a different token")
+	}
+	if revision := clientToken("abc123", "my-task:2"); first == revision {
+		t.Fatal("Expected another revision to get a different token")
+	}
+	if len(first) > 64 {
+		t.Fatalf("Expected a token of at most 64 characters, got %d", len(first))
+	}
+}
+
+func TestNewRunIDIsStableInCI(t *testing.T) {
+	env := map[string]string{"BUILDKITE_JOB_ID": "0183c3a4-7f6e-4b5a-9b1e-2d8f1c0e9a77"}
+	first, err := newRunID(fakeEnv(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry, _ := newRunID(fakeEnv(env)); first != retry {
+		t.Fatalf("Expected a retry of the job to get the same run ID, got %q and %q", first, retry)
+	}
+	if len(first) != 16 {
+		t.Fatalf("Expected a 16 character run ID, got %q", first)
+	}
+
+	attempt := map[string]string{"GITHUB_RUN_ID": "1234", "GITHUB_JOB": "deploy", "GITHUB_RUN_ATTEMPT": "1"}
+	github, _ := newRunID(fakeEnv(attempt))
+	attempt["GITHUB_RUN_ATTEMPT"] = "2"
+	if rerun, _ := newRunID(fakeEnv(attempt)); github == rerun {
+		t.Fatal("Expected another attempt of the workflow to get a different run ID")
+	}
+
+	a, _ := newRunID(fakeEnv(nil))
+	b, _ := newRunID(fakeEnv(nil))
+	if a == b {
+		t.Fatal("Expected random run IDs outside CI")
+	}
+}
+
+func TestDryRunRegistersWithoutRunning(t *testing.T) {
+	svc := &mockECS{
+		taskDefinitions: map[string]*ecs.TaskDefinition{
+			"my-task:3": {
+				Family:               aws.String("my-task"),
+				ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("app")}},
+			},
+		},
+	}
+
+	r := New()
+	r.ExistingTaskDefinition = "my-task:3"
+	r.DryRun = true
+	r.Deregister = true
+
+	if err := r.dryRun(context.Background(), svc, "my-prefix"); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := len(svc.registered); l != 1 {
+		t.Fatal("bad number of task definitions registered", l)
+	}
+	if len(svc.runTaskInputs) != 0 || len(svc.startTaskInputs) != 0 {
+		t.Fatal("Expected no tasks to be run in a dry run")
+	}
+	if len(svc.deregistered) != 1 || svc.deregistered[0] != "my-task:1" {
+		t.Fatalf("Expected my-task:1 to be deregistered, got %v", svc.deregistered)
+	}
+}
+
+func TestDeregisterTimeoutIsSurfaced(t *testing.T) {
+	svc := &mockECS{
+		taskDefinitions: map[string]*ecs.TaskDefinition{
+			"my-task:3": {
+				Family:               aws.String("my-task"),
+				ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("app")}},
+			},
+		},
+		deregisterDelay: time.Second,
+	}
+
+	r := New()
+	r.ExistingTaskDefinition = "my-task:3"
+	r.DryRun = true
+	r.Deregister = true
+	r.DeregisterTimeout = 10 * time.Millisecond
+
+	start := time.Now()
+	err := r.dryRun(context.Background(), svc, "my-prefix")
+	if err == nil || !strings.Contains(err.Error(), "timed out after 10ms deregistering task my-task:1") {
+		t.Fatalf("Expected a deregister timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Expected the deregister to give up after the timeout, took %v", elapsed)
+	}
+	if len(svc.deregistered) != 0 {
+		t.Fatalf("Expected nothing to be deregistered, got %v", svc.deregistered)
+	}
+}
+
+func TestWriteEnv(t *testing.T) {
+	env := []*ecs.KeyValuePair{
+		{Name: aws.String("DB_HOST"), Value: aws.String("db.internal")},
+		{Name: aws.String("DB_PASSWORD"), Value: aws.String("hunter2")},
+	}
+
+	var keys bytes.Buffer
+	writeEnv(&keys, PrintEnvKeys, env)
+	if keys.String() != "Container environment:\n  DB_HOST\n  DB_PASSWORD\n" {
+		t.Fatalf("bad keys output %q", keys.String())
+	}
+
+	var full bytes.Buffer
+	writeEnv(&full, PrintEnvFull, env)
+	if full.String() != "Container environment:\n  DB_HOST=db.internal\n  DB_PASSWORD=hunter2\n" {
+		t.Fatalf("bad full output %q", full.String())
+	}
+}
+
+func TestEnvironmentPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base, prod := filepath.Join(dir, "base.env"), filepath.Join(dir, "prod.env")
+	if err := ioutil.WriteFile(base, []byte("LOG_LEVEL=debug\nDB_HOST=localhost\nREGION=us-east-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(prod, []byte("DB_HOST=db.internal\nLOG_LEVEL=info\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New()
+	r.EnvFiles = []string{base, prod}
+	r.Environment = []string{"LOG_LEVEL=warn"}
+
+	environment, err := r.environment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := awsKeyValuePairForEnv(func(string) (string, bool) { return "", false }, environment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"LOG_LEVEL": "warn", "DB_HOST": "db.internal", "REGION": "us-east-1"}
+	if len(env) != len(expected) {
+		t.Fatalf("Expected each key once, got %v", env)
+	}
+	for _, kv := range env {
+		if expected[*kv.Name] != *kv.Value {
+			t.Fatalf("bad value %q for %s", *kv.Value, *kv.Name)
+		}
+	}
+}
+
+func TestSessionOptionsWithProfile(t *testing.T) {
+	r := New()
+	r.Region = "ap-southeast-2"
+
+	opts := r.sessionOptions()
+	if opts.Profile != "" || opts.SharedConfigState != session.SharedConfigStateFromEnv {
+		t.Fatalf("Expected the default credential chain without a profile, got %+v", opts)
+	}
+
+	r.Profile = "staging"
+	opts = r.sessionOptions()
+	if opts.Profile != "staging" || opts.SharedConfigState != session.SharedConfigEnable {
+		t.Fatalf("Expected the staging profile from shared config, got %+v", opts)
+	}
+	if region := aws.StringValue(opts.Config.Region); region != "ap-southeast-2" {
+		t.Fatalf("Expected --region to win over the profile's, got %q", region)
+	}
+}
+
+func TestNewSessionAssumesRole(t *testing.T) {
+	base := credentials.NewStaticCredentials("AKID", "SECRET", "")
+
+	r := New()
+	r.Region = "us-east-1"
+	r.Config = aws.NewConfig().WithCredentials(base)
+
+	sess, err := r.newSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.Config.Credentials != base {
+		t.Fatal("Expected the base credentials without --assume-role-arn")
+	}
+
+	r.AssumeRoleARN = "arn:aws:iam::012345678910:role/deploy"
+	r.AssumeRoleSessionName = "my-deploy"
+	if sess, err = r.newSession(); err != nil {
+		t.Fatal(err)
+	}
+	if sess.Config.Credentials == base || sess.Config.Credentials == nil {
+		t.Fatal("Expected assume role credentials with --assume-role-arn")
+	}
+
+	p := &stscreds.AssumeRoleProvider{}
+	r.configureAssumeRole(p)
+	if p.RoleSessionName != "my-deploy" {
+		t.Fatalf("bad role session name %q", p.RoleSessionName)
+	}
+}
+
+func TestSessionOptionsWithEndpointURL(t *testing.T) {
+	r := New()
+	r.Region = "us-east-1"
+	r.EndpointURL = "https://localhost:4566"
+
+	opts := r.sessionOptions()
+	if endpoint := aws.StringValue(opts.Config.Endpoint); endpoint != "https://localhost:4566" {
+		t.Fatalf("Expected the endpoint to be applied, got %q", endpoint)
+	}
+	if opts.Config.HTTPClient != nil {
+		t.Fatal("Expected TLS to be verified by default")
+	}
+	if r.Config.Endpoint != nil {
+		t.Fatal("Expected the runner's config not to be modified")
+	}
+
+	r.EndpointSkipTLSVerify = true
+	opts = r.sessionOptions()
+	transport, ok := opts.Config.HTTPClient.Transport.(*http.Transport)
+	if !ok || !transport.TLSClientConfig.InsecureSkipVerify {
+		t.Fatal("Expected TLS verification to be skipped")
+	}
+
+	sess, err := r.newSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint := ecs.New(sess).Endpoint; endpoint != "https://localhost:4566" {
+		t.Fatalf("Expected clients to use the endpoint, got %q", endpoint)
+	}
+}
+
+func TestWriteArnFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "arn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	svc := &mockECS{
+		taskDefinitions: map[string]*ecs.TaskDefinition{
+			"my-task:3": {
+				Family:               aws.String("my-task"),
+				ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("app")}},
+			},
+		},
+	}
+
+	r := New()
+	r.ExistingTaskDefinition = "my-task:3"
+	r.DryRun = true
+	r.ArnFile = filepath.Join(dir, "artifacts", "task-definition-arn")
+
+	if err := r.dryRun(context.Background(), svc, "my-prefix"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(r.ArnFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arn := string(b); arn != "arn:aws:ecs:us-east-1:012345678910:task-definition/my-task:1\n" {
+		t.Fatalf("bad arn file %q", arn)
+	}
+}
+
+func TestLogWatcherIntervals(t *testing.T) {
+	r := New()
+	printer := func(ev *cloudwatchlogs.FilteredLogEvent) bool { return true }
+
+	lw := r.newLogWatcher(nil, "my-group", "my-stream", printer)
+	if lw.Interval != 0 || lw.Timeout != 0 {
+		t.Fatalf("Expected the defaults when unset, got %v and %v", lw.Interval, lw.Timeout)
+	}
+
+	r.LogPollInterval = 10 * time.Second
+	r.LogWaitTimeout = 5 * time.Minute
+	lw = r.newLogWatcher(nil, "my-group", "my-stream", printer)
+	if lw.Interval != 10*time.Second || lw.Timeout != 5*time.Minute {
+		t.Fatalf("Expected the flags to propagate, got %v and %v", lw.Interval, lw.Timeout)
+	}
+	if lw.LogGroupName != "my-group" || lw.LogStreamName != "my-stream" {
+		t.Fatalf("bad log stream %s %s", lw.LogGroupName, lw.LogStreamName)
+	}
+
+	r.LogPollInterval = -time.Second
+	if err := r.validate(); err == nil {
+		t.Fatal("Expected an error for a negative interval, got nil")
+	}
+}
+
+func TestRunDetachedDoesNotWatch(t *testing.T) {
+	var mu sync.Mutex
+	var targets []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		target := req.Header.Get("X-Amz-Target")
+		mu.Lock()
+		targets = append(targets, target)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch target {
+		case "Logs_20140328.DescribeLogGroups":
+			fmt.Fprint(w, `{"logGroups":[{"logGroupName":"my-group"}]}`)
+		case "AmazonEC2ContainerServiceV20141113.RegisterTaskDefinition":
+			fmt.Fprint(w, `{"taskDefinition":{"family":"my-task","revision":1}}`)
+		case "AmazonEC2ContainerServiceV20141113.RunTask":
+			fmt.Fprint(w, `{"tasks":[{"taskArn":"arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123","containers":[{"name":"app"}]}]}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"__type":"UnexpectedCall","message":"unexpected %s"}`, target)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "detach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "taskdefinition.json")
+	if err := ioutil.WriteFile(file, []byte(`{"family":"my-task","containerDefinitions":[{"name":"app","image":"alpine"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New()
+	r.Region = "us-east-1"
+	r.Config = aws.NewConfig().WithCredentials(credentials.NewStaticCredentials("AKID", "SECRET", "")).WithMaxRetries(0)
+	r.EndpointURL = ts.URL
+	r.TaskDefinitionFile = file
+	r.Cluster = "my-cluster"
+	r.LogGroupName = "my-group"
+	r.Deregister = true
+	r.Detach = true
+
+	if err := r.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, target := range targets {
+		switch target {
+		case "AmazonEC2ContainerServiceV20141113.DescribeTasks",
+			"AmazonEC2ContainerServiceV20141113.DeregisterTaskDefinition",
+			"Logs_20140328.DescribeLogStreams",
+			"Logs_20140328.FilterLogEvents":
+			t.Fatalf("Expected a detached run not to wait, watch or deregister, got %s", target)
+		}
+	}
+	if last := targets[len(targets)-1]; last != "AmazonEC2ContainerServiceV20141113.RunTask" {
+		t.Fatalf("Expected the run to return after RunTask, got %s last", last)
+	}
+}
+
+func TestRunRegistersEachTaskDefinitionInFile(t *testing.T) {
+	var mu sync.Mutex
+	var families []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		target := req.Header.Get("X-Amz-Target")
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch target {
+		case "Logs_20140328.DescribeLogGroups":
+			fmt.Fprint(w, `{"logGroups":[{"logGroupName":"my-group"}]}`)
+		case "AmazonEC2ContainerServiceV20141113.RegisterTaskDefinition":
+			var input struct{ Family string }
+			if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			families = append(families, input.Family)
+			mu.Unlock()
+			fmt.Fprintf(w, `{"taskDefinition":{"family":%q,"revision":1}}`, input.Family)
+		case "AmazonEC2ContainerServiceV20141113.RunTask":
+			var input struct{ TaskDefinition string }
+			if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+				t.Error(err)
+			}
+			fmt.Fprintf(w, `{"tasks":[{"taskArn":"arn:aws:ecs:us-east-1:012345678910:task/my-cluster/%s","containers":[{"name":"app"}]}]}`,
+				strings.Replace(input.TaskDefinition, ":", "-", -1))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"__type":"UnexpectedCall","message":"unexpected %s"}`, target)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "multidoc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "taskdefinition.yml")
+	body := `
+family: one
+containerDefinitions:
+  - name: app
+    image: alpine
+---
+family: two
+containerDefinitions:
+  - name: app
+    image: alpine
+`
+	if err := ioutil.WriteFile(file, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New()
+	r.Region = "us-east-1"
+	r.Config = aws.NewConfig().WithCredentials(credentials.NewStaticCredentials("AKID", "SECRET", "")).WithMaxRetries(0)
+	r.EndpointURL = ts.URL
+	r.TaskDefinitionFile = file
+	r.Cluster = "my-cluster"
+	r.LogGroupName = "my-group"
+	r.Detach = true
+
+	result, err := r.RunWithResult(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(families)
+	if !reflect.DeepEqual(families, []string{"one", "two"}) {
+		t.Fatalf("Expected both task definitions to be registered, got %v", families)
+	}
+	if !reflect.DeepEqual(result.TaskDefinitions, []string{"one:1", "two:1"}) {
+		t.Fatalf("Expected both task definitions in the result in order, got %v", result.TaskDefinitions)
+	}
+	if len(result.TaskArns) != 2 {
+		t.Fatalf("Expected a task for each task definition, got %v", result.TaskArns)
+	}
+}
+
+func TestRunContainerWithoutExitCode(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123"
+	containers := `[` +
+		`{"name":"app","containerArn":"arn:aws:ecs:us-east-1:012345678910:container/app-1","lastStatus":"STOPPED","exitCode":0},` +
+		`{"name":"sidecar","containerArn":"arn:aws:ecs:us-east-1:012345678910:container/sidecar-1","lastStatus":"STOPPED",` +
+		`"reason":"CannotPullContainerError: pull access denied"}` +
+		`]`
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch target := req.Header.Get("X-Amz-Target"); target {
+		case "Logs_20140328.DescribeLogGroups":
+			fmt.Fprint(w, `{"logGroups":[{"logGroupName":"my-group"}]}`)
+		case "Logs_20140328.DescribeLogStreams":
+			// the sidecar never started, so never logged
+			if prefix := body["logStreamNamePrefix"].(string); strings.Contains(prefix, "/app/") {
+				fmt.Fprintf(w, `{"logStreams":[{"logStreamName":%q}]}`, prefix)
+			} else {
+				fmt.Fprint(w, `{"logStreams":[]}`)
+			}
+		case "Logs_20140328.FilterLogEvents":
+			fmt.Fprint(w, `{"events":[{"message":"Container app-1 exited with 0","timestamp":1}]}`)
+		case "Logs_20140328.PutLogEvents":
+			fmt.Fprint(w, `{}`)
+		case "AmazonEC2ContainerServiceV20141113.RegisterTaskDefinition":
+			fmt.Fprint(w, `{"taskDefinition":{"family":"my-task","revision":4}}`)
+		case "AmazonEC2ContainerServiceV20141113.RunTask":
+			fmt.Fprintf(w, `{"tasks":[{"taskArn":%q,"containers":%s}]}`, taskArn, containers)
+		case "AmazonEC2ContainerServiceV20141113.DescribeTasks":
+			fmt.Fprintf(w, `{"tasks":[{"taskArn":%q,"lastStatus":"STOPPED","containers":%s}]}`, taskArn, containers)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"__type":"UnexpectedCall","message":"unexpected %s"}`, target)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "noexit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "taskdefinition.json")
+	if err := ioutil.WriteFile(file, []byte(`{"family":"my-task","containerDefinitions":[{"name":"app","image":"alpine"},{"name":"sidecar","image":"alpine"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	newRunner := func() *Runner {
+		r := New()
+		r.Region = "us-east-1"
+		r.Config = aws.NewConfig().WithCredentials(credentials.NewStaticCredentials("AKID", "SECRET", "")).WithMaxRetries(0)
+		r.EndpointURL = ts.URL
+		r.TaskDefinitionFile = file
+		r.Cluster = "my-cluster"
+		r.LogGroupName = "my-group"
+		r.LogPollInterval = time.Millisecond * 10
+		r.LogWaitTimeout = time.Second * 5
+		return r
+	}
+
+	// the sidecar fails the run through the exit code strategy
+	result, err := newRunner().RunWithResult(context.Background())
+	if _, ok := err.(*exitError); !ok || !strings.Contains(err.Error(), "CannotPullContainerError") {
+		t.Fatalf("Expected an exit error with the sidecar's reason, got %v", err)
+	}
+	if result.ExitCode != 1 || len(result.Tasks) != 1 {
+		t.Fatalf("Expected exit code 1 with the task summarised, got %+v", result)
+	}
+
+	// unless it's ignored
+	r := newRunner()
+	r.IgnoredContainers = []string{"sidecar"}
+	result, err = r.RunWithResult(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ExitCode != 0 {
+		t.Fatalf("Expected exit code 0 with the sidecar ignored, got %d", result.ExitCode)
+	}
+}
+
+func TestRunReportsSeveralTaskDefinitionsOnce(t *testing.T) {
+	var tokensMu sync.Mutex
+	tokens := map[string]string{}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.Header().Set("X-Amzn-Requestid", "request-id")
+		switch target := req.Header.Get("X-Amz-Target"); target {
+		case "Logs_20140328.DescribeLogGroups":
+			fmt.Fprint(w, `{"logGroups":[{"logGroupName":"my-group"}]}`)
+		case "Logs_20140328.DescribeLogStreams":
+			fmt.Fprintf(w, `{"logStreams":[{"logStreamName":%q}]}`, body["logStreamNamePrefix"])
+		case "Logs_20140328.FilterLogEvents":
+			// streams are prefix/container/task, and tasks are named after their family
+			stream := strings.Split(body["logStreamNames"].([]interface{})[0].(string), "/")
+			fmt.Fprintf(w, `{"events":[{"message":"Container %s-%s exited with 0","timestamp":1}]}`, stream[2], stream[1])
+		case "Logs_20140328.PutLogEvents":
+			fmt.Fprint(w, `{}`)
+		case "AmazonEC2ContainerServiceV20141113.RegisterTaskDefinition":
+			fmt.Fprintf(w, `{"taskDefinition":{"family":%q,"revision":1}}`, body["family"])
+		case "AmazonEC2ContainerServiceV20141113.RunTask":
+			family := strings.Split(body["taskDefinition"].(string), ":")[0]
+			tokensMu.Lock()
+			tokens[family], _ = body["clientToken"].(string)
+			tokensMu.Unlock()
+			fmt.Fprintf(w, `{"tasks":[{"taskArn":"arn:aws:ecs:us-east-1:012345678910:task/my-cluster/%s",`+
+				`"containers":[{"name":"app","containerArn":"arn:aws:ecs:us-east-1:012345678910:container/%s-app"}]}]}`, family, family)
+		case "AmazonEC2ContainerServiceV20141113.DescribeTasks":
+			var tasks []string
+			for _, arn := range body["tasks"].([]interface{}) {
+				id := path.Base(arn.(string))
+				tasks = append(tasks, fmt.Sprintf(`{"taskArn":%q,"lastStatus":"STOPPED","containers":[`+
+					`{"name":"app","containerArn":"arn:aws:ecs:us-east-1:012345678910:container/%s-app","lastStatus":"STOPPED","exitCode":0}]}`,
+					arn, id))
+			}
+			fmt.Fprintf(w, `{"tasks":[%s]}`, strings.Join(tasks, ","))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"__type":"UnexpectedCall","message":"unexpected %s"}`, target)
+		}
+	}))
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var posted []Summary
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var summary Summary
+		if err := json.NewDecoder(req.Body).Decode(&summary); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		posted = append(posted, summary)
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	dir, err := ioutil.TempDir("", "multidoc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "taskdefinition.yml")
+	body := `
+family: one
+containerDefinitions:
+  - name: app
+    image: alpine
+---
+family: two
+containerDefinitions:
+  - name: app
+    image: alpine
+`
+	if err := ioutil.WriteFile(file, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New()
+	r.Region = "us-east-1"
+	r.Config = aws.NewConfig().WithCredentials(credentials.NewStaticCredentials("AKID", "SECRET", "")).WithMaxRetries(0)
+	r.EndpointURL = ts.URL
+	r.TaskDefinitionFile = file
+	r.Cluster = "my-cluster"
+	r.LogGroupName = "my-group"
+	r.LogPollInterval = time.Millisecond * 10
+	r.ResultWebhook = webhook.URL
+	r.ClientToken = "my-token"
+
+	if _, err := r.RunWithResult(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if tokens["one"] == "" || tokens["one"] == tokens["two"] {
+		t.Fatalf("Expected each task definition to have its own client token, got %v", tokens)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posted) != 1 {
+		t.Fatalf("Expected a single summary for the run, got %d", len(posted))
+	}
+	if len(posted[0].Tasks) != 2 {
+		t.Fatalf("Expected the tasks of both task definitions in the summary, got %+v", posted[0].Tasks)
+	}
+	if got := posted[0].RequestIDs["RunTask"]; len(got) != 2 {
+		t.Fatalf("Expected the request IDs of both runs, got %v", got)
+	}
+}
+
+func TestRunTaskDefinitionFromS3(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet && req.URL.Path == "/my-bucket/taskdefinition.json" {
+			fmt.Fprint(w, `{"family":"my-task","containerDefinitions":[{"name":"app","image":"alpine"}]}`)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch target := req.Header.Get("X-Amz-Target"); target {
+		case "Logs_20140328.DescribeLogGroups":
+			fmt.Fprint(w, `{"logGroups":[{"logGroupName":"my-group"}]}`)
+		case "AmazonEC2ContainerServiceV20141113.RegisterTaskDefinition":
+			fmt.Fprint(w, `{"taskDefinition":{"family":"my-task","revision":1}}`)
+		case "AmazonEC2ContainerServiceV20141113.RunTask":
+			fmt.Fprint(w, `{"tasks":[{"taskArn":"arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123","containers":[{"name":"app"}]}]}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"__type":"UnexpectedCall","message":"unexpected %s %s"}`, req.Method, req.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	r := New()
+	r.Region = "us-east-1"
+	r.Config = aws.NewConfig().WithCredentials(credentials.NewStaticCredentials("AKID", "SECRET", "")).
+		WithMaxRetries(0).WithS3ForcePathStyle(true)
+	r.EndpointURL = ts.URL
+	r.TaskDefinitionFile = "s3://my-bucket/taskdefinition.json"
+	r.Cluster = "my-cluster"
+	r.LogGroupName = "my-group"
+	r.Detach = true
+
+	result, err := r.RunWithResult(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.TaskDefinition != "my-task:1" {
+		t.Fatalf("Expected my-task:1, got %q", result.TaskDefinition)
+	}
+}
+
+func TestWriteContainerFinishedMessageNilExitCodeUseTaskReason(t *testing.T) {
+	task := &ecs.Task{StoppedReason: aws.String("Task failed ELB health checks")}
+
+	err := writeContainerFinishedMessage(context.Background(), nil, task, &ecs.Container{
+		Name:       aws.String("app"),
+		LastStatus: aws.String("STOPPED"),
+		Reason:     aws.String("CannotPullContainerError: pull access denied"),
+	})
+	if err == nil || !strings.Contains(err.Error(), "CannotPullContainerError") {
+		t.Fatalf("Expected the container reason, got %v", err)
+	}
+
+	err = writeContainerFinishedMessage(context.Background(), nil, task, &ecs.Container{
+		Name:       aws.String("app"),
+		LastStatus: aws.String("STOPPED"),
+	})
+	if err == nil || !strings.Contains(err.Error(), "Task failed ELB health checks") {
+		t.Fatalf("Expected the task reason, got %v", err)
+	}
+}
+
+func TestWriteContainerFinishedMessageNilReasons(t *testing.T) {
+	err := writeContainerFinishedMessage(context.Background(), nil, &ecs.Task{}, &ecs.Container{
+		LastStatus: aws.String("STOPPED"),
+	})
+	if err == nil || !strings.Contains(err.Error(), "stopped without an exit code: unknown reason") {
+		t.Fatalf("Expected a generic error, got %v", err)
+	}
+
+	if err := writeContainerFinishedMessage(context.Background(), nil, &ecs.Task{}, &ecs.Container{}); err == nil {
+		t.Fatal("Expected an error for a container without a status, got nil")
+	}
+}
+
+func TestRunWithResult(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123"
+	containers := `[` +
+		`{"name":"app","containerArn":"arn:aws:ecs:us-east-1:012345678910:container/app-1","lastStatus":"STOPPED","exitCode":0},` +
+		`{"name":"sidecar","containerArn":"arn:aws:ecs:us-east-1:012345678910:container/sidecar-1","lastStatus":"STOPPED","exitCode":3}` +
+		`]`
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch target := req.Header.Get("X-Amz-Target"); target {
+		case "Logs_20140328.DescribeLogGroups":
+			fmt.Fprint(w, `{"logGroups":[{"logGroupName":"my-group"}]}`)
+		case "Logs_20140328.DescribeLogStreams":
+			fmt.Fprintf(w, `{"logStreams":[{"logStreamName":%q}]}`, body["logStreamNamePrefix"])
+		case "Logs_20140328.FilterLogEvents":
+			// each container finishes straight away, streams are prefix/container/task
+			stream := strings.Split(body["logStreamNames"].([]interface{})[0].(string), "/")
+			fmt.Fprintf(w, `{"events":[{"message":"Container %s-1 exited with 0","timestamp":1}]}`, stream[1])
+		case "Logs_20140328.PutLogEvents":
+			fmt.Fprint(w, `{}`)
+		case "AmazonEC2ContainerServiceV20141113.RegisterTaskDefinition":
+			fmt.Fprint(w, `{"taskDefinition":{"family":"my-task","revision":4}}`)
+		case "AmazonEC2ContainerServiceV20141113.RunTask":
+			fmt.Fprintf(w, `{"tasks":[{"taskArn":%q,"containers":%s}]}`, taskArn, containers)
+		case "AmazonEC2ContainerServiceV20141113.DescribeTasks":
+			fmt.Fprintf(w, `{"tasks":[{"taskArn":%q,"lastStatus":"STOPPED","stoppedReason":"Essential container in task exited","containers":%s}]}`,
+				taskArn, containers)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"__type":"UnexpectedCall","message":"unexpected %s"}`, target)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "result")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "taskdefinition.json")
+	if err := ioutil.WriteFile(file, []byte(`{"family":"my-task","containerDefinitions":[{"name":"app","image":"alpine"},{"name":"sidecar","image":"alpine"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New()
+	r.Region = "us-east-1"
+	r.Config = aws.NewConfig().WithCredentials(credentials.NewStaticCredentials("AKID", "SECRET", "")).WithMaxRetries(0)
+	r.EndpointURL = ts.URL
+	r.TaskDefinitionFile = file
+	r.Cluster = "my-cluster"
+	r.LogGroupName = "my-group"
+	r.LogPollInterval = time.Millisecond * 10
+
+	result, err := r.RunWithResult(context.Background())
+	if err == nil || err.Error() != "container sidecar exited with 3" {
+		t.Fatalf("Expected the sidecar's exit code as an error, got %v", err)
+	}
+
+	if result.TaskDefinition != "my-task:4" {
+		t.Fatalf("Expected my-task:4, got %q", result.TaskDefinition)
+	}
+	if !reflect.DeepEqual(result.TaskArns, []string{taskArn}) {
+		t.Fatalf("Expected the launched task, got %v", result.TaskArns)
+	}
+	if result.ExitCode != 3 {
+		t.Fatalf("Expected exit code 3, got %d", result.ExitCode)
+	}
+	if len(result.Tasks) != 1 || result.Tasks[0].StoppedReason != "Essential container in task exited" {
+		t.Fatalf("Expected the stopped reason of the task, got %+v", result.Tasks)
+	}
+	var codes []int64
+	for _, c := range result.Tasks[0].Containers {
+		codes = append(codes, *c.ExitCode)
+	}
+	if !reflect.DeepEqual(codes, []int64{0, 3}) {
+		t.Fatalf("Expected the containers' exit codes, got %v", codes)
+	}
+}
+
+func TestRunAuditsSecretFiles(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123"
+	containers := `[` +
+		`{"name":"app","containerArn":"arn:aws:ecs:us-east-1:012345678910:container/app-1","lastStatus":"STOPPED","exitCode":0},` +
+		`{"name":"ecs-run-task-secret-files","containerArn":"arn:aws:ecs:us-east-1:012345678910:container/ecs-run-task-secret-files-1","lastStatus":"STOPPED","exitCode":0}` +
+		`]`
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch target := req.Header.Get("X-Amz-Target"); target {
+		case "Logs_20140328.DescribeLogGroups":
+			fmt.Fprint(w, `{"logGroups":[{"logGroupName":"my-group"}]}`)
+		case "Logs_20140328.DescribeLogStreams":
+			fmt.Fprintf(w, `{"logStreams":[{"logStreamName":%q}]}`, body["logStreamNamePrefix"])
+		case "Logs_20140328.FilterLogEvents":
+			stream := strings.Split(body["logStreamNames"].([]interface{})[0].(string), "/")
+			fmt.Fprintf(w, `{"events":[{"message":"Container %s-1 exited with 0","timestamp":1}]}`, stream[1])
+		case "Logs_20140328.PutLogEvents":
+			fmt.Fprint(w, `{}`)
+		case "AmazonEC2ContainerServiceV20141113.RegisterTaskDefinition":
+			fmt.Fprint(w, `{"taskDefinition":{"family":"my-task","revision":4}}`)
+		case "AmazonEC2ContainerServiceV20141113.RunTask":
+			fmt.Fprintf(w, `{"tasks":[{"taskArn":%q,"containers":%s}]}`, taskArn, containers)
+		case "AmazonEC2ContainerServiceV20141113.DescribeTasks":
+			fmt.Fprintf(w, `{"tasks":[{"taskArn":%q,"lastStatus":"STOPPED","containers":%s}]}`, taskArn, containers)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"__type":"UnexpectedCall","message":"unexpected %s"}`, target)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "taskdefinition.json")
+	if err := ioutil.WriteFile(file, []byte(`{"family":"my-task","containerDefinitions":[{"name":"app","image":"alpine"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := New()
+	r.Region = "us-east-1"
+	r.Config = aws.NewConfig().WithCredentials(credentials.NewStaticCredentials("AKID", "SECRET", "")).WithMaxRetries(0)
+	r.EndpointURL = ts.URL
+	r.TaskDefinitionFile = file
+	r.Cluster = "my-cluster"
+	r.LogGroupName = "my-group"
+	r.LogPollInterval = time.Millisecond * 10
+	r.AuditSecrets = true
+	r.SecretFiles = []string{"app:/etc/app/key.pem=arn:aws:secretsmanager:us-east-1:012345678910:secret:key"}
+
+	result, err := r.RunWithResult(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for _, ref := range result.summary.Secrets {
+		if ref.Container == "ecs-run-task-secret-files" &&
+			ref.ValueFrom == "arn:aws:secretsmanager:us-east-1:012345678910:secret:key" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Expected the secret file in the audit, got %+v", result.summary.Secrets)
+	}
+}
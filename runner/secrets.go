@@ -0,0 +1,243 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+const (
+	// secretFilesContainer is the name of the container that writes secrets
+	// to files before the other containers start
+	secretFilesContainer = "ecs-run-task-secret-files"
+
+	// secretFilesImage is a small image with a shell for secretFilesContainer
+	secretFilesImage = "public.ecr.aws/docker/library/busybox:stable"
+)
+
+// ParseSecrets parses secrets in the form NAME=arn, keyed by the container
+// they're for, which is the service container if one is given, otherwise
+// the first container
+func ParseSecrets(secrets []string, service string) (map[string][]*ecs.Secret, error) {
+	out := map[string][]*ecs.Secret{}
+	for _, s := range secrets {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid secret %q, expected NAME=arn", s)
+		}
+		if err := validSecretArn(parts[1]); err != nil {
+			return nil, err
+		}
+		out[service] = append(out[service], &ecs.Secret{
+			Name:      aws.String(parts[0]),
+			ValueFrom: aws.String(parts[1]),
+		})
+	}
+	return out, nil
+}
+
+// validSecretArn returns an error if a secret isn't a Secrets Manager secret
+// or SSM Parameter Store parameter ARN
+func validSecretArn(s string) error {
+	a, err := arn.Parse(s)
+	if err == nil {
+		switch {
+		case a.Service == "secretsmanager" && strings.HasPrefix(a.Resource, "secret:"):
+			return nil
+		case a.Service == "ssm" && strings.HasPrefix(a.Resource, "parameter/"):
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid secret %q, expected a Secrets Manager secret or SSM parameter ARN", s)
+}
+
+// addSecrets adds secrets to containers by container name, with an empty
+// name meaning the first container. A secret replaces one of the same name
+// from the task definition.
+func addSecrets(defs []*ecs.ContainerDefinition, secrets map[string][]*ecs.Secret) error {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var def *ecs.ContainerDefinition
+		if name == "" {
+			if len(defs) == 0 {
+				return fmt.Errorf("no container definitions to add secrets to")
+			}
+			def = defs[0]
+		} else {
+			var err error
+			if def, err = containerDefinition(defs, name); err != nil {
+				return err
+			}
+		}
+
+		for _, secret := range secrets[name] {
+			log.Printf("Adding secret %s to %s", *secret.Name, *def.Name)
+			def.Secrets = setSecret(def.Secrets, secret)
+		}
+	}
+	return nil
+}
+
+// setSecret replaces the secret with the same name, or appends it
+func setSecret(secrets []*ecs.Secret, secret *ecs.Secret) []*ecs.Secret {
+	for i, existing := range secrets {
+		if aws.StringValue(existing.Name) == *secret.Name {
+			secrets[i] = secret
+			return secrets
+		}
+	}
+	return append(secrets, secret)
+}
+
+// secretFile is a secret to write to a file in a container
+type secretFile struct {
+	Container string
+	Path      string
+	ValueFrom string
+}
+
+// parseSecretFile parses a secret file in the form CONTAINER:path=arn
+func parseSecretFile(s string) (secretFile, error) {
+	container, rest, err := parseContainerValue(s)
+	if err != nil {
+		return secretFile{}, fmt.Errorf("invalid secret file %q, expected CONTAINER:path=arn", s)
+	}
+	parts := strings.SplitN(rest, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return secretFile{}, fmt.Errorf("invalid secret file %q, expected CONTAINER:path=arn", s)
+	}
+	p := parts[0]
+	if !path.IsAbs(p) || strings.HasSuffix(p, "/") || path.Clean(p) != p {
+		return secretFile{}, fmt.Errorf("invalid secret file path %q, expected an absolute file path", p)
+	}
+	if strings.ContainsAny(p, "'\n") {
+		return secretFile{}, fmt.Errorf("invalid secret file path %q, can't contain quotes or newlines", p)
+	}
+	return secretFile{Container: container, Path: p, ValueFrom: parts[1]}, nil
+}
+
+// addSecretFiles adds a container that writes secrets to files in volumes
+// shared with the containers that need them. ECS only exposes secrets as
+// environment variables, so the container gets them as secrets and writes
+// them out, and the other containers wait for it to succeed and mount the
+// volumes read only.
+func addSecretFiles(input *ecs.RegisterTaskDefinitionInput, files []secretFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	writer := &ecs.ContainerDefinition{
+		Name:      aws.String(secretFilesContainer),
+		Image:     aws.String(secretFilesImage),
+		Essential: aws.Bool(false),
+	}
+	var script []string
+	volumes := map[string]string{}
+
+	for i, file := range files {
+		def, err := containerDefinition(input.ContainerDefinitions, file.Container)
+		if err != nil {
+			return err
+		}
+
+		// one volume per container and directory, mounted over the directory
+		dir := path.Dir(file.Path)
+		key := file.Container + ":" + dir
+		volume, ok := volumes[key]
+		if !ok {
+			volume = fmt.Sprintf("ecs-run-task-secrets-%d", len(volumes))
+			volumes[key] = volume
+			input.Volumes = append(input.Volumes, &ecs.Volume{Name: aws.String(volume)})
+			writer.MountPoints = append(writer.MountPoints, &ecs.MountPoint{
+				SourceVolume:  aws.String(volume),
+				ContainerPath: aws.String("/" + volume),
+			})
+			def.MountPoints = append(def.MountPoints, &ecs.MountPoint{
+				SourceVolume:  aws.String(volume),
+				ContainerPath: aws.String(dir),
+				ReadOnly:      aws.Bool(true),
+			})
+			def.DependsOn = append(def.DependsOn, &ecs.ContainerDependency{
+				ContainerName: aws.String(secretFilesContainer),
+				Condition:     aws.String(ecs.ContainerConditionSuccess),
+			})
+		}
+
+		env := fmt.Sprintf("SECRET_FILE_%d", i)
+		target := fmt.Sprintf("/%s/%s", volume, path.Base(file.Path))
+		writer.Secrets = append(writer.Secrets, &ecs.Secret{
+			Name:      aws.String(env),
+			ValueFrom: aws.String(file.ValueFrom),
+		})
+		script = append(script, fmt.Sprintf(`printf '%%s' "$%s" > '%s' && chmod 0444 '%s'`, env, target, target))
+	}
+
+	writer.Command = aws.StringSlice([]string{"sh", "-c", strings.Join(script, " && ")})
+	input.ContainerDefinitions = append(input.ContainerDefinitions, writer)
+
+	return nil
+}
+
+// SecretReference is a secret a container references, by where it's
+// referenced from rather than its value
+type SecretReference struct {
+	Container string `json:"container"`
+
+	// Name is the environment variable the secret is exposed as, which is
+	// empty for repository credentials
+	Name string `json:"name,omitempty"`
+
+	// ValueFrom is the Secrets Manager or SSM Parameter Store ARN, or the
+	// parameter name if it's in the same region and account
+	ValueFrom string `json:"valueFrom"`
+}
+
+// auditSecrets lists the secrets and repository credentials referenced by
+// the container definitions, without resolving them
+func auditSecrets(defs []*ecs.ContainerDefinition) []SecretReference {
+	var refs []SecretReference
+	for _, def := range defs {
+		if def.RepositoryCredentials != nil && aws.StringValue(def.RepositoryCredentials.CredentialsParameter) != "" {
+			refs = append(refs, SecretReference{
+				Container: aws.StringValue(def.Name),
+				ValueFrom: aws.StringValue(def.RepositoryCredentials.CredentialsParameter),
+			})
+		}
+		for _, secret := range def.Secrets {
+			refs = append(refs, SecretReference{
+				Container: aws.StringValue(def.Name),
+				Name:      aws.StringValue(secret.Name),
+				ValueFrom: aws.StringValue(secret.ValueFrom),
+			})
+		}
+	}
+	return refs
+}
+
+// writeSecretsAudit prints the referenced secrets for a human
+func writeSecretsAudit(w io.Writer, refs []SecretReference) {
+	if len(refs) == 0 {
+		fmt.Fprintf(w, "The task definition references no secrets\n")
+		return
+	}
+	fmt.Fprintf(w, "Secrets referenced by the task definition:\n")
+	for _, ref := range refs {
+		name := ref.Name
+		if name == "" {
+			name = "(repository credentials)"
+		}
+		fmt.Fprintf(w, "  %s %s: %s\n", ref.Container, name, ref.ValueFrom)
+	}
+}
@@ -0,0 +1,202 @@
+package runner
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestParseSecretFile(t *testing.T) {
+	file, err := parseSecretFile("app:/run/secrets/db-password=arn:aws:secretsmanager:us-east-1:012345678910:secret:db-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Container != "app" || file.Path != "/run/secrets/db-password" ||
+		file.ValueFrom != "arn:aws:secretsmanager:us-east-1:012345678910:secret:db-password" {
+		t.Fatalf("bad secret file %+v", file)
+	}
+
+	for _, s := range []string{
+		"app",
+		"app:/run/secrets/db-password",
+		"app:/run/secrets/db-password=",
+		"app:relative/path=arn:aws:ssm:us-east-1:012345678910:parameter/db",
+		"app:/run/secrets/=arn:aws:ssm:us-east-1:012345678910:parameter/db",
+		"app:/run/secrets/it's=arn:aws:ssm:us-east-1:012345678910:parameter/db",
+	} {
+		if _, err := parseSecretFile(s); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+}
+
+func TestAddSecretFiles(t *testing.T) {
+	input := &ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions: []*ecs.ContainerDefinition{{Name: aws.String("app")}},
+	}
+
+	err := addSecretFiles(input, []secretFile{
+		{Container: "app", Path: "/run/secrets/db-password", ValueFrom: "arn:aws:ssm:us-east-1:012345678910:parameter/db-password"},
+		{Container: "app", Path: "/run/secrets/api-key", ValueFrom: "arn:aws:ssm:us-east-1:012345678910:parameter/api-key"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l := len(input.ContainerDefinitions); l != 2 {
+		t.Fatal("bad number of container definitions", l)
+	}
+	if l := len(input.Volumes); l != 1 {
+		t.Fatal("Expected a single volume for a single directory", l)
+	}
+
+	app := input.ContainerDefinitions[0]
+	if len(app.MountPoints) != 1 || *app.MountPoints[0].ContainerPath != "/run/secrets" || !*app.MountPoints[0].ReadOnly {
+		t.Fatalf("bad app mount points %v", app.MountPoints)
+	}
+	if len(app.DependsOn) != 1 || *app.DependsOn[0].ContainerName != secretFilesContainer || *app.DependsOn[0].Condition != "SUCCESS" {
+		t.Fatalf("bad app dependencies %v", app.DependsOn)
+	}
+
+	writer := input.ContainerDefinitions[1]
+	if *writer.Name != secretFilesContainer || *writer.Essential {
+		t.Fatalf("bad secret files container %v", writer)
+	}
+	if len(writer.Secrets) != 2 || *writer.Secrets[0].Name != "SECRET_FILE_0" ||
+		*writer.Secrets[1].ValueFrom != "arn:aws:ssm:us-east-1:012345678910:parameter/api-key" {
+		t.Fatalf("bad secrets %v", writer.Secrets)
+	}
+	expected := `printf '%s' "$SECRET_FILE_0" > '/ecs-run-task-secrets-0/db-password' && chmod 0444 '/ecs-run-task-secrets-0/db-password' && ` +
+		`printf '%s' "$SECRET_FILE_1" > '/ecs-run-task-secrets-0/api-key' && chmod 0444 '/ecs-run-task-secrets-0/api-key'`
+	if len(writer.Command) != 3 || *writer.Command[2] != expected {
+		t.Fatalf("bad command %q", aws.StringValueSlice(writer.Command))
+	}
+
+	if err := addSecretFiles(input, []secretFile{{Container: "llamas", Path: "/x", ValueFrom: "y"}}); err == nil {
+		t.Fatal("Expected an error for an unknown container")
+	}
+}
+
+func TestParseSecrets(t *testing.T) {
+	secrets, err := ParseSecrets([]string{
+		"DB_PASSWORD=arn:aws:secretsmanager:us-east-1:012345678910:secret:db-password-AbCdEf",
+		"API_KEY=arn:aws:ssm:us-east-1:012345678910:parameter/api-key",
+	}, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 1 || len(secrets["app"]) != 2 ||
+		*secrets["app"][0].Name != "DB_PASSWORD" || *secrets["app"][1].ValueFrom != "arn:aws:ssm:us-east-1:012345678910:parameter/api-key" {
+		t.Fatalf("bad secrets %v", secrets)
+	}
+
+	for _, s := range []string{
+		"DB_PASSWORD",
+		"=arn:aws:ssm:us-east-1:012345678910:parameter/api-key",
+		"DB_PASSWORD=db-password",
+		"DB_PASSWORD=arn:aws:s3:::my-bucket/db-password",
+		"DB_PASSWORD=arn:aws:secretsmanager:us-east-1:012345678910:db-password",
+	} {
+		if _, err := ParseSecrets([]string{s}, ""); err == nil {
+			t.Errorf("Expected an error for %q", s)
+		}
+	}
+}
+
+func TestAddSecrets(t *testing.T) {
+	defs := []*ecs.ContainerDefinition{
+		{
+			Name: aws.String("sidecar"),
+		},
+		{
+			Name: aws.String("app"),
+			Secrets: []*ecs.Secret{
+				{Name: aws.String("DB_PASSWORD"), ValueFrom: aws.String("arn:aws:ssm:us-east-1:012345678910:parameter/old")},
+			},
+		},
+	}
+
+	err := addSecrets(defs, map[string][]*ecs.Secret{
+		"": {
+			{Name: aws.String("DD_API_KEY"), ValueFrom: aws.String("arn:aws:ssm:us-east-1:012345678910:parameter/dd")},
+		},
+		"app": {
+			{Name: aws.String("DB_PASSWORD"), ValueFrom: aws.String("arn:aws:ssm:us-east-1:012345678910:parameter/new")},
+			{Name: aws.String("API_KEY"), ValueFrom: aws.String("arn:aws:ssm:us-east-1:012345678910:parameter/api-key")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(defs[0].Secrets) != 1 || *defs[0].Secrets[0].Name != "DD_API_KEY" {
+		t.Fatalf("Expected the secret without a container on the first container, got %v", defs[0].Secrets)
+	}
+	if len(defs[1].Secrets) != 2 ||
+		*defs[1].Secrets[0].ValueFrom != "arn:aws:ssm:us-east-1:012345678910:parameter/new" ||
+		*defs[1].Secrets[1].Name != "API_KEY" {
+		t.Fatalf("Expected the app's secrets to be replaced and added, got %v", defs[1].Secrets)
+	}
+
+	if err := addSecrets(defs, map[string][]*ecs.Secret{"llamas": nil}); err == nil {
+		t.Fatal("Expected an error for an unknown container")
+	}
+}
+
+func TestAuditSecrets(t *testing.T) {
+	const (
+		dbPassword = "arn:aws:secretsmanager:us-east-1:012345678910:secret:db-password-AbCdEf"
+		apiKey     = "arn:aws:ssm:us-east-1:012345678910:parameter/api-key"
+		registry   = "arn:aws:secretsmanager:us-east-1:012345678910:secret:registry-GhIjKl"
+	)
+	defs := []*ecs.ContainerDefinition{
+		{
+			Name:                  aws.String("app"),
+			RepositoryCredentials: &ecs.RepositoryCredentials{CredentialsParameter: aws.String(registry)},
+			Secrets: []*ecs.Secret{
+				{Name: aws.String("DB_PASSWORD"), ValueFrom: aws.String(dbPassword)},
+			},
+		},
+		{
+			Name: aws.String("sidecar"),
+			Secrets: []*ecs.Secret{
+				{Name: aws.String("API_KEY"), ValueFrom: aws.String(apiKey)},
+			},
+		},
+		{
+			Name: aws.String("plain"),
+		},
+	}
+
+	refs := auditSecrets(defs)
+	expected := []SecretReference{
+		{Container: "app", ValueFrom: registry},
+		{Container: "app", Name: "DB_PASSWORD", ValueFrom: dbPassword},
+		{Container: "sidecar", Name: "API_KEY", ValueFrom: apiKey},
+	}
+	if !reflect.DeepEqual(refs, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, refs)
+	}
+
+	var buf bytes.Buffer
+	writeSecretsAudit(&buf, refs)
+	for _, arn := range []string{dbPassword, apiKey, registry} {
+		if !strings.Contains(buf.String(), arn) {
+			t.Errorf("Expected %s in the audit output, got %q", arn, buf.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if err := writeSummary(&out, "json", &Summary{Secrets: refs}); err != nil {
+		t.Fatal(err)
+	}
+	for _, arn := range []string{dbPassword, apiKey, registry} {
+		if !strings.Contains(out.String(), arn) {
+			t.Errorf("Expected %s in the JSON summary, got %q", arn, out.String())
+		}
+	}
+}
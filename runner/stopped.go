@@ -0,0 +1,71 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// stoppedTaskRetention is roughly how long ECS keeps describing a task after
+// it stops, after which it's reaped and DescribeTasks reports it as missing
+const stoppedTaskRetention = "an hour"
+
+// describeStoppedTasks describes the stopped tasks again and writes the
+// details that are useful when debugging why a task failed, such as its
+// network interfaces and attachments
+func describeStoppedTasks(w io.Writer, svc ecsInterface, cluster string, taskARNs []*string) error {
+	output, err := describeTasks(svc, cluster, taskARNs)
+	if err != nil {
+		return fmt.Errorf("failed to describe stopped tasks: %v", err)
+	}
+
+	for _, task := range output.Tasks {
+		writeStoppedTask(w, task)
+	}
+	for _, failure := range output.Failures {
+		fmt.Fprintf(w, "Task %s: %s\n", aws.StringValue(failure.Arn), aws.StringValue(failure.Reason))
+	}
+
+	fmt.Fprintf(w, "\nECS keeps stopped tasks for about %s, inspect them with:\n\n"+
+		"  aws ecs describe-tasks --cluster %s --tasks %s\n\n",
+		stoppedTaskRetention, cluster, strings.Join(aws.StringValueSlice(taskARNs), " "))
+	return nil
+}
+
+func writeStoppedTask(w io.Writer, task *ecs.Task) {
+	fmt.Fprintf(w, "Task %s (%s)\n", path.Base(aws.StringValue(task.TaskArn)), aws.StringValue(task.LastStatus))
+	if task.StopCode != nil || task.StoppedReason != nil {
+		fmt.Fprintf(w, "  Stopped: %s %s\n", aws.StringValue(task.StopCode), aws.StringValue(task.StoppedReason))
+	}
+	if task.ContainerInstanceArn != nil {
+		fmt.Fprintf(w, "  Container instance: %s\n", aws.StringValue(task.ContainerInstanceArn))
+	}
+
+	for _, attachment := range task.Attachments {
+		fmt.Fprintf(w, "  Attachment %s %s (%s)\n",
+			aws.StringValue(attachment.Type), aws.StringValue(attachment.Id), aws.StringValue(attachment.Status))
+		for _, detail := range attachment.Details {
+			fmt.Fprintf(w, "    %s: %s\n", aws.StringValue(detail.Name), aws.StringValue(detail.Value))
+		}
+	}
+
+	for _, container := range task.Containers {
+		fmt.Fprintf(w, "  Container %s (%s) exit code %s",
+			aws.StringValue(container.Name), aws.StringValue(container.LastStatus), formatExitCode(container.ExitCode))
+		if container.Reason != nil {
+			fmt.Fprintf(w, ": %s", aws.StringValue(container.Reason))
+		}
+		fmt.Fprintln(w)
+		for _, ni := range container.NetworkInterfaces {
+			ip := aws.StringValue(ni.PrivateIpv4Address)
+			if ip == "" {
+				ip = aws.StringValue(ni.Ipv6Address)
+			}
+			fmt.Fprintf(w, "    Network interface %s %s\n", aws.StringValue(ni.AttachmentId), ip)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package runner
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestDescribeStoppedTasksPrintsDetails(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123"
+	svc := &mockECS{
+		tasks: map[string]*ecs.Task{
+			taskArn: {
+				TaskArn:       aws.String(taskArn),
+				LastStatus:    aws.String("STOPPED"),
+				StopCode:      aws.String(ecs.TaskStopCodeEssentialContainerExited),
+				StoppedReason: aws.String("Essential container in task exited"),
+				Attachments: []*ecs.Attachment{
+					{
+						Id:     aws.String("eni-attachment-1"),
+						Type:   aws.String("ElasticNetworkInterface"),
+						Status: aws.String("DELETED"),
+						Details: []*ecs.KeyValuePair{
+							{Name: aws.String("subnetId"), Value: aws.String("subnet-123")},
+							{Name: aws.String("networkInterfaceId"), Value: aws.String("eni-456")},
+						},
+					},
+				},
+				Containers: []*ecs.Container{
+					{
+						Name:       aws.String("app"),
+						LastStatus: aws.String("STOPPED"),
+						ExitCode:   aws.Int64(2),
+						NetworkInterfaces: []*ecs.NetworkInterface{
+							{AttachmentId: aws.String("eni-attachment-1"), PrivateIpv4Address: aws.String("10.0.0.12")},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := describeStoppedTasks(&buf, svc, "my-cluster", aws.StringSlice([]string{taskArn})); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"Task abc123 (STOPPED)",
+		"Stopped: EssentialContainerExited Essential container in task exited",
+		"Attachment ElasticNetworkInterface eni-attachment-1 (DELETED)",
+		"subnetId: subnet-123",
+		"networkInterfaceId: eni-456",
+		"Container app (STOPPED) exit code 2",
+		"Network interface eni-attachment-1 10.0.0.12",
+		"aws ecs describe-tasks --cluster my-cluster --tasks " + taskArn,
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Expected output to contain %q, got:\n%s", expected, buf.String())
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+const (
+	// OutputJSON writes the run summary as JSON
+	OutputJSON = "json"
+
+	// OutputTable writes the run summary as a table
+	OutputTable = "table"
+
+	// SummarySchemaVersion is the version of the JSON summary. It only
+	// changes when fields are removed or change meaning, not when added.
+	SummarySchemaVersion = 1
+)
+
+const (
+	// ExitCodeFirst exits with the first non-zero container exit code
+	ExitCodeFirst = "first"
+
+	// ExitCodeMax exits with the highest container exit code
+	ExitCodeMax = "max"
+
+	// ExitCodeAnyNonzero exits with 1 if any container exited non-zero
+	ExitCodeAnyNonzero = "any-nonzero"
+)
+
+// Summary describes how the tasks in a run went
+type Summary struct {
+	// SchemaVersion is SummarySchemaVersion, so consumers can check they
+	// understand the summary
+	SchemaVersion int           `json:"schemaVersion"`
+	RunID         string        `json:"runId,omitempty"`
+	LogGroupArn   string        `json:"logGroupArn,omitempty"`
+	Tasks         []TaskSummary `json:"tasks"`
+
+	// RequestIDs are the AWS request IDs of the calls that registered the
+	// task definition and ran the tasks, by operation, for CloudTrail
+	RequestIDs map[string][]string `json:"requestIds,omitempty"`
+
+	// Secrets are the secrets the task definition references, with
+	// AuditSecrets
+	Secrets []SecretReference `json:"secrets,omitempty"`
+
+	// ExitCode and ExitReason are what ecs-run-task exits with, from the
+	// container exit codes with the exit code strategy
+	ExitCode   int    `json:"exitCode"`
+	ExitReason string `json:"exitReason"`
+}
+
+// TaskSummary describes a task and its timings. ECS only reports timestamps
+// per task, so the containers in a task share them.
+type TaskSummary struct {
+	TaskArn       string             `json:"taskArn"`
+	CreatedAt     *time.Time         `json:"createdAt,omitempty"`
+	StartedAt     *time.Time         `json:"startedAt,omitempty"`
+	StoppedAt     *time.Time         `json:"stoppedAt,omitempty"`
+	PullSeconds   *float64           `json:"pullSeconds,omitempty"`
+	RunSeconds    *float64           `json:"runSeconds,omitempty"`
+	StoppedReason string             `json:"stoppedReason,omitempty"`
+	TimedOut      bool               `json:"timedOut,omitempty"`
+	Containers    []ContainerSummary `json:"containers"`
+}
+
+// ContainerSummary describes how a container in a task exited
+type ContainerSummary struct {
+	Name     string `json:"name"`
+	ExitCode *int64 `json:"exitCode,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+
+	// LogError is why streaming the container's logs failed, if it did
+	LogError string `json:"logError,omitempty"`
+}
+
+// newSummary builds a summary from the final state of the tasks
+func newSummary(tasks []*ecs.Task) *Summary {
+	summary := &Summary{
+		SchemaVersion: SummarySchemaVersion,
+		Tasks:         []TaskSummary{},
+	}
+
+	for _, task := range tasks {
+		ts := TaskSummary{
+			TaskArn:       aws.StringValue(task.TaskArn),
+			CreatedAt:     task.CreatedAt,
+			StartedAt:     task.StartedAt,
+			StoppedAt:     task.StoppedAt,
+			PullSeconds:   secondsBetween(task.PullStartedAt, task.PullStoppedAt),
+			RunSeconds:    secondsBetween(task.StartedAt, task.StoppedAt),
+			StoppedReason: aws.StringValue(task.StoppedReason),
+			Containers:    []ContainerSummary{},
+		}
+		for _, container := range task.Containers {
+			ts.Containers = append(ts.Containers, ContainerSummary{
+				Name:     aws.StringValue(container.Name),
+				ExitCode: container.ExitCode,
+				Reason:   aws.StringValue(container.Reason),
+			})
+		}
+		summary.Tasks = append(summary.Tasks, ts)
+	}
+
+	summary.ExitCode, summary.ExitReason = computeExitCode(summary.Tasks, ExitCodeFirst)
+	return summary
+}
+
+// computeExitCode returns the exit code and reason for the tasks, going
+// through the containers in order:
+//
+//   - ExitCodeFirst is the first non-zero exit code
+//   - ExitCodeMax is the highest exit code, the earliest if there's a tie
+//   - ExitCodeAnyNonzero is 1 if any exit code is non-zero
+//
+// A container without an exit code never ran, such as when its image
+// couldn't be pulled, so it counts as exiting with 1.
+func computeExitCode(tasks []TaskSummary, strategy string) (int, string) {
+	code, reason := 0, "all containers exited with 0"
+	for _, task := range tasks {
+		for _, container := range task.Containers {
+			c, r := 1, fmt.Sprintf("container %s didn't exit: %s",
+				container.Name, firstNonEmpty(container.Reason, task.StoppedReason, "no exit code"))
+			if container.ExitCode != nil {
+				c, r = int(*container.ExitCode), fmt.Sprintf("container %s exited with %d", container.Name, *container.ExitCode)
+			}
+			if c == 0 {
+				continue
+			}
+
+			switch strategy {
+			case ExitCodeMax:
+				if c > code {
+					code, reason = c, r
+				}
+			case ExitCodeAnyNonzero:
+				return 1, r
+			default:
+				return c, r
+			}
+		}
+	}
+	return code, reason
+}
+
+// ignoreContainers returns the tasks without the named containers, such as
+// sidecars that don't exit cleanly, so they don't affect the exit code. Any
+// names that aren't containers in the tasks are returned too.
+func ignoreContainers(tasks []TaskSummary, names []string) ([]TaskSummary, []string) {
+	if len(names) == 0 {
+		return tasks, nil
+	}
+	ignored := map[string]bool{}
+	for _, name := range names {
+		ignored[name] = false
+	}
+
+	var filtered []TaskSummary
+	for _, task := range tasks {
+		var containers []ContainerSummary
+		for _, container := range task.Containers {
+			if _, ok := ignored[container.Name]; ok {
+				ignored[container.Name] = true
+				continue
+			}
+			containers = append(containers, container)
+		}
+		task.Containers = containers
+		filtered = append(filtered, task)
+	}
+
+	var unknown []string
+	for _, name := range names {
+		if !ignored[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	return filtered, unknown
+}
+
+// validExitCodeStrategy returns an error if the exit code strategy isn't known
+func validExitCodeStrategy(strategy string) error {
+	switch strategy {
+	case "", ExitCodeFirst, ExitCodeMax, ExitCodeAnyNonzero:
+		return nil
+	}
+	return fmt.Errorf("unknown exit code strategy %q, expected %q, %q or %q",
+		strategy, ExitCodeFirst, ExitCodeMax, ExitCodeAnyNonzero)
+}
+
+// setLogErrors records the errors the log watchers stopped with on their
+// containers. They don't affect the exit code.
+func (s *Summary) setLogErrors(errs *watchErrors) {
+	for i, task := range s.Tasks {
+		for j, container := range task.Containers {
+			if err := errs.Get(task.TaskArn, container.Name); err != nil {
+				s.Tasks[i].Containers[j].LogError = err.Error()
+			}
+		}
+	}
+}
+
+// secondsBetween returns the seconds between two timestamps, or nil if either
+// of them is missing
+func secondsBetween(start, end *time.Time) *float64 {
+	if start == nil || end == nil {
+		return nil
+	}
+	return aws.Float64(end.Sub(*start).Seconds())
+}
+
+// validOutput returns an error if the output format isn't known
+func validOutput(format string) error {
+	switch format {
+	case "", OutputJSON, OutputTable:
+		return nil
+	}
+	return fmt.Errorf("unknown output %q, expected %q or %q", format, OutputJSON, OutputTable)
+}
+
+// writeSummary writes the summary to w in the given format
+func writeSummary(w io.Writer, format string, summary *Summary) error {
+	switch format {
+	case OutputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(summary)
+	case OutputTable:
+		if summary.RunID != "" {
+			fmt.Fprintf(w, "Run %s\n", summary.RunID)
+		}
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TASK\tCONTAINER\tEXIT CODE\tPULL\tRUN")
+		for _, task := range summary.Tasks {
+			for _, container := range task.Containers {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+					path.Base(task.TaskArn),
+					container.Name,
+					formatExitCode(container.ExitCode),
+					formatSeconds(task.PullSeconds),
+					formatSeconds(task.RunSeconds),
+				)
+			}
+		}
+		return tw.Flush()
+	}
+	return validOutput(format)
+}
+
+func formatExitCode(code *int64) string {
+	if code == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d", *code)
+}
+
+func formatSeconds(seconds *float64) string {
+	if seconds == nil {
+		return "-"
+	}
+	return (time.Duration(*seconds * float64(time.Second))).Round(time.Millisecond).String()
+}
+
+// combineSummaries combines the summaries of runs of several task
+// definitions into one for the whole run. The exit code is left for the
+// caller to compute across all of the tasks.
+func combineSummaries(summaries []*Summary) *Summary {
+	combined := &Summary{
+		SchemaVersion: SummarySchemaVersion,
+		Tasks:         []TaskSummary{},
+	}
+	for _, s := range summaries {
+		if combined.RunID == "" {
+			combined.RunID = s.RunID
+		}
+		if combined.LogGroupArn == "" {
+			combined.LogGroupArn = s.LogGroupArn
+		}
+		combined.Tasks = append(combined.Tasks, s.Tasks...)
+		combined.Secrets = append(combined.Secrets, s.Secrets...)
+		for op, ids := range s.RequestIDs {
+			if combined.RequestIDs == nil {
+				combined.RequestIDs = map[string][]string{}
+			}
+			combined.RequestIDs[op] = append(combined.RequestIDs[op], ids...)
+		}
+	}
+	return combined
+}
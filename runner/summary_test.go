@@ -0,0 +1,332 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestSummaryDurations(t *testing.T) {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	summary := newSummary([]*ecs.Task{
+		{
+			TaskArn:       aws.String("arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123"),
+			CreatedAt:     aws.Time(created),
+			PullStartedAt: aws.Time(created.Add(time.Second)),
+			PullStoppedAt: aws.Time(created.Add(11 * time.Second)),
+			StartedAt:     aws.Time(created.Add(12 * time.Second)),
+			StoppedAt:     aws.Time(created.Add(72 * time.Second)),
+			Containers: []*ecs.Container{
+				{Name: aws.String("app"), ExitCode: aws.Int64(0)},
+			},
+		},
+		{
+			TaskArn: aws.String("arn:aws:ecs:us-east-1:012345678910:task/my-cluster/def456"),
+			Containers: []*ecs.Container{
+				{Name: aws.String("app"), Reason: aws.String("CannotPullContainerError")},
+			},
+		},
+	})
+
+	if l := len(summary.Tasks); l != 2 {
+		t.Fatal("bad number of tasks", l)
+	}
+	if pull := summary.Tasks[0].PullSeconds; pull == nil || *pull != 10 {
+		t.Fatalf("bad pull seconds %v", pull)
+	}
+	if run := summary.Tasks[0].RunSeconds; run == nil || *run != 60 {
+		t.Fatalf("bad run seconds %v", run)
+	}
+	if summary.Tasks[1].PullSeconds != nil || summary.Tasks[1].RunSeconds != nil {
+		t.Fatal("expected missing timestamps to have no durations")
+	}
+
+	var buf bytes.Buffer
+	if err := writeSummary(&buf, OutputJSON, summary); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Summary
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if run := decoded.Tasks[0].RunSeconds; run == nil || *run != 60 {
+		t.Fatalf("bad run seconds in json %v", run)
+	}
+
+	buf.Reset()
+	if err := writeSummary(&buf, OutputTable, summary); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "10s") || !strings.Contains(buf.String(), "1m0s") {
+		t.Fatalf("expected durations in table output, got %q", buf.String())
+	}
+}
+
+func TestValidOutput(t *testing.T) {
+	if err := validOutput("llamas"); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+}
+
+func TestSummarySchemaVersion(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeSummary(&buf, OutputJSON, newSummary(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := decoded["schemaVersion"]; !ok || v != float64(1) {
+		t.Fatalf("Expected schemaVersion 1, got %v", v)
+	}
+}
+
+func TestSummaryJSONShape(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeSummary(&buf, OutputJSON, newSummary([]*ecs.Task{
+		{
+			TaskArn:       aws.String("arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123"),
+			StoppedReason: aws.String("Essential container in task exited"),
+			Containers: []*ecs.Container{
+				{Name: aws.String("app"), ExitCode: aws.Int64(3)},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded struct {
+		Tasks []struct {
+			TaskArn       string `json:"taskArn"`
+			StoppedReason string `json:"stoppedReason"`
+			Containers    []struct {
+				Name     string `json:"name"`
+				ExitCode *int64 `json:"exitCode"`
+			} `json:"containers"`
+		} `json:"tasks"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded.Tasks) != 1 || len(decoded.Tasks[0].Containers) != 1 {
+		t.Fatalf("bad summary %s", buf.String())
+	}
+	task := decoded.Tasks[0]
+	if task.TaskArn != "arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123" ||
+		task.StoppedReason != "Essential container in task exited" {
+		t.Fatalf("bad task %+v", task)
+	}
+	if c := task.Containers[0]; c.Name != "app" || c.ExitCode == nil || *c.ExitCode != 3 {
+		t.Fatalf("bad container %+v", c)
+	}
+}
+
+func TestSummaryExitStatusMatchesContainers(t *testing.T) {
+	summary := newSummary([]*ecs.Task{
+		{
+			TaskArn: aws.String("arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123"),
+			Containers: []*ecs.Container{
+				{Name: aws.String("app"), ExitCode: aws.Int64(0)},
+			},
+		},
+		{
+			TaskArn: aws.String("arn:aws:ecs:us-east-1:012345678910:task/my-cluster/def456"),
+			Containers: []*ecs.Container{
+				{Name: aws.String("migrate"), ExitCode: aws.Int64(0)},
+				{Name: aws.String("app"), ExitCode: aws.Int64(42)},
+				{Name: aws.String("sidecar"), ExitCode: aws.Int64(137)},
+			},
+		},
+	})
+
+	var buf bytes.Buffer
+	if err := writeSummary(&buf, OutputJSON, summary); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Summary
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first non-zero container wins
+	winner := decoded.Tasks[1].Containers[1]
+	if decoded.ExitCode != int(*winner.ExitCode) || decoded.ExitCode != 42 {
+		t.Fatalf("Expected exitCode 42 from %s, got %d", winner.Name, decoded.ExitCode)
+	}
+	if decoded.ExitReason != "container app exited with 42" {
+		t.Fatalf("bad exit reason %q", decoded.ExitReason)
+	}
+
+	summary = newSummary([]*ecs.Task{
+		{
+			TaskArn: aws.String("arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123"),
+			Containers: []*ecs.Container{
+				{Name: aws.String("app"), Reason: aws.String("CannotPullContainerError")},
+			},
+		},
+	})
+	if summary.ExitCode != 1 || !strings.Contains(summary.ExitReason, "CannotPullContainerError") {
+		t.Fatalf("bad exit status %d %q", summary.ExitCode, summary.ExitReason)
+	}
+
+	if summary = newSummary(nil); summary.ExitCode != 0 || summary.ExitReason == "" {
+		t.Fatalf("bad exit status %d %q", summary.ExitCode, summary.ExitReason)
+	}
+}
+
+func TestComputeExitCode(t *testing.T) {
+	container := func(name string, code int64) ContainerSummary {
+		return ContainerSummary{Name: name, ExitCode: aws.Int64(code)}
+	}
+	tasks := []TaskSummary{
+		{Containers: []ContainerSummary{container("a", 0), container("b", 2)}},
+		{Containers: []ContainerSummary{container("c", 137), container("d", 0)}},
+		{Containers: []ContainerSummary{container("e", 42), {Name: "f", Reason: "CannotPullContainerError"}}},
+	}
+	succeeded := []TaskSummary{
+		{Containers: []ContainerSummary{container("a", 0)}},
+		{Containers: []ContainerSummary{container("b", 0)}},
+	}
+	notRun := []TaskSummary{
+		{Containers: []ContainerSummary{container("a", 0), {Name: "b", Reason: "CannotPullContainerError"}}},
+	}
+
+	for _, tc := range []struct {
+		strategy   string
+		tasks      []TaskSummary
+		exitCode   int
+		exitReason string
+	}{
+		{ExitCodeFirst, tasks, 2, "container b exited with 2"},
+		{"", tasks, 2, "container b exited with 2"},
+		{ExitCodeMax, tasks, 137, "container c exited with 137"},
+		{ExitCodeAnyNonzero, tasks, 1, "container b exited with 2"},
+		{ExitCodeFirst, succeeded, 0, "all containers exited with 0"},
+		{ExitCodeMax, succeeded, 0, "all containers exited with 0"},
+		{ExitCodeAnyNonzero, succeeded, 0, "all containers exited with 0"},
+		{ExitCodeFirst, notRun, 1, "container b didn't exit: CannotPullContainerError"},
+		{ExitCodeMax, notRun, 1, "container b didn't exit: CannotPullContainerError"},
+		{ExitCodeAnyNonzero, notRun, 1, "container b didn't exit: CannotPullContainerError"},
+	} {
+		code, reason := computeExitCode(tc.tasks, tc.strategy)
+		if code != tc.exitCode || reason != tc.exitReason {
+			t.Errorf("%q: expected %d %q, got %d %q", tc.strategy, tc.exitCode, tc.exitReason, code, reason)
+		}
+	}
+}
+
+func TestIgnoreContainersExitCode(t *testing.T) {
+	tasks := []TaskSummary{
+		{
+			TaskArn: "arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123",
+			Containers: []ContainerSummary{
+				{Name: "app", ExitCode: aws.Int64(0)},
+				{Name: "datadog-agent", ExitCode: aws.Int64(143)},
+			},
+		},
+		{
+			TaskArn: "arn:aws:ecs:us-east-1:012345678910:task/my-cluster/def456",
+			Containers: []ContainerSummary{
+				{Name: "app", ExitCode: aws.Int64(0)},
+				{Name: "datadog-agent", Reason: "CannotPullContainerError"},
+			},
+		},
+	}
+
+	if code, _ := computeExitCode(tasks, ExitCodeFirst); code != 143 {
+		t.Fatalf("Expected the sidecar's exit code without ignoring it, got %d", code)
+	}
+
+	filtered, unknown := ignoreContainers(tasks, []string{"datadog-agent", "proxy"})
+	if code, reason := computeExitCode(filtered, ExitCodeFirst); code != 0 {
+		t.Fatalf("Expected exit code 0 ignoring the sidecar, got %d %q", code, reason)
+	}
+	if !reflect.DeepEqual(unknown, []string{"proxy"}) {
+		t.Fatalf("Expected proxy to be unknown, got %v", unknown)
+	}
+	if len(tasks[0].Containers) != 2 {
+		t.Fatalf("Expected the tasks to be left alone, got %+v", tasks[0])
+	}
+
+	tasks[1].Containers[0].ExitCode = aws.Int64(3)
+	filtered, _ = ignoreContainers(tasks, []string{"datadog-agent"})
+	if code, reason := computeExitCode(filtered, ExitCodeMax); code != 3 || reason != "container app exited with 3" {
+		t.Fatalf("Expected the app's exit code, got %d %q", code, reason)
+	}
+}
+
+func TestValidExitCodeStrategy(t *testing.T) {
+	for _, strategy := range []string{"", ExitCodeFirst, ExitCodeMax, ExitCodeAnyNonzero} {
+		if err := validExitCodeStrategy(strategy); err != nil {
+			t.Errorf("%q: %v", strategy, err)
+		}
+	}
+	if err := validExitCodeStrategy("last"); err == nil {
+		t.Fatal("Expected an error for an unknown strategy")
+	}
+}
+
+func TestSummaryLogErrorsAreIsolated(t *testing.T) {
+	taskArn := "arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123"
+	errs := newWatchErrors()
+	var watchers sync.WaitGroup
+
+	var finished int32
+	for _, name := range []string{"app", "sidecar", "proxy"} {
+		name := name
+		watchers.Add(1)
+		go func() {
+			defer watchers.Done()
+			if name == "sidecar" {
+				errs.Set(taskArn, name, errors.New("ResourceNotFoundException: The specified log group does not exist"))
+				return
+			}
+			// the others keep watching after the sidecar's watcher fails
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&finished, 1)
+		}()
+	}
+	watchers.Wait()
+
+	if finished != 2 {
+		t.Fatalf("Expected the other watchers to finish, got %d", finished)
+	}
+
+	summary := newSummary([]*ecs.Task{
+		{
+			TaskArn: aws.String(taskArn),
+			Containers: []*ecs.Container{
+				{Name: aws.String("app"), ExitCode: aws.Int64(3)},
+				{Name: aws.String("sidecar"), ExitCode: aws.Int64(0)},
+				{Name: aws.String("proxy"), ExitCode: aws.Int64(0)},
+			},
+		},
+	})
+	summary.setLogErrors(errs)
+
+	for _, c := range summary.Tasks[0].Containers {
+		if (c.Name == "sidecar") != (c.LogError != "") {
+			t.Fatalf("Expected only the sidecar to have a log error, got %+v", c)
+		}
+	}
+	if !strings.Contains(summary.Tasks[0].Containers[1].LogError, "log group does not exist") {
+		t.Fatalf("bad log error %q", summary.Tasks[0].Containers[1].LogError)
+	}
+	if summary.ExitCode != 3 {
+		t.Fatalf("Expected log errors not to change the exit code, got %d", summary.ExitCode)
+	}
+}
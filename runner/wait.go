@@ -0,0 +1,301 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// defaultTaskTimeoutInterval is how often tasks are checked against the
+// per-task timeout
+const defaultTaskTimeoutInterval = time.Second * 10
+
+const (
+	// minDescribeInterval is how often tasks are described when polling with
+	// backoff, which matches the ECS waiter's fixed delay
+	minDescribeInterval = time.Second * 6
+
+	// maxDescribeInterval caps the backoff when polling
+	maxDescribeInterval = time.Minute
+)
+
+// interruptedReason is the stop reason for tasks when the run is cancelled,
+// such as by a SIGINT or SIGTERM
+const interruptedReason = "Interrupted by ecs-run-task"
+
+// logMatcher signals once a log line matches a pattern, optionally only from
+// a single container
+type logMatcher struct {
+	re        *regexp.Regexp
+	container string
+	once      sync.Once
+	matched   chan struct{}
+}
+
+func newLogMatcher(pattern string) (*logMatcher, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &logMatcher{re: re, matched: make(chan struct{})}, nil
+}
+
+// newContainerLogMatcher parses a CONTAINER:REGEX matcher that only matches
+// log lines from the named container
+func newContainerLogMatcher(spec string) (*logMatcher, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("expected CONTAINER:REGEX, got %q", spec)
+	}
+	m, err := newLogMatcher(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	m.container = parts[0]
+	return m, nil
+}
+
+// MatchContainer checks a log line from a container, ignoring it if the
+// matcher is for a different container
+func (m *logMatcher) MatchContainer(container, line string) bool {
+	if m.container != "" && m.container != container {
+		return false
+	}
+	return m.Match(line)
+}
+
+// Match checks a log line against the pattern, signalling if it matches
+func (m *logMatcher) Match(line string) bool {
+	if !m.re.MatchString(line) {
+		return false
+	}
+	m.once.Do(func() {
+		log.Printf("Found log line matching %s: %s", m.re, line)
+		close(m.matched)
+	})
+	return true
+}
+
+// Matched returns whether a log line has matched yet
+func (m *logMatcher) Matched() bool {
+	select {
+	case <-m.matched:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitUntilStopped calls wait until it succeeds, retrying on timeouts. If a
+// matcher is given, it returns early with true once a log line matches.
+func waitUntilStopped(ctx context.Context, wait func(context.Context) error, m *logMatcher) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if m != nil {
+		go func() {
+			select {
+			case <-m.matched:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	for {
+		err := wait(ctx)
+		if m != nil && m.Matched() {
+			return true, nil
+		}
+		if err == nil {
+			return false, nil
+		}
+		if !isAwsTimeOutError(err) {
+			return false, err
+		}
+	}
+}
+
+// cancelRun stops the tasks once the run's context is done, returning an
+// error for why the run ended early
+func (r *Runner) cancelRun(ctx context.Context, svc ecsInterface, taskARNs []*string) error {
+	reason, stopReason := "Run was cancelled", interruptedReason
+	if ctx.Err() == context.DeadlineExceeded {
+		reason, stopReason = "Run timed out", "Run timed out"
+	}
+
+	if err := r.StopTasks(svc, taskARNs, stopReason); err != nil {
+		return fmt.Errorf("%s and failed to stop tasks: %v", reason, err)
+	}
+
+	return errors.New(reason)
+}
+
+// StopTasks stops each of the given tasks in the runner's cluster
+func (r *Runner) StopTasks(svc ecsInterface, taskARNs []*string, reason string) error {
+	return stopTasks(svc, r.Cluster, taskARNs, reason)
+}
+
+// stopTasks stops the given tasks with a reason
+func stopTasks(svc ecsInterface, cluster string, taskARNs []*string, reason string) error {
+	for _, arn := range taskARNs {
+		log.Printf("Stopping task %s", *arn)
+		_, err := svc.StopTask(&ecs.StopTaskInput{
+			Cluster: aws.String(cluster),
+			Task:    arn,
+			Reason:  aws.String(reason),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// taskTimeouts stops individual tasks that have been running for longer than
+// a timeout, leaving the other tasks in the run alone
+type taskTimeouts struct {
+	svc      ecsInterface
+	cluster  string
+	timeout  time.Duration
+	interval time.Duration
+
+	mu       sync.Mutex
+	timedOut map[string]bool
+}
+
+func newTaskTimeouts(svc ecsInterface, cluster string, timeout time.Duration) *taskTimeouts {
+	return &taskTimeouts{
+		svc:      svc,
+		cluster:  cluster,
+		timeout:  timeout,
+		interval: defaultTaskTimeoutInterval,
+		timedOut: map[string]bool{},
+	}
+}
+
+// Watch checks the tasks until the context is done
+func (t *taskTimeouts) Watch(ctx context.Context, taskARNs []*string) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.check(taskARNs, time.Now()); err != nil {
+				log.Printf("Failed to check for timed out tasks: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check stops any task that started more than the timeout before now, or for
+// a task that hasn't started, such as one stuck PENDING, was created then
+func (t *taskTimeouts) check(taskARNs []*string, now time.Time) error {
+	output, err := describeTasks(t.svc, t.cluster, taskARNs)
+	if err != nil {
+		return err
+	}
+
+	for _, task := range output.Tasks {
+		since := task.StartedAt
+		if since == nil {
+			since = task.CreatedAt
+		}
+		if aws.StringValue(task.LastStatus) == ecs.DesiredStatusStopped || since == nil {
+			continue
+		}
+		if now.Sub(*since) <= t.timeout || t.TimedOut(*task.TaskArn) {
+			continue
+		}
+
+		log.Printf("Task %s has been %s for longer than %v", *task.TaskArn,
+			strings.ToLower(aws.StringValue(task.LastStatus)), t.timeout)
+		reason := fmt.Sprintf("Task exceeded --per-task-timeout of %v", t.timeout)
+		if err := stopTasks(t.svc, t.cluster, []*string{task.TaskArn}, reason); err != nil {
+			return err
+		}
+
+		t.mu.Lock()
+		t.timedOut[*task.TaskArn] = true
+		t.mu.Unlock()
+	}
+
+	return nil
+}
+
+// TimedOut returns whether a task was stopped for exceeding the timeout
+func (t *taskTimeouts) TimedOut(taskARN string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.timedOut[taskARN]
+}
+
+// describeBackoff doubles the interval between describes while the tasks'
+// statuses stay the same, resetting when any of them change
+type describeBackoff struct {
+	min, max time.Duration
+
+	interval time.Duration
+	statuses string
+}
+
+// Next returns how long to wait before describing again, given the statuses
+// from the latest describe
+func (b *describeBackoff) Next(statuses string) time.Duration {
+	if b.interval == 0 || statuses != b.statuses {
+		b.interval = b.min
+		b.statuses = statuses
+		return b.interval
+	}
+	b.interval *= 2
+	if b.interval > b.max {
+		b.interval = b.max
+	}
+	return b.interval
+}
+
+// pollUntilStopped describes the tasks until they've all stopped, backing
+// off while their statuses don't change
+func pollUntilStopped(ctx context.Context, svc ecsInterface, cluster string, taskARNs []*string,
+	backoff *describeBackoff, sleep func(context.Context, time.Duration) error) error {
+	for {
+		var statuses []string
+		output, err := describeTasks(svc, cluster, taskARNs)
+		if err != nil && !isRateLimited(err) {
+			return err
+		} else if err == nil {
+			if len(output.Failures) > 0 {
+				return fmt.Errorf("failed to describe task %s: %s",
+					aws.StringValue(output.Failures[0].Arn), aws.StringValue(output.Failures[0].Reason))
+			}
+			stopped := true
+			for _, task := range output.Tasks {
+				status := aws.StringValue(task.LastStatus)
+				statuses = append(statuses, status)
+				if status != ecs.DesiredStatusStopped {
+					stopped = false
+				}
+			}
+			if stopped {
+				return nil
+			}
+		}
+
+		interval := backoff.Next(strings.Join(statuses, ","))
+		log.Printf("Tasks are %v, describing again in %v", statuses, interval)
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+func TestWaitUntilStoppedReturnsOnLogMatch(t *testing.T) {
+	m, err := newLogMatcher(`Server started on port \d+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a wait that only returns when cancelled, like a task that never stops
+	wait := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		m.Match("Starting up")
+		m.Match("Server started on port 8080")
+	}()
+
+	matched, err := waitUntilStopped(context.Background(), wait, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matched {
+		t.Fatal("Expected the log match to end the wait")
+	}
+}
+
+func TestWaitUntilStoppedWithoutMatcher(t *testing.T) {
+	var calls int
+	wait := func(ctx context.Context) error {
+		calls++
+		return nil
+	}
+
+	matched, err := waitUntilStopped(context.Background(), wait, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched || calls != 1 {
+		t.Fatalf("Expected a single wait without a match, got %d calls and matched %v", calls, matched)
+	}
+
+	wait = func(ctx context.Context) error {
+		return errors.New("llamas")
+	}
+	if _, err := waitUntilStopped(context.Background(), wait, nil); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+}
+
+func TestStopTasks(t *testing.T) {
+	svc := &mockECS{}
+
+	err := stopTasks(svc, "my-cluster", aws.StringSlice([]string{"task-a", "task-b"}), "Stopped by ecs-run-task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(svc.stopped) != 2 || svc.stopped[0] != "task-a" || svc.stopped[1] != "task-b" {
+		t.Fatalf("bad stopped tasks %v", svc.stopped)
+	}
+}
+
+func TestRunnerStopTasksOnInterrupt(t *testing.T) {
+	svc := &mockECS{}
+	r := New()
+	r.Cluster = "my-cluster"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := r.cancelRun(ctx, svc, aws.StringSlice([]string{"task-a", "task-b"}))
+	if err == nil || err.Error() != "Run was cancelled" {
+		t.Fatalf("Expected a cancelled error, got %v", err)
+	}
+	if len(svc.stopped) != 2 || svc.stopped[0] != "task-a" || svc.stopped[1] != "task-b" {
+		t.Fatalf("bad stopped tasks %v", svc.stopped)
+	}
+	for _, reason := range svc.stopReasons {
+		if reason != interruptedReason {
+			t.Fatalf("bad stop reason %q", reason)
+		}
+	}
+}
+
+func TestCancelRunStopsTasksOnTimeout(t *testing.T) {
+	svc := &mockECS{}
+	taskARNs := aws.StringSlice([]string{"task-a"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// a wait that only returns when cancelled, like a hung task
+	wait := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	if _, err := waitUntilStopped(ctx, wait, nil); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+
+	r := New()
+	r.Cluster = "my-cluster"
+	err := r.cancelRun(ctx, svc, taskARNs)
+	if err == nil || err.Error() != "Run timed out" {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+	if len(svc.stopped) != 1 || svc.stopped[0] != "task-a" {
+		t.Fatalf("Expected task-a to be stopped, got %v", svc.stopped)
+	}
+}
+
+func TestTaskTimeoutsStopsOnlySlowTasks(t *testing.T) {
+	now := time.Now()
+	svc := &mockECS{
+		tasks: map[string]*ecs.Task{
+			"task-slow": {
+				TaskArn:    aws.String("task-slow"),
+				LastStatus: aws.String("RUNNING"),
+				StartedAt:  aws.Time(now.Add(-2 * time.Minute)),
+			},
+			"task-done": {
+				TaskArn:    aws.String("task-done"),
+				LastStatus: aws.String("STOPPED"),
+				StartedAt:  aws.Time(now.Add(-2 * time.Minute)),
+			},
+			"task-fast": {
+				TaskArn:    aws.String("task-fast"),
+				LastStatus: aws.String("RUNNING"),
+				StartedAt:  aws.Time(now.Add(-10 * time.Second)),
+			},
+			"task-stuck": {
+				TaskArn:    aws.String("task-stuck"),
+				LastStatus: aws.String("PENDING"),
+				CreatedAt:  aws.Time(now.Add(-2 * time.Minute)),
+			},
+			"task-pending": {
+				TaskArn:    aws.String("task-pending"),
+				LastStatus: aws.String("PENDING"),
+				CreatedAt:  aws.Time(now.Add(-10 * time.Second)),
+			},
+		},
+	}
+	taskARNs := aws.StringSlice([]string{"task-slow", "task-done", "task-fast", "task-stuck", "task-pending"})
+
+	timeouts := newTaskTimeouts(svc, "my-cluster", time.Minute)
+	if err := timeouts.check(taskARNs, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// checking again shouldn't stop the slow task twice
+	if err := timeouts.check(taskARNs, now); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(svc.stopped)
+	if !reflect.DeepEqual(svc.stopped, []string{"task-slow", "task-stuck"}) {
+		t.Fatalf("Expected only task-slow and task-stuck to be stopped, got %v", svc.stopped)
+	}
+	if !timeouts.TimedOut("task-slow") || !timeouts.TimedOut("task-stuck") ||
+		timeouts.TimedOut("task-done") || timeouts.TimedOut("task-fast") || timeouts.TimedOut("task-pending") {
+		t.Fatal("Expected only task-slow and task-stuck to have timed out")
+	}
+}
+
+func TestDescribeBackoffGrowsWhileRunning(t *testing.T) {
+	b := &describeBackoff{min: 6 * time.Second, max: time.Minute}
+
+	var intervals []time.Duration
+	for _, statuses := range []string{"PENDING", "RUNNING", "RUNNING", "RUNNING", "RUNNING", "RUNNING", "RUNNING", "DEPROVISIONING"} {
+		intervals = append(intervals, b.Next(statuses))
+	}
+
+	expected := []time.Duration{6, 6, 12, 24, 48, 60, 60, 6}
+	for i := range expected {
+		if intervals[i] != expected[i]*time.Second {
+			t.Fatalf("bad intervals %v", intervals)
+		}
+	}
+}
+
+func TestPollUntilStopped(t *testing.T) {
+	task := &ecs.Task{TaskArn: aws.String("task-a"), LastStatus: aws.String("RUNNING")}
+	svc := &mockECS{tasks: map[string]*ecs.Task{"task-a": task}}
+
+	var slept []time.Duration
+	sleep := func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		if len(slept) == 4 {
+			task.LastStatus = aws.String("STOPPED")
+		}
+		return nil
+	}
+
+	b := &describeBackoff{min: time.Second, max: 5 * time.Second}
+	if err := pollUntilStopped(context.Background(), svc, "my-cluster", aws.StringSlice([]string{"task-a"}), b, sleep); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(slept) != 4 || slept[0] != time.Second || slept[1] != 2*time.Second || slept[2] != 4*time.Second || slept[3] != 5*time.Second {
+		t.Fatalf("bad intervals %v", slept)
+	}
+}
+
+func TestReadyWhenMatchesNamedContainer(t *testing.T) {
+	m, err := newContainerLogMatcher(`db:ready to accept connections`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wait := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		if m.MatchContainer("app", "db is ready to accept connections") {
+			t.Error("Expected a line from another container not to match")
+		}
+		m.MatchContainer("db", "initializing")
+		m.MatchContainer("db", "database system is ready to accept connections")
+	}()
+
+	matched, err := waitUntilStopped(context.Background(), wait, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matched {
+		t.Fatal("Expected the named container's marker to end the wait")
+	}
+
+	for _, spec := range []string{"db", ":ready", "db:", "db:("} {
+		if _, err := newContainerLogMatcher(spec); err == nil {
+			t.Errorf("Expected an error for %q, got nil", spec)
+		}
+	}
+}
+
+func TestPollUntilStoppedOverOneHundredTasks(t *testing.T) {
+	svc := &mockECS{tasks: map[string]*ecs.Task{}}
+	var taskARNs []string
+	for i := 0; i < 150; i++ {
+		arn := fmt.Sprintf("task-%d", i)
+		svc.tasks[arn] = &ecs.Task{TaskArn: aws.String(arn), LastStatus: aws.String("RUNNING")}
+		taskARNs = append(taskARNs, arn)
+	}
+
+	sleep := func(ctx context.Context, d time.Duration) error {
+		for _, task := range svc.tasks {
+			task.LastStatus = aws.String("STOPPED")
+		}
+		return nil
+	}
+
+	b := &describeBackoff{min: time.Second, max: 5 * time.Second}
+	if err := pollUntilStopped(context.Background(), svc, "my-cluster", aws.StringSlice(taskARNs), b, sleep); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := describeTasks(svc, "my-cluster", aws.StringSlice(taskARNs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(output.Tasks) != 150 {
+		t.Fatalf("Expected all 150 tasks to be described, got %d", len(output.Tasks))
+	}
+}
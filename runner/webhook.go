@@ -0,0 +1,56 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const defaultWebhookTimeout = time.Second * 10
+
+var (
+	// webhookRetries is how many times to retry a failed webhook
+	webhookRetries = 2
+
+	// webhookRetryDelay is how long to wait between webhook attempts
+	webhookRetryDelay = time.Second * 2
+)
+
+// postSummary POSTs the summary as JSON to a webhook, retrying on failure
+func postSummary(url string, timeout time.Duration, summary *Summary) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	if timeout == time.Duration(0) {
+		timeout = defaultWebhookTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+
+	for attempt := 0; ; attempt++ {
+		err = postJSON(client, url, body)
+		if err == nil || attempt >= webhookRetries {
+			return err
+		}
+		log.Printf("Retrying webhook after error: %v", err)
+		time.Sleep(webhookRetryDelay)
+	}
+}
+
+func postJSON(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Failed to POST result to %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Failed to POST result to %s: %s", url, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package runner
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPostSummary(t *testing.T) {
+	var received Summary
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("bad content type %q", ct)
+		}
+		if err := json.NewDecoder(req.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	summary := &Summary{Tasks: []TaskSummary{{
+		TaskArn:    "arn:aws:ecs:us-east-1:012345678910:task/my-cluster/abc123",
+		Containers: []ContainerSummary{{Name: "app"}},
+	}}}
+
+	if err := postSummary(server.URL, time.Second, summary); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(received.Tasks) != 1 || received.Tasks[0].Containers[0].Name != "app" {
+		t.Fatalf("bad payload received %+v", received)
+	}
+}
+
+func TestPostSummaryRetriesAndFails(t *testing.T) {
+	defer func(d time.Duration) { webhookRetryDelay = d }(webhookRetryDelay)
+	webhookRetryDelay = time.Millisecond
+
+	var attempts int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	if err := postSummary(server.URL, time.Second, &Summary{}); err == nil {
+		t.Fatal("Expected an error, got nil")
+	}
+	if attempts != webhookRetries+1 {
+		t.Fatalf("Expected %d attempts, got %d", webhookRetries+1, attempts)
+	}
+}